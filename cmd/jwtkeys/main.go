@@ -0,0 +1,23 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+	"uneexpo/pkg/keyring"
+)
+
+// Generates an Ed25519 token signing key named after the current date, e.g.
+//
+//	go run cmd/jwtkeys/main.go -dir ./keys -public ./keys-public
+func main() {
+	dir := flag.String("dir", "./keys", "directory for the private key")
+	publicDir := flag.String("public", "", "optional directory for the public key, used to stage a rotation")
+	kid := flag.String("kid", time.Now().Format("2006-01-02"), "key id")
+	flag.Parse()
+
+	if err := keyring.GenerateKey(*dir, *publicDir, *kid); err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
+	log.Printf("Key %s written to %s", *kid, *dir)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"uneexpo/config"
+	"uneexpo/pkg/storage"
+)
+
+// Copies uploaded files between storage backends configured in .env, e.g.
+// from UPLOAD_PATH to the S3 bucket before switching STORAGE_DRIVER:
+//
+//	go run cmd/storagemigrate/main.go -from local -to s3
+//
+// Files already at the destination with the same size are skipped, so an
+// interrupted run can be started again.
+func main() {
+	from := flag.String("from", storage.DriverLocal, "driver to copy from: local or s3")
+	to := flag.String("to", storage.DriverS3, "driver to copy to: local or s3")
+	prefix := flag.String("prefix", "", "only copy keys starting with this prefix")
+	overwrite := flag.Bool("overwrite", false, "copy files that already exist at the destination")
+	dryRun := flag.Bool("dry-run", false, "list the files that would be copied")
+	flag.Parse()
+
+	if *from == *to {
+		log.Fatalf("Source and destination are both %s", *from)
+	}
+
+	config.InitConfig()
+	src, err := storage.Open(*from)
+	if err != nil {
+		log.Fatalf("Failed to open %s storage: %v", *from, err)
+	}
+	dst, err := storage.Open(*to)
+	if err != nil {
+		log.Fatalf("Failed to open %s storage: %v", *to, err)
+	}
+
+	ctx := context.Background()
+	var copied, skipped, failed int
+	err = src.List(ctx, *prefix, func(object storage.ObjectInfo) error {
+		if !*overwrite {
+			existing, err := dst.Stat(ctx, object.Key)
+			if err == nil && existing.Size == object.Size {
+				skipped++
+				return nil
+			}
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return err
+			}
+		}
+
+		if *dryRun {
+			log.Printf("Would copy %s (%d bytes)", object.Key, object.Size)
+			copied++
+			return nil
+		}
+		if err := storage.Copy(ctx, dst, src, object.Key); err != nil {
+			log.Printf("Failed to copy %s: %v", object.Key, err)
+			failed++
+			return nil
+		}
+		copied++
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Failed to list %s storage: %v", *from, err)
+	}
+
+	log.Printf("Copied %d, skipped %d, failed %d files", copied, skipped, failed)
+	if failed > 0 {
+		log.Fatalf("Some files were not copied, run again to retry them")
+	}
+}
@@ -11,10 +11,31 @@ import (
 	"uneexpo/config"
 	"uneexpo/database"
 	app "uneexpo/internal"
+	"uneexpo/internal/apiKeys"
+	"uneexpo/internal/auth"
+	"uneexpo/internal/emails"
 	"uneexpo/internal/firebasePush"
+	"uneexpo/internal/media"
+	"uneexpo/internal/repo"
+	"uneexpo/internal/roles"
 	"uneexpo/internal/scheduler"
+	"uneexpo/internal/uploads"
+	"uneexpo/pkg/activity"
+	"uneexpo/pkg/hmacauth"
+	"uneexpo/pkg/keyring"
+	"uneexpo/pkg/mailer"
+	"uneexpo/pkg/middlewares"
+	mediaService "uneexpo/pkg/media"
+	"uneexpo/pkg/otp"
+	"uneexpo/pkg/ratelimit"
+	"uneexpo/pkg/revocation"
+	"uneexpo/pkg/sms"
 	"uneexpo/pkg/smtp"
+	"uneexpo/pkg/storage"
+	"uneexpo/pkg/utils"
 	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
 func setupSMTPConfig() {
@@ -23,23 +44,199 @@ func setupSMTPConfig() {
 	smtp.DefaultConfig.SenderEmail = config.ENV.SMTP_MAIL
 	smtp.DefaultConfig.Password = config.ENV.SMTP_PASSWORD
 	smtp.DefaultConfig.LogoURL = config.ENV.APP_LOGO_URL
+	smtp.DefaultConfig.Username = config.ENV.SMTP_USERNAME
+	smtp.DefaultConfig.AuthMechanism = config.ENV.SMTP_AUTH
+	smtp.DefaultConfig.SenderName = config.ENV.SMTP_SENDER_NAME
+	smtp.DefaultConfig.ReplyTo = config.ENV.SMTP_REPLY_TO
+
+	security, err := smtp.ParseSecurity(config.ENV.SMTP_SECURITY, config.ENV.SMTP_PORT)
+	if err != nil {
+		log.Fatalf("Failed to parse SMTP_SECURITY: %v", err)
+	}
+	smtp.DefaultConfig.Security = security
+}
+
+// setupMailer renders emails from the embedded templates and queues them in
+// tbl_email_outbox, whose workers send them over SMTP.
+func setupMailer() *mailer.Outbox {
+	if config.ENV.MAIL_DEFAULT_LOCALE != "" {
+		mailer.DefaultLocale = config.ENV.MAIL_DEFAULT_LOCALE
+	}
+
+	outbox := mailer.NewOutbox(smtp.DefaultConfig, emails.OutboxStore{})
+	m, err := mailer.New(outbox, mailer.Options{
+		AppName:      config.ENV.APP_NAME,
+		LogoURL:      config.ENV.APP_LOGO_URL,
+		TemplatesDir: config.ENV.MAIL_TEMPLATES_DIR,
+	})
+	if err != nil {
+		log.Fatalf("Failed to load email templates: %v", err)
+	}
+	mailer.Default = m
+	return outbox
+}
+
+// setupSigningKeys switches token signing to EdDSA when a key directory is
+// configured and keeps reloading it so rotated keys apply without a restart.
+func setupSigningKeys() (stop func()) {
+	if config.ENV.JWT_KEYS_DIR == "" {
+		log.Println("JWT_KEYS_DIR is not set, signing tokens with HS256")
+		return func() {}
+	}
+
+	keys, err := keyring.Load(config.ENV.JWT_KEYS_DIR)
+	if err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
+	utils.SigningKeys = keys
+	return keys.Watch(time.Minute)
+}
+
+// setupStorage picks where uploads are kept: UPLOAD_PATH by default, or an
+// S3-compatible bucket with STORAGE_DRIVER=s3.
+func setupStorage() {
+	store, err := storage.Open(config.ENV.STORAGE_DRIVER)
+	if err != nil {
+		log.Fatalf("Failed to set up storage: %v", err)
+	}
+	storage.Default = store
+}
+
+// setupMediaProcessor starts the workers that process uploaded videos and
+// audio.
+func setupMediaProcessor() *mediaService.Processor {
+	processor := mediaService.NewProcessor()
+	mediaService.DefaultProcessor = processor
+	processor.Start()
+	return processor
+}
+
+// setupPush sends new device alerts, and codes of users without another
+// verified contact, as push notifications to the apps they are logged into.
+func setupPush() {
+	push := func(ctx context.Context, userID int, title, body string) error {
+		tokens, err := repo.GetUserFirebaseTokens(userID)
+		if err != nil || len(tokens) == 0 {
+			return err
+		}
+		return firebasePush.SendToTokens(ctx, tokens, title, body)
+	}
+
+	auth.PushLoginAlert = func(userID int, session repo.Session) error {
+		return push(context.Background(), userID, "New login", "Your account was accessed from "+auth.DescribeDevice(session))
+	}
+	otp.RegisterChannel(otp.PushChannel{
+		HasDevice: func(userID int) bool {
+			tokens, err := repo.GetUserFirebaseTokens(userID)
+			if err != nil {
+				log.Printf("Failed to load push tokens of user %d: %v", userID, err)
+			}
+			return len(tokens) > 0
+		},
+		Push: push,
+	})
+}
+
+func setupRateLimits() {
+	if config.ENV.RATE_LIMIT_BACKEND == "postgres" {
+		ratelimit.DefaultBackend = ratelimit.NewPostgresBackend()
+	}
+}
+
+// setupSMS picks the SMS providers. SMS_PROVIDER=fake writes messages to
+// SMS_FAKE_PATH, or the log, instead of sending them.
+func setupSMS() {
+	if config.ENV.SMS_PROVIDER == "fake" {
+		sms.Default = sms.NewFakeSender(config.ENV.SMS_FAKE_PATH)
+		return
+	}
+
+	senders := []sms.SMSSender{sms.NewGatewaySender("gateway", config.ENV.OTP_SERVICE_ROUTE, sms.OTPFormat{
+		Prefix:      config.ENV.OTP_SERVICE_TEXT,
+		AppName:     config.ENV.APP_NAME,
+		AndroidHash: config.ENV.OTP_ANDROID_HASH,
+	})}
+	if config.ENV.SMS_FALLBACK_ROUTE != "" {
+		androidHash := config.ENV.SMS_FALLBACK_ANDROID_HASH
+		if androidHash == "" {
+			androidHash = config.ENV.OTP_ANDROID_HASH
+		}
+		senders = append(senders, sms.NewGatewaySender("fallback", config.ENV.SMS_FALLBACK_ROUTE, sms.OTPFormat{
+			Prefix:      config.ENV.SMS_FALLBACK_TEXT,
+			AppName:     config.ENV.APP_NAME,
+			AndroidHash: androidHash,
+		}))
+	}
+	sms.Default = sms.NewDispatcher(senders...)
+}
+
+// setupSystemClients loads the secrets internal callers sign requests with.
+// Until SYSTEM_CLIENTS is set, API_SECRET is accepted as the "system" client.
+// SYSTEM_LEGACY_HEADER=1 also accepts unsigned requests carrying API_SECRET
+// in SYSTEM_HEADER, for callers that are not signing yet.
+func setupSystemClients() {
+	secrets, err := hmacauth.ParseClients(config.ENV.SYSTEM_CLIENTS)
+	if err != nil {
+		log.Fatalf("Failed to parse SYSTEM_CLIENTS: %v", err)
+	}
+	if len(secrets) == 0 && config.ENV.API_SECRET != "" {
+		secrets["system"] = config.ENV.API_SECRET
+	}
+	hmacauth.SetClients(secrets)
+
+	if config.ENV.SYSTEM_LEGACY_HEADER == 1 {
+		log.Printf("SYSTEM_LEGACY_HEADER is deprecated: %s is still accepted without a signature", config.ENV.SYSTEM_HEADER)
+		middlewares.AllowLegacySystemHeader(config.ENV.SYSTEM_HEADER, config.ENV.API_SECRET)
+	}
+}
+
+func setupRoutes(router *gin.Engine) {
+	router.GET("/.well-known/jwks.json", auth.JWKS)
+
+	api := router.Group(config.ENV.API_PREFIX)
+	auth.InitRoutes(api)
+	roles.InitRoutes(api)
+	apiKeys.InitRoutes(api)
+	emails.InitRoutes(api)
+	media.InitRoutes(api)
+	uploads.InitRoutes(api)
 }
 
 func main() {
 	config.InitConfig()
 	database.InitDB()
 	setupSMTPConfig()
+	emailOutbox := setupMailer()
+	stopKeyReload := setupSigningKeys()
+	// Handlers still calling utils.CreateToken log in through auth
+	utils.LegacyLogin = auth.LegacyLogin
+	setupRateLimits()
+	setupSystemClients()
+	setupSMS()
+	setupStorage()
+
+	if err := revocation.Start(); err != nil {
+		log.Fatalf("Failed to load token revocations: %v", err)
+	}
+
+	activity.Start()
+	otp.Start(time.Hour)
+	uploads.Start(time.Hour)
 
 	analyticsScheduler := scheduler.NewAnalyticsScheduler()
 	if err := analyticsScheduler.Start(); err != nil {
 		log.Fatalf("Failed to start analytics scheduler: %v", err)
 	}
+	emailOutbox.Start()
+	mediaProcessor := setupMediaProcessor()
 
 	if err := firebasePush.InitFirebase(); err != nil {
 		log.Fatalf("Failed to initialize Firebase: %v", err)
 	}
+	setupPush()
 
 	router := app.InitApp()
+	setupRoutes(router)
 	address := fmt.Sprintf("%v:%v", config.ENV.API_HOST, config.ENV.API_PORT)
 
 	srv := &http.Server{
@@ -67,7 +264,19 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := srv.Shutdown(ctx); err != nil {
+	err := srv.Shutdown(ctx)
+
+	// Stop the rest only once no request can queue more work for them
+	activity.Stop()
+	emailOutbox.Stop()
+	mediaProcessor.Stop()
+	smtp.DefaultConfig.Close()
+	stopKeyReload()
+	revocation.Stop()
+	otp.Stop()
+	uploads.Stop()
+
+	if err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 
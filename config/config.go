@@ -0,0 +1,289 @@
+package config
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileUploadConfig limits what clients may upload.
+type FileUploadConfig struct {
+	MaxFileSize      int64
+	AllowedMimeTypes map[string]bool
+	StorageBasePath  string
+}
+
+// Config holds the settings of the API, read from the environment by
+// InitConfig.
+type Config struct {
+	API_HOST       string
+	API_PORT       string
+	API_PREFIX     string
+	API_SERVER_URL string
+	STATIC_URL     string
+	UPLOAD_PATH    string
+	// STORAGE_DRIVER is "local", files under UPLOAD_PATH, or "s3", the bucket
+	// configured by S3_*. S3_PATH_STYLE=1 addresses the bucket in the path,
+	// as MinIO needs.
+	STORAGE_DRIVER string
+	S3_ENDPOINT    string
+	S3_REGION      string
+	S3_BUCKET      string
+	S3_ACCESS_KEY  string
+	S3_SECRET_KEY  string
+	S3_PATH_STYLE  int
+
+	ACCESS_KEY   string
+	REFRESH_KEY  string
+	ACCESS_TIME  time.Duration
+	REFRESH_TIME time.Duration
+	// JWT_KEYS_DIR holds the Ed25519 keys tokens are signed with. Tokens are
+	// signed with ACCESS_KEY and REFRESH_KEY (HS256) while it is empty.
+	JWT_KEYS_DIR string
+	// TOTP_ENCRYPTION_KEY seals the TOTP secrets of users. Defaults to a key
+	// derived from ACCESS_KEY.
+	TOTP_ENCRYPTION_KEY string
+
+	SYSTEM_HEADER string
+	API_SECRET    string
+	// SYSTEM_CLIENTS lists the "name:secret,name:secret" internal callers sign
+	// requests with. SYSTEM_LEGACY_HEADER=1 still accepts API_SECRET unsigned
+	// in SYSTEM_HEADER.
+	SYSTEM_CLIENTS       string
+	SYSTEM_LEGACY_HEADER int
+
+	APP_NAME     string
+	APP_LOGO_URL string
+
+	OTP_ANDROID_HASH  string
+	OTP_SERVICE_TEXT  string
+	OTP_SERVICE_ROUTE string
+	// OTP_HASH_KEY keys the hashes OTP codes are stored as. Defaults to a key
+	// derived from ACCESS_KEY.
+	OTP_HASH_KEY string
+	// SMS_PROVIDER=fake writes texts to SMS_FAKE_PATH, or the log, instead of
+	// sending them. SMS_FALLBACK_* configure a second gateway tried when the
+	// one at OTP_SERVICE_ROUTE fails.
+	SMS_PROVIDER              string
+	SMS_FAKE_PATH             string
+	SMS_FALLBACK_ROUTE        string
+	SMS_FALLBACK_TEXT         string
+	SMS_FALLBACK_ANDROID_HASH string
+
+	MAX_FILES_UPLOAD int
+	FileUpload       FileUploadConfig
+	COMPRESS_IMAGES  int
+	COMPRESS_SIZE    int
+	COMPRESS_QUALITY int
+	// MEDIA_URL_SECRET signs media URLs. Defaults to a key derived from
+	// ACCESS_KEY.
+	MEDIA_URL_SECRET string
+
+	SMTP_HOST     string
+	SMTP_PORT     string
+	SMTP_MAIL     string
+	SMTP_PASSWORD string
+	// SMTP_USERNAME defaults to SMTP_MAIL. SMTP_AUTH is "plain", "login" or
+	// "cram-md5". SMTP_SECURITY is "starttls", "starttls_optional", "tls" or
+	// "none", and picks TLS by SMTP_PORT when empty.
+	SMTP_USERNAME    string
+	SMTP_AUTH        string
+	SMTP_SECURITY    string
+	SMTP_SENDER_NAME string
+	SMTP_REPLY_TO    string
+	// MAIL_TEMPLATES_DIR holds templates overriding the embedded ones by name.
+	MAIL_TEMPLATES_DIR  string
+	MAIL_DEFAULT_LOCALE string
+	// EMAIL_LINK_SECRET signs email verification and magic links. Defaults to
+	// a key derived from ACCESS_KEY. Magic links are off until MAGIC_LINK_URL,
+	// the app page that completes them, is set.
+	EMAIL_LINK_SECRET string
+	MAGIC_LINK_URL    string
+
+	// RATE_LIMIT_BACKEND is "memory", per instance, or "postgres", shared by
+	// all instances.
+	RATE_LIMIT_BACKEND string
+}
+
+var ENV Config
+
+// defaultMimeTypes are accepted for upload unless ALLOWED_MIME_TYPES is set.
+const defaultMimeTypes = "image/jpeg,image/png,image/webp,image/gif,video/mp4,video/quicktime,video/webm," +
+	"audio/mpeg,audio/mp4,audio/ogg,audio/wav,application/pdf"
+
+// InitConfig loads .env, when there is one, and reads the settings from the
+// environment. Variables already set take precedence over .env.
+func InitConfig() {
+	if err := loadEnvFile(".env"); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Failed to read .env: %v", err)
+	}
+
+	ENV = Config{
+		API_HOST:       getEnv("API_HOST", "0.0.0.0"),
+		API_PORT:       getEnv("API_PORT", "8000"),
+		API_PREFIX:     getEnv("API_PREFIX", "/api/v1"),
+		API_SERVER_URL: getEnv("API_SERVER_URL", "http://localhost:8000"),
+		STATIC_URL:     getEnv("STATIC_URL", ""),
+		UPLOAD_PATH:    getEnv("UPLOAD_PATH", "uploads"),
+		STORAGE_DRIVER: getEnv("STORAGE_DRIVER", "local"),
+		S3_ENDPOINT:    getEnv("S3_ENDPOINT", ""),
+		S3_REGION:      getEnv("S3_REGION", ""),
+		S3_BUCKET:      getEnv("S3_BUCKET", ""),
+		S3_ACCESS_KEY:  getEnv("S3_ACCESS_KEY", ""),
+		S3_SECRET_KEY:  getEnv("S3_SECRET_KEY", ""),
+		S3_PATH_STYLE:  getEnvInt("S3_PATH_STYLE", 0),
+
+		ACCESS_KEY:          getEnv("ACCESS_KEY", ""),
+		REFRESH_KEY:         getEnv("REFRESH_KEY", ""),
+		ACCESS_TIME:         getEnvDuration("ACCESS_TIME", 15*time.Minute),
+		REFRESH_TIME:        getEnvDuration("REFRESH_TIME", 30*24*time.Hour),
+		JWT_KEYS_DIR:        getEnv("JWT_KEYS_DIR", ""),
+		TOTP_ENCRYPTION_KEY: getEnv("TOTP_ENCRYPTION_KEY", ""),
+
+		SYSTEM_HEADER:        getEnv("SYSTEM_HEADER", "X-System-Key"),
+		API_SECRET:           getEnv("API_SECRET", ""),
+		SYSTEM_CLIENTS:       getEnv("SYSTEM_CLIENTS", ""),
+		SYSTEM_LEGACY_HEADER: getEnvInt("SYSTEM_LEGACY_HEADER", 0),
+
+		APP_NAME:     getEnv("APP_NAME", "UNEEXPO"),
+		APP_LOGO_URL: getEnv("APP_LOGO_URL", ""),
+
+		OTP_ANDROID_HASH:          getEnv("OTP_ANDROID_HASH", ""),
+		OTP_SERVICE_TEXT:          getEnv("OTP_SERVICE_TEXT", ""),
+		OTP_SERVICE_ROUTE:         getEnv("OTP_SERVICE_ROUTE", ""),
+		OTP_HASH_KEY:              getEnv("OTP_HASH_KEY", ""),
+		SMS_PROVIDER:              getEnv("SMS_PROVIDER", "gateway"),
+		SMS_FAKE_PATH:             getEnv("SMS_FAKE_PATH", ""),
+		SMS_FALLBACK_ROUTE:        getEnv("SMS_FALLBACK_ROUTE", ""),
+		SMS_FALLBACK_TEXT:         getEnv("SMS_FALLBACK_TEXT", ""),
+		SMS_FALLBACK_ANDROID_HASH: getEnv("SMS_FALLBACK_ANDROID_HASH", ""),
+
+		MAX_FILES_UPLOAD: getEnvInt("MAX_FILES_UPLOAD", 10),
+		COMPRESS_IMAGES:  getEnvInt("COMPRESS_IMAGES", 1),
+		COMPRESS_SIZE:    getEnvInt("COMPRESS_SIZE", 1920),
+		COMPRESS_QUALITY: getEnvInt("COMPRESS_QUALITY", 80),
+		MEDIA_URL_SECRET: getEnv("MEDIA_URL_SECRET", ""),
+
+		SMTP_HOST:           getEnv("SMTP_HOST", ""),
+		SMTP_PORT:           getEnv("SMTP_PORT", "587"),
+		SMTP_MAIL:           getEnv("SMTP_MAIL", ""),
+		SMTP_PASSWORD:       getEnv("SMTP_PASSWORD", ""),
+		SMTP_USERNAME:       getEnv("SMTP_USERNAME", ""),
+		SMTP_AUTH:           getEnv("SMTP_AUTH", "plain"),
+		SMTP_SECURITY:       getEnv("SMTP_SECURITY", ""),
+		SMTP_SENDER_NAME:    getEnv("SMTP_SENDER_NAME", ""),
+		SMTP_REPLY_TO:       getEnv("SMTP_REPLY_TO", ""),
+		MAIL_TEMPLATES_DIR:  getEnv("MAIL_TEMPLATES_DIR", ""),
+		MAIL_DEFAULT_LOCALE: getEnv("MAIL_DEFAULT_LOCALE", ""),
+		EMAIL_LINK_SECRET:   getEnv("EMAIL_LINK_SECRET", ""),
+		MAGIC_LINK_URL:      getEnv("MAGIC_LINK_URL", ""),
+
+		RATE_LIMIT_BACKEND: getEnv("RATE_LIMIT_BACKEND", "memory"),
+	}
+	ENV.FileUpload = FileUploadConfig{
+		MaxFileSize:      int64(getEnvInt("MAX_FILE_SIZE", 50<<20)),
+		AllowedMimeTypes: getEnvSet("ALLOWED_MIME_TYPES", defaultMimeTypes),
+		StorageBasePath:  ENV.UPLOAD_PATH,
+	}
+
+	if ENV.ACCESS_KEY == "" || ENV.REFRESH_KEY == "" {
+		log.Fatal("ACCESS_KEY and REFRESH_KEY must be set")
+	}
+
+	// Secrets left unset are derived from ACCESS_KEY, so changing it also
+	// invalidates what they signed.
+	if ENV.MEDIA_URL_SECRET == "" {
+		ENV.MEDIA_URL_SECRET = deriveKey("uneexpo media url")
+	}
+	if ENV.TOTP_ENCRYPTION_KEY == "" {
+		ENV.TOTP_ENCRYPTION_KEY = deriveKey("uneexpo totp secret")
+	}
+	if ENV.OTP_HASH_KEY == "" {
+		ENV.OTP_HASH_KEY = deriveKey("uneexpo otp")
+	}
+	if ENV.EMAIL_LINK_SECRET == "" {
+		ENV.EMAIL_LINK_SECRET = deriveKey("uneexpo email link")
+	}
+}
+
+// deriveKey derives the key of label from ACCESS_KEY.
+func deriveKey(label string) string {
+	mac := hmac.New(sha256.New, []byte(ENV.ACCESS_KEY))
+	mac.Write([]byte(label))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("%s must be a number: %v", key, err)
+	}
+	return n
+}
+
+// getEnvDuration reads durations like "15m" or "720h".
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("%s must be a duration: %v", key, err)
+	}
+	return d
+}
+
+// getEnvSet reads a comma-separated list.
+func getEnvSet(key, fallback string) map[string]bool {
+	set := map[string]bool{}
+	for _, item := range strings.Split(getEnv(key, fallback), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+// loadEnvFile sets the KEY=value lines of path that are not set yet.
+func loadEnvFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.Trim(strings.TrimSpace(value), `"'`)
+		if _, set := os.LookupEnv(key); !set {
+			os.Setenv(key, value)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,220 @@
+package apiKeys
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/middlewares"
+	"uneexpo/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+type createRequest struct {
+	Name      string     `json:"name" binding:"required,max=100"`
+	Scopes    []string   `json:"scopes" binding:"required"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type updateRequest struct {
+	Name   string   `json:"name" binding:"required,max=100"`
+	Scopes []string `json:"scopes" binding:"required"`
+}
+
+// CreatedKey is the only response that ever contains the full key.
+type CreatedKey struct {
+	repo.APIKey
+	Key string `json:"key"`
+}
+
+// checkAPIAccess aborts unless the caller's company plan includes API access.
+func checkAPIAccess(ctx *gin.Context, companyID int) bool {
+	access, err := repo.CompanyHasAPIAccess(companyID)
+	if err != nil {
+		log.Printf("Failed to check plan of company %d: %v", companyID, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to check plan", ""))
+		return false
+	}
+	if !access {
+		ctx.JSON(http.StatusForbidden, utils.FormatErrorResponse("Forbidden", "Your plan does not include API access"))
+		return false
+	}
+	return true
+}
+
+// validateScopes keeps the scopes of a key within the permissions of its creator.
+func validateScopes(claims *utils.Claims, scopes []string) ([]string, error) {
+	valid := []string{}
+	for _, scope := range scopes {
+		scope = strings.TrimSpace(scope)
+		if scope == "" || slices.Contains(valid, scope) {
+			continue
+		}
+		if claims.Role != "admin" && claims.Role != "system" {
+			allowed, err := middlewares.RoleHasPermission(claims.RoleID, scope)
+			if err != nil {
+				return nil, err
+			}
+			if !allowed {
+				return nil, fmt.Errorf("scope %q is not a permission of your role", scope)
+			}
+		}
+		valid = append(valid, scope)
+	}
+	if len(valid) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return valid, nil
+}
+
+func keyID(ctx *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid API key id", err.Error()))
+		return 0, false
+	}
+	return id, true
+}
+
+func respondKeyError(ctx *gin.Context, err error, action string) {
+	if errors.Is(err, repo.ErrAPIKeyNotFound) {
+		ctx.JSON(http.StatusNotFound, utils.FormatErrorResponse("API key not found", ""))
+		return
+	}
+	log.Printf("Failed to %s API key: %v", action, err)
+	ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to "+action+" API key", ""))
+}
+
+func GetAPIKeys(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+
+	keys, err := repo.GetCompanyAPIKeys(claims.CompanyID)
+	if err != nil {
+		respondKeyError(ctx, err, "load")
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("API keys", keys))
+}
+
+func CreateAPIKey(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+
+	var body createRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+	if body.ExpiresAt != nil && !body.ExpiresAt.After(time.Now()) {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid expiry", "expires_at must be in the future"))
+		return
+	}
+	if !checkAPIAccess(ctx, claims.CompanyID) {
+		return
+	}
+
+	scopes, err := validateScopes(claims, body.Scopes)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid scopes", err.Error()))
+		return
+	}
+
+	key, prefix, err := utils.GenerateAPIKey()
+	if err != nil {
+		respondKeyError(ctx, err, "create")
+		return
+	}
+
+	created, err := repo.CreateAPIKey(repo.APIKey{
+		CompanyID: claims.CompanyID,
+		UserID:    claims.ID,
+		Name:      strings.TrimSpace(body.Name),
+		Prefix:    prefix,
+		KeyHash:   utils.HashToken(key),
+		Scopes:    scopes,
+		ExpiresAt: body.ExpiresAt,
+	})
+	if err != nil {
+		respondKeyError(ctx, err, "create")
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, utils.FormatResponse("API key created, store it now: it will not be shown again", CreatedKey{APIKey: created, Key: key}))
+}
+
+func UpdateAPIKey(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+	id, ok := keyID(ctx)
+	if !ok {
+		return
+	}
+
+	var body updateRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	scopes, err := validateScopes(claims, body.Scopes)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid scopes", err.Error()))
+		return
+	}
+
+	updated, err := repo.UpdateAPIKey(claims.CompanyID, id, strings.TrimSpace(body.Name), scopes)
+	if err != nil {
+		respondKeyError(ctx, err, "update")
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("API key updated", updated))
+}
+
+// RotateAPIKey issues a new secret for an existing key. The old secret stops working immediately.
+func RotateAPIKey(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+	id, ok := keyID(ctx)
+	if !ok {
+		return
+	}
+	if !checkAPIAccess(ctx, claims.CompanyID) {
+		return
+	}
+
+	key, prefix, err := utils.GenerateAPIKey()
+	if err != nil {
+		respondKeyError(ctx, err, "rotate")
+		return
+	}
+
+	rotated, err := repo.RotateAPIKey(claims.CompanyID, id, prefix, utils.HashToken(key))
+	if err != nil {
+		respondKeyError(ctx, err, "rotate")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, utils.FormatResponse("API key rotated, store it now: it will not be shown again", CreatedKey{APIKey: rotated, Key: key}))
+}
+
+func RevokeAPIKey(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+	id, ok := keyID(ctx)
+	if !ok {
+		return
+	}
+
+	revoked, err := repo.RevokeAPIKey(claims.CompanyID, id)
+	if err != nil {
+		respondKeyError(ctx, err, "revoke")
+		return
+	}
+	if !revoked {
+		respondKeyError(ctx, repo.ErrAPIKeyNotFound, "revoke")
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("API key revoked", gin.H{"id": id}))
+}
@@ -0,0 +1,18 @@
+package apiKeys
+
+import (
+	"uneexpo/pkg/middlewares"
+
+	"github.com/gin-gonic/gin"
+)
+
+// InitRoutes registers key management. It deliberately uses Guard rather than
+// GuardAPI, so an API key can never be used to mint or rotate other keys.
+func InitRoutes(router *gin.RouterGroup) {
+	keys := router.Group("/api-keys", middlewares.Guard, middlewares.RequirePermission("api_key.manage"))
+	keys.GET("", GetAPIKeys)
+	keys.POST("", CreateAPIKey)
+	keys.PUT("/:id", UpdateAPIKey)
+	keys.POST("/:id/rotate", RotateAPIKey)
+	keys.DELETE("/:id", RevokeAPIKey)
+}
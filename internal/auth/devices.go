@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/smtp"
+	"uneexpo/pkg/utils"
+)
+
+// PushLoginAlert delivers the new device alert as a push notification.
+// main registers it once Firebase is initialized.
+var PushLoginAlert func(userID int, session repo.Session) error
+
+type SessionView struct {
+	repo.Session
+	Platform string `json:"platform"`
+	Current  bool   `json:"current"`
+}
+
+func newSessionView(session repo.Session, currentID int) SessionView {
+	return SessionView{
+		Session:  session,
+		Platform: utils.DetectDeviceFirmware(session.DeviceFirmware),
+		Current:  session.ID == currentID,
+	}
+}
+
+// DescribeDevice names the device of a session for login alerts.
+func DescribeDevice(session repo.Session) string {
+	parts := []string{}
+	for _, part := range []string{session.DeviceName, session.DeviceModel, session.DeviceFirmware} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		parts = append(parts, utils.DetectDeviceFirmware(session.DeviceFirmware))
+	}
+	return fmt.Sprintf("%s (IP %s)", strings.Join(parts, ", "), session.IpAddress)
+}
+
+// alertNewDevice notifies the user when a session was started from a device
+// that never logged into the account before.
+func alertNewDevice(session repo.Session) {
+	isNew, err := repo.IsNewDevice(session)
+	if err != nil {
+		log.Printf("Failed to check device of session %d: %v", session.ID, err)
+		return
+	}
+	if !isNew {
+		return
+	}
+
+	contact, err := repo.GetUserContact(session.UserID)
+	if err != nil {
+		log.Printf("Failed to load contacts of user %d: %v", session.UserID, err)
+		return
+	}
+
+	if contact.Email != "" {
+		if err := smtp.SendNewLoginEmail(contact.Email, DescribeDevice(session)); err != nil {
+			log.Printf("Failed to send new device alert to user %d: %v", session.UserID, err)
+		}
+	}
+
+	if PushLoginAlert != nil {
+		if err := PushLoginAlert(session.UserID, session); err != nil {
+			log.Printf("Failed to push new device alert to user %d: %v", session.UserID, err)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"uneexpo/config"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/mailer"
+	"uneexpo/pkg/ratelimit"
+	"uneexpo/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Purposes of email links. The purpose is signed into the link, so a
+// verification link can't be used to log in.
+const (
+	LinkPurposeVerifyEmail = "verify_email"
+	LinkPurposeMagicLink   = "magic_link"
+)
+
+var (
+	VerifyEmailLinkTTL = time.Hour
+	MagicLinkTTL       = 15 * time.Minute
+)
+
+// emailLinkSends bounds the links sent to one user for one purpose.
+var emailLinkSends = ratelimit.Every(5, time.Hour)
+
+var (
+	ErrInvalidLink          = errors.New("invalid or expired link")
+	ErrNoEmail              = errors.New("account has no email address")
+	ErrEmailAlreadyVerified = errors.New("email address is already verified")
+	ErrTooManyLinks         = errors.New("too many links requested, please try again later")
+	ErrMagicLinkDisabled    = errors.New("magic link login is not enabled")
+)
+
+// IsEmailLinkClientError separates bad links and requests from storage failures.
+func IsEmailLinkClientError(err error) bool {
+	return errors.Is(err, ErrInvalidLink) ||
+		errors.Is(err, ErrNoEmail) ||
+		errors.Is(err, ErrEmailAlreadyVerified) ||
+		errors.Is(err, ErrTooManyLinks) ||
+		errors.Is(err, ErrMagicLinkDisabled)
+}
+
+func linkSignature(purpose, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(config.ENV.EMAIL_LINK_SECRET))
+	mac.Write([]byte(purpose + "\n" + nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newLinkToken returns a token of the form nonce.signature and the hash of
+// the nonce that is stored.
+func newLinkToken(purpose string) (token, hash string, err error) {
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", "", err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(random)
+	return nonce + "." + linkSignature(purpose, nonce), hashLinkNonce(nonce), nil
+}
+
+// checkLinkToken verifies the signature before the database is asked, so
+// made-up tokens cost nothing.
+func checkLinkToken(purpose, token string) (string, error) {
+	nonce, signature, ok := strings.Cut(strings.TrimSpace(token), ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(linkSignature(purpose, nonce))) {
+		return "", ErrInvalidLink
+	}
+	return hashLinkNonce(nonce), nil
+}
+
+func hashLinkNonce(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
+
+// sendEmailLink stores a new link for the user and emails it.
+func sendEmailLink(purpose string, user repo.LoginUser, baseURL, template string, ttl time.Duration, locale string) error {
+	attempt, err := ratelimit.DefaultBackend.Take("email_link:"+purpose+":"+strconv.Itoa(user.ID), emailLinkSends)
+	if err != nil {
+		return err
+	}
+	if !attempt.Allowed {
+		return ErrTooManyLinks
+	}
+
+	token, hash, err := newLinkToken(purpose)
+	if err != nil {
+		return err
+	}
+	link, err := url.Parse(baseURL)
+	if err != nil {
+		return fmt.Errorf("invalid link URL %q: %w", baseURL, err)
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	if err := repo.CreateEmailLink(purpose, user.ID, user.Email, hash, ttl); err != nil {
+		return err
+	}
+	return mailer.Send(context.Background(), mailer.Email{
+		To:       user.Email,
+		Template: template,
+		Locale:   locale,
+		Data:     mailer.EmailData{Link: link.String(), ExpiresInMinutes: int(ttl.Minutes())},
+	})
+}
+
+// verifyEmailURL is the page of this API that confirms a verification link.
+func verifyEmailURL() string {
+	return strings.Join([]string{config.ENV.API_SERVER_URL, config.ENV.API_PREFIX, "email", "verify"}, "/")
+}
+
+// SendVerificationEmail emails the user a link confirming their address.
+func SendVerificationEmail(userID int, locale string) error {
+	user, err := repo.GetLoginUser(userID)
+	if err != nil {
+		return err
+	}
+	if user.Email == "" {
+		return ErrNoEmail
+	}
+	contact, err := repo.GetUserContact(userID)
+	if err != nil {
+		return err
+	}
+	if contact.EmailVerified() {
+		return ErrEmailAlreadyVerified
+	}
+	return sendEmailLink(LinkPurposeVerifyEmail, user, verifyEmailURL(), mailer.TemplateVerifyEmail, VerifyEmailLinkTTL, locale)
+}
+
+// VerifyEmail uses a verification link. It fails if the address of the user
+// changed since the link was sent.
+func VerifyEmail(token string) error {
+	hash, err := checkLinkToken(LinkPurposeVerifyEmail, token)
+	if err != nil {
+		return err
+	}
+	link, err := repo.ConsumeEmailLink(LinkPurposeVerifyEmail, hash)
+	if errors.Is(err, repo.ErrEmailLinkNotFound) {
+		return ErrInvalidLink
+	}
+	if err != nil {
+		return err
+	}
+
+	verified, err := repo.MarkEmailVerified(link.UserID, link.Email)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return ErrInvalidLink
+	}
+	return nil
+}
+
+// SendMagicLink emails a login link if email is the verified address of an
+// account. Whether it is isn't revealed, so unknown addresses succeed silently.
+func SendMagicLink(email, locale string) error {
+	if config.ENV.MAGIC_LINK_URL == "" {
+		return ErrMagicLinkDisabled
+	}
+
+	user, err := repo.GetLoginUserByVerifiedEmail(strings.TrimSpace(email))
+	if errors.Is(err, repo.ErrLoginUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = sendEmailLink(LinkPurposeMagicLink, user, config.ENV.MAGIC_LINK_URL, mailer.TemplateMagicLink, MagicLinkTTL, locale)
+	if errors.Is(err, ErrTooManyLinks) {
+		log.Printf("Magic link not sent to user %d: %v", user.ID, err)
+		return nil
+	}
+	return err
+}
+
+// LoginWithMagicLink uses a login link. Links are only ever used by an
+// explicit POST from the app, never by opening them, so mail scanners that
+// prefetch URLs can't burn or use them.
+func LoginWithMagicLink(ctx *gin.Context, token string) (LoginResult, error) {
+	hash, err := checkLinkToken(LinkPurposeMagicLink, token)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	link, err := repo.ConsumeEmailLink(LinkPurposeMagicLink, hash)
+	if errors.Is(err, repo.ErrEmailLinkNotFound) {
+		return LoginResult{}, ErrInvalidLink
+	}
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	user, err := repo.GetLoginUser(link.UserID)
+	if errors.Is(err, repo.ErrLoginUserNotFound) || (err == nil && !strings.EqualFold(user.Email, link.Email)) {
+		return LoginResult{}, ErrInvalidLink
+	}
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	return CompleteLogin(ctx, utils.TokenSubject{
+		ID:        user.ID,
+		RoleID:    user.RoleID,
+		CompanyID: user.CompanyID,
+		DriverID:  user.DriverID,
+		Role:      user.Role,
+	}, LoginMethodMagicLink)
+}
@@ -0,0 +1,580 @@
+package auth
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"uneexpo/config"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/middlewares"
+	"uneexpo/pkg/otp"
+	"uneexpo/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+func RefreshToken(ctx *gin.Context) {
+	var body refreshRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	tokens, err := RefreshSession(ctx, body.RefreshToken)
+	if err != nil {
+		if isClientError(err) {
+			ctx.JSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", err.Error()))
+			return
+		}
+		log.Printf("Failed to refresh session: %v", err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to refresh token", ""))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Token refreshed", tokens))
+}
+
+func ListSessions(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+
+	sessions, err := repo.ListUserSessions(claims.ID)
+	if err != nil {
+		log.Printf("Failed to list sessions of user %d: %v", claims.ID, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to load sessions", ""))
+		return
+	}
+
+	views := make([]SessionView, 0, len(sessions))
+	for _, session := range sessions {
+		views = append(views, newSessionView(session, claims.SessionID))
+	}
+
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Sessions", views))
+}
+
+func RevokeSession(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+
+	sessionID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid session id", err.Error()))
+		return
+	}
+
+	if err := RevokeSessionAccess(claims.ID, sessionID, RevokeReasonUser); err != nil {
+		if errors.Is(err, ErrSessionRevoked) {
+			ctx.JSON(http.StatusNotFound, utils.FormatErrorResponse("Session not found", ""))
+			return
+		}
+		log.Printf("Failed to revoke session %d: %v", sessionID, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to revoke session", ""))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Session revoked", gin.H{"id": sessionID}))
+}
+
+// RevokeOtherSessions logs the user out everywhere except the session making the call.
+// Tokens issued before sessions existed carry none, so they cannot tell which one to keep.
+func RevokeOtherSessions(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+	if claims.SessionID == 0 {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Current token is not bound to a session", "Please log in again"))
+		return
+	}
+
+	count, err := RevokeOtherSessionAccess(claims.ID, claims.SessionID, RevokeReasonUser)
+	if err != nil {
+		log.Printf("Failed to revoke sessions of user %d: %v", claims.ID, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to revoke sessions", ""))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Sessions revoked", gin.H{"revoked": count}))
+}
+
+func Logout(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+
+	if err := EndSession(claims); err != nil {
+		log.Printf("Failed to log out user %d: %v", claims.ID, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to log out", ""))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Logged out", nil))
+}
+
+// RevokeUserSessions lets admins log out a user everywhere, e.g. right after banning them.
+func RevokeUserSessions(ctx *gin.Context) {
+	userID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid user id", err.Error()))
+		return
+	}
+
+	if err := RevokeUserAccess(userID, 0, RevokeReasonBan); err != nil {
+		log.Printf("Failed to revoke access of user %d: %v", userID, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to revoke access", ""))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, utils.FormatResponse("User access revoked", gin.H{"id": userID}))
+}
+
+// RevokeCompanySessions lets admins log out every user of a company, e.g. right after banning it.
+func RevokeCompanySessions(ctx *gin.Context) {
+	companyID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid company id", err.Error()))
+		return
+	}
+
+	if err := RevokeCompanyAccess(companyID, RevokeReasonBan); err != nil {
+		log.Printf("Failed to revoke access of company %d: %v", companyID, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to revoke access", ""))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Company access revoked", gin.H{"id": companyID}))
+}
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type challengeRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code"`
+}
+
+// twoFactorError answers a failed 2FA call, hiding storage errors behind message.
+func twoFactorError(ctx *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, ErrInvalidChallenge), errors.Is(err, ErrTooManyAttempts):
+		ctx.JSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", err.Error()))
+	case errors.Is(err, ErrTwoFactorMandatory):
+		ctx.JSON(http.StatusForbidden, utils.FormatErrorResponse(message, err.Error()))
+	case IsTwoFactorClientError(err):
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse(message, err.Error()))
+	default:
+		log.Printf("%s: %v", message, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse(message, ""))
+	}
+}
+
+func GetTwoFactorStatus(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+
+	twoFactor, err := repo.GetTwoFactor(claims.ID)
+	if err != nil && !errors.Is(err, repo.ErrTwoFactorNotFound) {
+		twoFactorError(ctx, err, "Failed to load two-factor status")
+		return
+	}
+	required, err := repo.RoleRequiresTwoFactor(claims.RoleID)
+	if err != nil {
+		twoFactorError(ctx, err, "Failed to load two-factor status")
+		return
+	}
+
+	recoveryCodes := 0
+	if twoFactor.Enabled() {
+		if recoveryCodes, err = repo.CountRecoveryCodes(claims.ID); err != nil {
+			twoFactorError(ctx, err, "Failed to load two-factor status")
+			return
+		}
+	}
+
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Two-factor status", gin.H{
+		"enabled":        twoFactor.Enabled(),
+		"required":       required,
+		"recovery_codes": recoveryCodes,
+	}))
+}
+
+// SetupTwoFactor starts enrollment; the secret is confirmed by EnableTwoFactor.
+func SetupTwoFactor(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+
+	enrollment, err := StartEnrollment(claims.ID)
+	if err != nil {
+		twoFactorError(ctx, err, "Failed to set up two-factor authentication")
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Scan the code with an authenticator app", enrollment))
+}
+
+func EnableTwoFactor(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+
+	var body twoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	codes, err := ConfirmEnrollment(claims.ID, body.Code)
+	if err != nil {
+		twoFactorError(ctx, err, "Failed to enable two-factor authentication")
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Two-factor authentication enabled", gin.H{"recovery_codes": codes}))
+}
+
+func DisableTwoFactor(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+
+	var body twoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	required, err := repo.RoleRequiresTwoFactor(claims.RoleID)
+	if err != nil {
+		twoFactorError(ctx, err, "Failed to disable two-factor authentication")
+		return
+	}
+	if required {
+		twoFactorError(ctx, ErrTwoFactorMandatory, "Failed to disable two-factor authentication")
+		return
+	}
+
+	if err := VerifyUserCode(claims.ID, body.Code); err != nil {
+		twoFactorError(ctx, err, "Failed to disable two-factor authentication")
+		return
+	}
+	if err := repo.DisableTwoFactor(claims.ID); err != nil {
+		twoFactorError(ctx, err, "Failed to disable two-factor authentication")
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Two-factor authentication disabled", nil))
+}
+
+func RegenerateRecoveryCodes(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+
+	var body twoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	if err := VerifyUserCode(claims.ID, body.Code); err != nil {
+		twoFactorError(ctx, err, "Failed to regenerate recovery codes")
+		return
+	}
+	codes, err := NewRecoveryCodes(claims.ID)
+	if err != nil {
+		twoFactorError(ctx, err, "Failed to regenerate recovery codes")
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Recovery codes regenerated", gin.H{"recovery_codes": codes}))
+}
+
+// SetupChallengeTwoFactor starts enrollment during login, for roles that require 2FA.
+func SetupChallengeTwoFactor(ctx *gin.Context) {
+	var body challengeRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	enrollment, err := StartChallengeEnrollment(body.ChallengeToken)
+	if err != nil {
+		twoFactorError(ctx, err, "Failed to set up two-factor authentication")
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Scan the code with an authenticator app", enrollment))
+}
+
+// VerifyTwoFactorChallenge is the second step of a two-factor login.
+func VerifyTwoFactorChallenge(ctx *gin.Context) {
+	var body challengeRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil || body.Code == "" {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", "challenge_token and code are required"))
+		return
+	}
+
+	result, err := VerifyChallenge(ctx, body.ChallengeToken, body.Code)
+	if err != nil {
+		twoFactorError(ctx, err, "Failed to verify two-factor code")
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Login successful", result))
+}
+
+type otpChannelRequest struct {
+	Channel string `json:"channel"`
+}
+
+// SetOTPChannel stores the channel the caller wants codes on, empty for automatic.
+func SetOTPChannel(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+
+	var body otpChannelRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+	if body.Channel != "" && !otp.IsChannel(body.Channel) {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid channel", otp.ErrUnknownChannel.Error()))
+		return
+	}
+
+	if err := repo.SetUserOTPChannel(claims.ID, body.Channel); err != nil {
+		log.Printf("Failed to set OTP channel of user %d: %v", claims.ID, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to update preference", ""))
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Preference updated", gin.H{"channel": body.Channel}))
+}
+
+// otpError answers a failed OTP call, hiding storage errors behind message.
+func otpError(ctx *gin.Context, err error, message string) {
+	var limitErr *otp.LimitError
+	switch {
+	case errors.As(err, &limitErr):
+		ctx.Header("Retry-After", strconv.Itoa(int(limitErr.RetryAfter.Seconds())+1))
+		ctx.JSON(http.StatusTooManyRequests, utils.FormatErrorResponse(message, err.Error()))
+	case errors.Is(err, otp.ErrUnknownChannel), errors.Is(err, otp.ErrInvalidPurpose):
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse(message, err.Error()))
+	case otp.IsClientError(err):
+		ctx.JSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", err.Error()))
+	default:
+		log.Printf("%s: %v", message, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse(message, ""))
+	}
+}
+
+type loginCodeRequest struct {
+	// Login is a verified phone number or email address of the account.
+	Login   string `json:"login" binding:"required"`
+	Channel string `json:"channel"`
+}
+
+type userCodeRequest struct {
+	Purpose string `json:"purpose" binding:"required"`
+	Channel string `json:"channel"`
+}
+
+// userCodePurposes are the codes a logged-in user may ask for, to confirm
+// changes to the account.
+var userCodePurposes = map[string]bool{
+	otp.PurposePhoneChange: true,
+	otp.PurposeEmailChange: true,
+}
+
+type otpLoginRequest struct {
+	Login string `json:"login" binding:"required"`
+	Code  string `json:"code" binding:"required"`
+}
+
+// RequestLoginCode sends a login code. The answer is the same whether or not
+// the contact belongs to an account.
+func RequestLoginCode(ctx *gin.Context) {
+	var body loginCodeRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	err := SendLoginCode(ctx.Request.Context(), body.Login, body.Channel,
+		ctx.GetHeader(HeaderDeviceFirmware), ctx.GetHeader("Accept-Language"))
+	if err != nil {
+		otpError(ctx, err, "Failed to send login code")
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("If the contact belongs to an account, a login code has been sent", nil))
+}
+
+// RequestUserCode sends the caller a code confirming an account change, over
+// the first of their verified contacts that works.
+func RequestUserCode(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+
+	var body userCodeRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+	if !userCodePurposes[body.Purpose] {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Failed to send code", otp.ErrInvalidPurpose.Error()))
+		return
+	}
+
+	delivery, err := otp.DeliverToUser(ctx.Request.Context(), otp.DeliverRequest{
+		UserID:   claims.ID,
+		Purpose:  body.Purpose,
+		Channel:  body.Channel,
+		Firmware: ctx.GetHeader(HeaderDeviceFirmware),
+		Locale:   ctx.GetHeader("Accept-Language"),
+	})
+	if errors.Is(err, otp.ErrNoChannel) {
+		ctx.JSON(http.StatusConflict, utils.FormatErrorResponse("Failed to send code", err.Error()))
+		return
+	}
+	if err != nil {
+		otpError(ctx, err, "Failed to send code")
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Code sent", delivery))
+}
+
+// OTPLogin exchanges a login code for a session, or for a 2FA challenge.
+func OTPLogin(ctx *gin.Context) {
+	var body otpLoginRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	result, err := LoginWithCode(ctx, body.Login, body.Code)
+	if err != nil {
+		otpError(ctx, err, "Failed to log in")
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Login successful", result))
+}
+
+// emailLinkError answers a failed email link call, hiding storage errors behind message.
+func emailLinkError(ctx *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, ErrTooManyLinks):
+		ctx.JSON(http.StatusTooManyRequests, utils.FormatErrorResponse(message, err.Error()))
+	case errors.Is(err, ErrMagicLinkDisabled):
+		ctx.JSON(http.StatusNotFound, utils.FormatErrorResponse(message, err.Error()))
+	case errors.Is(err, ErrInvalidLink):
+		ctx.JSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", err.Error()))
+	case IsEmailLinkClientError(err):
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse(message, err.Error()))
+	default:
+		log.Printf("%s: %v", message, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse(message, ""))
+	}
+}
+
+// RequestEmailVerification emails the caller a link confirming their address.
+func RequestEmailVerification(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+
+	if err := SendVerificationEmail(claims.ID, ctx.GetHeader("Accept-Language")); err != nil {
+		emailLinkError(ctx, err, "Failed to send verification email")
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Verification email sent", nil))
+}
+
+type emailLinkRequest struct {
+	Token string `json:"token" form:"token" binding:"required"`
+}
+
+// verifyEmailPage is what opening a verification link shows. Nothing is
+// verified until the button is pressed, because mail scanners open links too.
+var verifyEmailPage = template.Must(template.New("verify_email").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex"><title>{{ .AppName }}</title></head>
+<body style="font-family: sans-serif; text-align: center; padding: 48px 16px">
+<h2>{{ .AppName }}</h2>
+{{ if .Token }}<form method="post">
+<input type="hidden" name="token" value="{{ .Token }}">
+<button type="submit" style="font-size: 16px; padding: 12px 24px">Confirm email</button>
+</form>{{ else }}<p>{{ .Message }}</p>{{ end }}
+</body></html>`))
+
+func renderVerifyEmailPage(ctx *gin.Context, status int, token, message string) {
+	ctx.Header("Cache-Control", "no-store")
+	ctx.Header("Referrer-Policy", "no-referrer")
+	ctx.Header("Content-Type", "text/html; charset=utf-8")
+	ctx.Status(status)
+	verifyEmailPage.Execute(ctx.Writer, gin.H{"AppName": config.ENV.APP_NAME, "Token": token, "Message": message})
+}
+
+// ShowVerifyEmail is the page a verification link opens.
+func ShowVerifyEmail(ctx *gin.Context) {
+	token := ctx.Query("token")
+	if token == "" {
+		renderVerifyEmailPage(ctx, http.StatusBadRequest, "", "This link is invalid.")
+		return
+	}
+	renderVerifyEmailPage(ctx, http.StatusOK, token, "")
+}
+
+// ConfirmEmail uses a verification link, from the form of ShowVerifyEmail or
+// from an app posting JSON.
+func ConfirmEmail(ctx *gin.Context) {
+	fromPage := ctx.ContentType() == binding.MIMEPOSTForm
+
+	var body emailLinkRequest
+	if err := ctx.ShouldBind(&body); err != nil {
+		if fromPage {
+			renderVerifyEmailPage(ctx, http.StatusBadRequest, "", "This link is invalid.")
+			return
+		}
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	err := VerifyEmail(body.Token)
+	if !fromPage {
+		if err != nil {
+			emailLinkError(ctx, err, "Failed to verify email")
+			return
+		}
+		ctx.JSON(http.StatusOK, utils.FormatResponse("Email verified", nil))
+		return
+	}
+
+	switch {
+	case err == nil:
+		renderVerifyEmailPage(ctx, http.StatusOK, "", "Your email address is confirmed. You can close this page.")
+	case errors.Is(err, ErrInvalidLink):
+		renderVerifyEmailPage(ctx, http.StatusBadRequest, "", "This link is invalid or has expired. Request a new one in the app.")
+	default:
+		log.Printf("Failed to verify email: %v", err)
+		renderVerifyEmailPage(ctx, http.StatusInternalServerError, "", "Something went wrong, please try again later.")
+	}
+}
+
+type magicLinkRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// RequestMagicLink emails a login link. The answer is the same whether or
+// not the address belongs to an account.
+func RequestMagicLink(ctx *gin.Context) {
+	var body magicLinkRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	if err := SendMagicLink(body.Email, ctx.GetHeader("Accept-Language")); err != nil {
+		emailLinkError(ctx, err, "Failed to send login link")
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("If the address belongs to an account, a login link has been sent", nil))
+}
+
+// MagicLinkLogin exchanges the token of a login link for a session.
+func MagicLinkLogin(ctx *gin.Context) {
+	var body emailLinkRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	result, err := LoginWithMagicLink(ctx, body.Token)
+	if err != nil {
+		emailLinkError(ctx, err, "Failed to log in")
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Login successful", result))
+}
@@ -0,0 +1,19 @@
+package auth
+
+import (
+	"net/http"
+	"uneexpo/pkg/keyring"
+	"uneexpo/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// JWKS publishes the token verification keys at /.well-known/jwks.json.
+func JWKS(ctx *gin.Context) {
+	if utils.SigningKeys == nil {
+		ctx.JSON(http.StatusOK, keyring.JWKSet{Keys: []keyring.JWK{}})
+		return
+	}
+	ctx.Header("Cache-Control", "public, max-age=300")
+	ctx.JSON(http.StatusOK, utils.SigningKeys.JWKS())
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/otp"
+	"uneexpo/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loginUserByContact finds the account whose verified phone number or email
+// address is login.
+func loginUserByContact(login string) (repo.LoginUser, error) {
+	login = strings.TrimSpace(login)
+	if strings.Contains(login, "@") {
+		return repo.GetLoginUserByVerifiedEmail(login)
+	}
+	return repo.GetLoginUserByVerifiedPhone(otp.NormalizeDestination(login))
+}
+
+// SendLoginCode sends a login code to the account whose verified contact is
+// login, over channel when it works. Whether there is one isn't revealed, so
+// unknown contacts succeed silently.
+func SendLoginCode(ctx context.Context, login, channel, firmware, locale string) error {
+	user, err := loginUserByContact(login)
+	if errors.Is(err, repo.ErrLoginUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = otp.DeliverToUser(ctx, otp.DeliverRequest{
+		UserID:   user.ID,
+		Purpose:  otp.PurposeLogin,
+		Channel:  channel,
+		Firmware: firmware,
+		Locale:   locale,
+	})
+	if errors.Is(err, otp.ErrNoChannel) {
+		log.Printf("Login code not sent to user %d: %v", user.ID, err)
+		return nil
+	}
+	return err
+}
+
+// LoginWithCode checks a code sent by SendLoginCode and logs the account in,
+// through the second factor when it has one.
+func LoginWithCode(ctx *gin.Context, login, code string) (LoginResult, error) {
+	user, err := loginUserByContact(login)
+	if errors.Is(err, repo.ErrLoginUserNotFound) {
+		return LoginResult{}, otp.ErrNoCode
+	}
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	if err := otp.VerifyUser(otp.PurposeLogin, user.ID, code); err != nil {
+		return LoginResult{}, err
+	}
+
+	return CompleteLogin(ctx, utils.TokenSubject{
+		ID:        user.ID,
+		RoleID:    user.RoleID,
+		CompanyID: user.CompanyID,
+		DriverID:  user.DriverID,
+		Role:      user.Role,
+	}, LoginMethodOTP)
+}
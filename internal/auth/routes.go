@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"uneexpo/pkg/middlewares"
+	"uneexpo/pkg/ratelimit"
+
+	"github.com/gin-gonic/gin"
+)
+
+var refreshRateLimit = middlewares.RateLimit(middlewares.RateLimitConfig{
+	Name:  "refresh",
+	Limit: ratelimit.PerMinute(30),
+	Key:   middlewares.KeyByIP,
+})
+
+var emailLinkRateLimit = middlewares.RateLimit(middlewares.RateLimitConfig{
+	Name:  "email_link",
+	Limit: ratelimit.PerMinute(10),
+	Key:   middlewares.KeyByIP,
+})
+
+var challengeRateLimit = middlewares.RateLimit(middlewares.RateLimitConfig{
+	Name:  "2fa_challenge",
+	Limit: ratelimit.PerMinute(10),
+	Key:   middlewares.KeyByIP,
+})
+
+func InitRoutes(router *gin.RouterGroup) {
+	sessions := router.Group("/sessions")
+	sessions.POST("/refresh", refreshRateLimit, RefreshToken)
+	sessions.POST("/logout", middlewares.Guard, Logout)
+	sessions.GET("", middlewares.Guard, ListSessions)
+	sessions.DELETE("", middlewares.Guard, RevokeOtherSessions)
+	sessions.DELETE("/:id", middlewares.Guard, RevokeSession)
+
+	twoFactor := router.Group("/2fa")
+	twoFactor.GET("", middlewares.Guard, GetTwoFactorStatus)
+	twoFactor.POST("/setup", middlewares.Guard, SetupTwoFactor)
+	twoFactor.POST("/enable", middlewares.Guard, EnableTwoFactor)
+	twoFactor.DELETE("", middlewares.Guard, DisableTwoFactor)
+	twoFactor.POST("/recovery-codes", middlewares.Guard, RegenerateRecoveryCodes)
+	twoFactor.POST("/challenge/setup", challengeRateLimit, SetupChallengeTwoFactor)
+	twoFactor.POST("/challenge", challengeRateLimit, VerifyTwoFactorChallenge)
+
+	otpRoutes := router.Group("/otp")
+	otpRoutes.PUT("/channel", middlewares.Guard, SetOTPChannel)
+	otpRoutes.POST("/code", middlewares.Guard, middlewares.OTPRateLimit, RequestUserCode)
+	otpRoutes.POST("/login/code", middlewares.OTPRateLimit, RequestLoginCode)
+	otpRoutes.POST("/login", middlewares.OTPVerifyRateLimit, OTPLogin)
+
+	email := router.Group("/email")
+	email.POST("/verification", middlewares.Guard, RequestEmailVerification)
+	email.GET("/verify", ShowVerifyEmail)
+	email.POST("/verify", emailLinkRateLimit, ConfirmEmail)
+
+	magicLink := router.Group("/magic-link")
+	magicLink.POST("", emailLinkRateLimit, RequestMagicLink)
+	magicLink.POST("/login", emailLinkRateLimit, MagicLinkLogin)
+
+	admin := router.Group("/admin", middlewares.GuardAdmin)
+	admin.POST("/users/:id/revoke-sessions", RevokeUserSessions)
+	admin.POST("/companies/:id/revoke-sessions", RevokeCompanySessions)
+}
@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	"uneexpo/config"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/revocation"
+	"uneexpo/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	HeaderDeviceName     = "X-Device-Name"
+	HeaderDeviceModel    = "X-Device-Model"
+	HeaderDeviceFirmware = "X-Device-Firmware"
+	HeaderAppName        = "X-App-Name"
+	HeaderAppVersion     = "X-App-Version"
+)
+
+const (
+	LoginMethodPassword  = "password"
+	LoginMethodOTP       = "otp"
+	LoginMethodOAuth     = "oauth"
+	LoginMethodMagicLink = "magic_link"
+)
+
+const (
+	RevokeReasonReuse          = "token_reuse"
+	RevokeReasonUser           = "revoked_by_user"
+	RevokeReasonLogout         = "logout"
+	RevokeReasonPasswordChange = "password_change"
+	RevokeReasonBan            = "banned"
+	RevokeReasonChallengeUsed  = "2fa_challenge_used"
+	RevokeReasonSessionUpgrade = "session_upgrade"
+)
+
+var (
+	ErrInvalidToken    = errors.New("invalid refresh token")
+	ErrSessionRequired = errors.New("refresh token is not bound to a session, please log in again")
+	ErrSessionRevoked  = errors.New("session is no longer active")
+	ErrTokenReused     = errors.New("refresh token has already been used, session revoked")
+)
+
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Exp          int64  `json:"exp"`
+}
+
+func sessionFromRequest(ctx *gin.Context) repo.Session {
+	return repo.Session{
+		DeviceName:     ctx.GetHeader(HeaderDeviceName),
+		DeviceModel:    ctx.GetHeader(HeaderDeviceModel),
+		DeviceFirmware: ctx.GetHeader(HeaderDeviceFirmware),
+		AppName:        ctx.GetHeader(HeaderAppName),
+		AppVersion:     ctx.GetHeader(HeaderAppVersion),
+		UserAgent:      ctx.Request.UserAgent(),
+		IpAddress:      ctx.ClientIP(),
+	}
+}
+
+// StartSession records a new row in tbl_sessions for a successful login and
+// issues the first token pair of that session.
+func StartSession(ctx *gin.Context, subject utils.TokenSubject, loginMethod string) (TokenPair, error) {
+	return startSession(sessionFromRequest(ctx), subject, loginMethod)
+}
+
+// startSession is StartSession with the device of the session given.
+func startSession(session repo.Session, subject utils.TokenSubject, loginMethod string) (TokenPair, error) {
+	session.UserID = subject.ID
+	session.CompanyID = subject.CompanyID
+	session.LoginMethod = loginMethod
+	session.ExpiresAt = time.Now().Add(config.ENV.REFRESH_TIME)
+
+	sessionID, err := repo.CreateSession(session)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	accessToken, refreshToken, exp := utils.CreateSessionToken(subject, sessionID)
+	if _, err := repo.RotateSessionToken(sessionID, "", utils.HashToken(refreshToken), session.ExpiresAt, session.IpAddress); err != nil {
+		return TokenPair{}, err
+	}
+
+	session.ID = sessionID
+	go alertNewDevice(session)
+
+	return TokenPair{AccessToken: accessToken, RefreshToken: refreshToken, Exp: exp}, nil
+}
+
+// RefreshSession exchanges a refresh token for a new token pair. Every refresh
+// token can be used once: presenting one that has already been rotated means it
+// was copied, so the whole session and every token descending from it is revoked.
+func RefreshSession(ctx *gin.Context, refreshToken string) (TokenPair, error) {
+	claims, err := utils.ParseRefreshToken(refreshToken)
+	if err != nil {
+		return TokenPair{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if claims.SessionID == 0 {
+		return upgradePreSessionToken(ctx, claims)
+	}
+
+	accessToken, newRefreshToken, exp := utils.CreateSessionToken(claims.Subject(), claims.SessionID)
+	expiresAt := time.Now().Add(config.ENV.REFRESH_TIME)
+
+	rotated, err := repo.RotateSessionToken(
+		claims.SessionID, utils.HashToken(refreshToken), utils.HashToken(newRefreshToken), expiresAt, ctx.ClientIP(),
+	)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if rotated {
+		return TokenPair{AccessToken: accessToken, RefreshToken: newRefreshToken, Exp: exp}, nil
+	}
+
+	session, err := repo.GetSession(claims.SessionID)
+	if err != nil {
+		if errors.Is(err, repo.ErrSessionNotFound) {
+			return TokenPair{}, ErrSessionRevoked
+		}
+		return TokenPair{}, err
+	}
+	if !session.IsActive || session.UserID != claims.ID || session.ExpiresAt.Before(time.Now()) {
+		return TokenPair{}, ErrSessionRevoked
+	}
+
+	log.Printf("Refresh token reuse detected for session %d of user %d from %s", session.ID, session.UserID, ctx.ClientIP())
+	if err := repo.RevokeSession(session.ID, RevokeReasonReuse); err != nil {
+		return TokenPair{}, err
+	}
+	if err := revocation.RevokeSession(session.ID, RevokeReasonReuse); err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{}, ErrTokenReused
+}
+
+// upgradePreSessionToken trades a refresh token of the original
+// utils.CreateToken, which has no session, for a new session once. Users who
+// have enabled 2FA since have to log in again.
+func upgradePreSessionToken(ctx *gin.Context, claims *utils.Claims) (TokenPair, error) {
+	if revocation.IsRevoked(claims) {
+		return TokenPair{}, ErrSessionRevoked
+	}
+	if err := revocation.RevokeToken(claims, RevokeReasonSessionUpgrade); err != nil {
+		return TokenPair{}, err
+	}
+
+	result, err := CompleteLogin(ctx, claims.Subject(), LoginMethodPassword)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if result.TokenPair == nil {
+		return TokenPair{}, ErrSessionRequired
+	}
+	return *result.TokenPair, nil
+}
+
+// isClientError separates invalid or revoked credentials from storage failures.
+func isClientError(err error) bool {
+	return errors.Is(err, ErrInvalidToken) ||
+		errors.Is(err, ErrSessionRequired) ||
+		errors.Is(err, ErrSessionRevoked) ||
+		errors.Is(err, ErrTokenReused)
+}
+
+// EndSession logs the caller out: its access token stops working immediately
+// and the refresh token of its session can no longer be exchanged.
+func EndSession(claims *utils.Claims) error {
+	if claims.SessionID == 0 {
+		return revocation.RevokeToken(claims, RevokeReasonLogout)
+	}
+	err := RevokeSessionAccess(claims.ID, claims.SessionID, RevokeReasonLogout)
+	if errors.Is(err, ErrSessionRevoked) {
+		return revocation.RevokeToken(claims, RevokeReasonLogout)
+	}
+	return err
+}
+
+// RevokeSessionAccess revokes a session of a user together with the access tokens
+// it issued. It returns ErrSessionRevoked when the user has no such active session.
+func RevokeSessionAccess(userID, sessionID int, reason string) error {
+	revoked, err := repo.RevokeUserSession(userID, sessionID, reason)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrSessionRevoked
+	}
+	return revocation.RevokeSession(sessionID, reason)
+}
+
+// RevokeOtherSessionAccess revokes every session of a user but keepSessionID,
+// together with the access tokens they issued, and returns how many there were.
+func RevokeOtherSessionAccess(userID, keepSessionID int, reason string) (int, error) {
+	ids, err := repo.RevokeOtherSessions(userID, keepSessionID, reason)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		if err := revocation.RevokeSession(id, reason); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+// RevokeUserAccess kills every token of a user, keeping only the session
+// keepSessionID (0 keeps none). The kept session has to refresh its tokens.
+// Password changes and bans of users and companies are also revoked by the
+// triggers on tbl_user and tbl_company, which keep no session: a password
+// change handler that keeps the caller logged in starts a new session for it.
+func RevokeUserAccess(userID, keepSessionID int, reason string) error {
+	if _, err := repo.RevokeOtherSessions(userID, keepSessionID, reason); err != nil {
+		return err
+	}
+	return revocation.RevokeUser(userID, reason)
+}
+
+// RevokeCompanyAccess kills every token and session of the users of a company, e.g. on a ban.
+func RevokeCompanyAccess(companyID int, reason string) error {
+	if _, err := repo.RevokeCompanySessions(companyID, reason); err != nil {
+		return err
+	}
+	return revocation.RevokeCompany(companyID, reason)
+}
@@ -0,0 +1,376 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"uneexpo/config"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/ratelimit"
+	"uneexpo/pkg/revocation"
+	"uneexpo/pkg/totp"
+	"uneexpo/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RecoveryCodeCount is how many one-time recovery codes a user gets at once.
+const RecoveryCodeCount = 10
+
+// challengeAttempts bounds the codes that may be tried with one challenge token.
+var challengeAttempts = ratelimit.Every(5, utils.ChallengeTTL)
+
+var (
+	ErrInvalidChallenge    = errors.New("invalid or expired challenge token")
+	ErrTooManyAttempts     = errors.New("too many attempts, please log in again")
+	ErrInvalidCode         = errors.New("invalid two-factor code")
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorNotStarted = errors.New("two-factor setup has not been started")
+	ErrTwoFactorMandatory  = errors.New("two-factor authentication is required for this role")
+	// ErrChallengeUnsupported is returned by LegacyLogin, which can't hand out a challenge.
+	ErrChallengeUnsupported = errors.New("two-factor authentication is required, log in through an endpoint that supports it")
+)
+
+// LoginResult is what a login handler returns: either the token pair of the
+// new session, or a challenge token for the second step.
+type LoginResult struct {
+	*TokenPair
+	TwoFactorRequired bool     `json:"two_factor_required,omitempty"`
+	SetupRequired     bool     `json:"two_factor_setup_required,omitempty"`
+	ChallengeToken    string   `json:"challenge_token,omitempty"`
+	ChallengeExp      int64    `json:"challenge_exp,omitempty"`
+	RecoveryCodes     []string `json:"recovery_codes,omitempty"`
+}
+
+// Enrollment is shown to the user once, to add the account to an authenticator.
+type Enrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+// CompleteLogin is called by every login handler once the first factor has
+// been checked, password and OTP logins included. Users with 2FA enabled, or
+// whose role requires it, get a challenge token instead of a token pair.
+// Sessionless token pairs are no longer issued at all.
+func CompleteLogin(ctx *gin.Context, subject utils.TokenSubject, loginMethod string) (LoginResult, error) {
+	return completeLogin(sessionFromRequest(ctx), subject, loginMethod)
+}
+
+// completeLogin is CompleteLogin with the device of the new session given.
+func completeLogin(session repo.Session, subject utils.TokenSubject, loginMethod string) (LoginResult, error) {
+	twoFactor, err := repo.GetTwoFactor(subject.ID)
+	if err != nil && !errors.Is(err, repo.ErrTwoFactorNotFound) {
+		return LoginResult{}, err
+	}
+
+	result := LoginResult{TwoFactorRequired: twoFactor.Enabled()}
+	if !result.TwoFactorRequired {
+		required, err := repo.RoleRequiresTwoFactor(subject.RoleID)
+		if err != nil {
+			return LoginResult{}, err
+		}
+		result.TwoFactorRequired = required
+		result.SetupRequired = required
+	}
+
+	if !result.TwoFactorRequired {
+		tokens, err := startSession(session, subject, loginMethod)
+		if err != nil {
+			return LoginResult{}, err
+		}
+		return LoginResult{TokenPair: &tokens}, nil
+	}
+
+	result.ChallengeToken, result.ChallengeExp, err = utils.CreateChallengeToken(subject, loginMethod)
+	return result, err
+}
+
+// LegacyLogin completes the password logins of handlers still calling
+// utils.CreateToken, set up as utils.LegacyLogin. They have no request to
+// read the device from and can't return a challenge, so users who need a
+// second factor get ErrChallengeUnsupported instead of tokens.
+func LegacyLogin(subject utils.TokenSubject) (string, string, int64, error) {
+	result, err := completeLogin(repo.Session{}, subject, LoginMethodPassword)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if result.TokenPair == nil {
+		return "", "", 0, ErrChallengeUnsupported
+	}
+	return result.AccessToken, result.RefreshToken, result.Exp, nil
+}
+
+func parseChallenge(challengeToken string) (*utils.Claims, error) {
+	claims, err := utils.ParseChallengeToken(challengeToken)
+	if err != nil || revocation.IsRevoked(claims) {
+		return nil, ErrInvalidChallenge
+	}
+	return claims, nil
+}
+
+// StartChallengeEnrollment lets a user whose role requires 2FA enroll during
+// login, using the challenge token in place of an access token.
+func StartChallengeEnrollment(challengeToken string) (Enrollment, error) {
+	claims, err := parseChallenge(challengeToken)
+	if err != nil {
+		return Enrollment{}, err
+	}
+	return StartEnrollment(claims.ID)
+}
+
+// VerifyChallenge completes a two-factor login. The code is a TOTP code or a
+// recovery code; during enrollment only a TOTP code confirms the new secret,
+// and the first recovery codes are returned along with the tokens.
+func VerifyChallenge(ctx *gin.Context, challengeToken, code string) (LoginResult, error) {
+	claims, err := parseChallenge(challengeToken)
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	attempt, err := ratelimit.DefaultBackend.Take("2fa:"+claims.RegisteredClaims.ID, challengeAttempts)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	if !attempt.Allowed {
+		return LoginResult{}, ErrTooManyAttempts
+	}
+
+	twoFactor, err := repo.GetTwoFactor(claims.ID)
+	if errors.Is(err, repo.ErrTwoFactorNotFound) {
+		return LoginResult{}, ErrTwoFactorNotStarted
+	}
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	var result LoginResult
+	if twoFactor.Enabled() {
+		if err := checkCode(twoFactor, code); err != nil {
+			return LoginResult{}, err
+		}
+	} else {
+		if result.RecoveryCodes, err = enable(twoFactor, code); err != nil {
+			return LoginResult{}, err
+		}
+	}
+
+	// A challenge completes a single login
+	if err := revocation.RevokeToken(claims, RevokeReasonChallengeUsed); err != nil {
+		return LoginResult{}, err
+	}
+
+	tokens, err := StartSession(ctx, claims.Subject(), claims.LoginMethod)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	result.TokenPair = &tokens
+	return result, nil
+}
+
+// StartEnrollment creates a new pending secret for the user.
+func StartEnrollment(userID int) (Enrollment, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return Enrollment{}, err
+	}
+	sealed, err := sealSecret(secret)
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	started, err := repo.StartTwoFactorEnrollment(userID, sealed)
+	if err != nil {
+		return Enrollment{}, err
+	}
+	if !started {
+		return Enrollment{}, ErrTwoFactorEnabled
+	}
+
+	account := fmt.Sprintf("user-%d", userID)
+	if contact, err := repo.GetUserContact(userID); err == nil {
+		if contact.Email != "" {
+			account = contact.Email
+		} else if contact.Phone != "" {
+			account = contact.Phone
+		}
+	}
+	return Enrollment{Secret: secret, ProvisioningURI: totp.ProvisioningURI(config.ENV.APP_NAME, account, secret)}, nil
+}
+
+// ConfirmEnrollment enables 2FA with the first code of the authenticator and
+// returns the recovery codes, which are only ever shown this once.
+func ConfirmEnrollment(userID int, code string) ([]string, error) {
+	twoFactor, err := repo.GetTwoFactor(userID)
+	if errors.Is(err, repo.ErrTwoFactorNotFound) {
+		return nil, ErrTwoFactorNotStarted
+	}
+	if err != nil {
+		return nil, err
+	}
+	if twoFactor.Enabled() {
+		return nil, ErrTwoFactorEnabled
+	}
+	return enable(twoFactor, code)
+}
+
+func enable(twoFactor repo.TwoFactor, code string) ([]string, error) {
+	secret, err := openSecret(twoFactor.Secret)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	enabled, err := repo.EnableTwoFactor(twoFactor.UserID, step, hashes)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, ErrInvalidCode
+	}
+	return codes, nil
+}
+
+// VerifyUserCode checks a code of a user with 2FA enabled, e.g. before it is
+// disabled or the recovery codes are replaced.
+func VerifyUserCode(userID int, code string) error {
+	twoFactor, err := repo.GetTwoFactor(userID)
+	if errors.Is(err, repo.ErrTwoFactorNotFound) || (err == nil && !twoFactor.Enabled()) {
+		return ErrTwoFactorNotEnabled
+	}
+	if err != nil {
+		return err
+	}
+	return checkCode(twoFactor, code)
+}
+
+// checkCode accepts a TOTP code not used before, or an unused recovery code.
+func checkCode(twoFactor repo.TwoFactor, code string) error {
+	secret, err := openSecret(twoFactor.Secret)
+	if err != nil {
+		return err
+	}
+
+	if step, ok := totp.Validate(secret, code, time.Now()); ok {
+		used, err := repo.UseTwoFactorStep(twoFactor.UserID, step)
+		if err != nil {
+			return err
+		}
+		if !used {
+			return ErrInvalidCode
+		}
+		return nil
+	}
+
+	used, err := repo.UseRecoveryCode(twoFactor.UserID, utils.HashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// NewRecoveryCodes replaces every recovery code of the user.
+func NewRecoveryCodes(userID int) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	return codes, repo.ReplaceRecoveryCodes(userID, hashes)
+}
+
+// Recovery codes are 10 base32 characters shown as xxxxx-xxxxx.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for range RecoveryCodeCount {
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(raw)[:10])
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, utils.HashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// IsTwoFactorClientError separates wrong codes and tokens from storage failures.
+func IsTwoFactorClientError(err error) bool {
+	return errors.Is(err, ErrInvalidChallenge) ||
+		errors.Is(err, ErrTooManyAttempts) ||
+		errors.Is(err, ErrInvalidCode) ||
+		errors.Is(err, ErrTwoFactorEnabled) ||
+		errors.Is(err, ErrTwoFactorNotEnabled) ||
+		errors.Is(err, ErrTwoFactorNotStarted) ||
+		errors.Is(err, ErrTwoFactorMandatory)
+}
+
+var (
+	secretKeyOnce sync.Once
+	secretAEAD    cipher.AEAD
+	secretKeyErr  error
+)
+
+// TOTP secrets have to be readable to check codes, so they are sealed with
+// AES-GCM under TOTP_ENCRYPTION_KEY.
+func secretCipher() (cipher.AEAD, error) {
+	secretKeyOnce.Do(func() {
+		key := sha256.Sum256([]byte(config.ENV.TOTP_ENCRYPTION_KEY))
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			secretKeyErr = err
+			return
+		}
+		secretAEAD, secretKeyErr = cipher.NewGCM(block)
+	})
+	return secretAEAD, secretKeyErr
+}
+
+func sealSecret(secret string) (string, error) {
+	aead, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+func openSecret(sealed string) (string, error) {
+	aead, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.RawStdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", errors.New("malformed totp secret")
+	}
+	secret, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to open totp secret: %w", err)
+	}
+	return string(secret), nil
+}
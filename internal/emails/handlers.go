@@ -0,0 +1,91 @@
+package emails
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxEmailsPerPage = 100
+
+type EmailView struct {
+	repo.OutboxEmail
+	Deliveries []repo.EmailDelivery `json:"deliveries"`
+}
+
+// GetEmails lists outgoing emails, optionally by ?status= and ?recipient=.
+func GetEmails(ctx *gin.Context) {
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > maxEmailsPerPage {
+		limit = maxEmailsPerPage
+	}
+	offset, err := strconv.Atoi(ctx.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	emails, err := repo.GetOutboxEmails(ctx.Query("status"), ctx.Query("recipient"), limit, offset)
+	if err != nil {
+		log.Printf("Failed to load emails: %v", err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to load emails", ""))
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Emails", emails))
+}
+
+// GetEmail returns an email with the log of its delivery attempts.
+func GetEmail(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid email id", err.Error()))
+		return
+	}
+
+	email, err := repo.GetOutboxEmail(id)
+	if errors.Is(err, repo.ErrOutboxEmailNotFound) {
+		ctx.JSON(http.StatusNotFound, utils.FormatErrorResponse("Email not found", ""))
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load email %d: %v", id, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to load email", ""))
+		return
+	}
+
+	deliveries, err := repo.GetEmailDeliveries(id)
+	if err != nil {
+		log.Printf("Failed to load deliveries of email %d: %v", id, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to load email", ""))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Email", EmailView{OutboxEmail: email, Deliveries: deliveries}))
+}
+
+// ResendEmail queues an email again with a fresh set of attempts, e.g. a dead
+// one after the SMTP problem that killed it has been fixed.
+func ResendEmail(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid email id", err.Error()))
+		return
+	}
+
+	requeued, err := repo.RequeueOutboxEmail(id)
+	if err != nil {
+		log.Printf("Failed to requeue email %d: %v", id, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to resend email", ""))
+		return
+	}
+	if !requeued {
+		ctx.JSON(http.StatusConflict, utils.FormatErrorResponse("Email cannot be resent", "email not found, being sent or carrying credentials"))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Email queued", gin.H{"id": id}))
+}
@@ -0,0 +1,14 @@
+package emails
+
+import (
+	"uneexpo/pkg/middlewares"
+
+	"github.com/gin-gonic/gin"
+)
+
+func InitRoutes(router *gin.RouterGroup) {
+	admin := router.Group("/admin/emails", middlewares.Guard, middlewares.RequirePermission("email.manage"))
+	admin.GET("", GetEmails)
+	admin.GET("/:id", GetEmail)
+	admin.POST("/:id/resend", ResendEmail)
+}
@@ -0,0 +1,47 @@
+package emails
+
+import (
+	"time"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/mailer"
+)
+
+// OutboxStore keeps the queue of a mailer.Outbox in tbl_email_outbox.
+type OutboxStore struct{}
+
+func (OutboxStore) Create(recipients []string, subject string, message []byte, maxAttempts int, expiresAt *time.Time, sensitive bool) error {
+	_, err := repo.CreateOutboxEmail(recipients, subject, message, maxAttempts, expiresAt, sensitive)
+	return err
+}
+
+func (OutboxStore) Claim(limit int, lease time.Duration) ([]mailer.QueuedEmail, error) {
+	emails, err := repo.ClaimOutboxEmails(limit, lease)
+	if err != nil {
+		return nil, err
+	}
+
+	queued := make([]mailer.QueuedEmail, 0, len(emails))
+	for _, e := range emails {
+		queued = append(queued, mailer.QueuedEmail{
+			ID:          e.ID,
+			Message:     e.Message,
+			Attempts:    e.Attempts,
+			MaxAttempts: e.MaxAttempts,
+			ExpiresAt:   e.ExpiresAt,
+		})
+	}
+	return queued, nil
+}
+
+func (OutboxStore) Finish(email mailer.QueuedEmail, sent, dead bool, response string, duration, retryIn time.Duration) error {
+	e := repo.OutboxEmail{ID: email.ID, Attempts: email.Attempts, MaxAttempts: email.MaxAttempts}
+	return repo.FinishOutboxAttempt(e, sent, dead, response, duration, retryIn)
+}
+
+func (OutboxStore) Expire() error {
+	return repo.ExpireOutboxEmails()
+}
+
+func (OutboxStore) Purge(retention time.Duration) error {
+	return repo.DeleteSentOutboxEmails(retention)
+}
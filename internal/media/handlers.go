@@ -0,0 +1,260 @@
+package media
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/media"
+	"uneexpo/pkg/middlewares"
+	"uneexpo/pkg/storage"
+	"uneexpo/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxMediaPerPage = 100
+
+// orphanMinAge keeps files that are being attached to a record right now
+// out of the orphan list.
+const orphanMinAge = 24 * time.Hour
+
+type MediaView struct {
+	media.File
+	Refs []repo.MediaRef `json:"refs"`
+}
+
+func owner(claims *utils.Claims) media.Owner {
+	return media.Owner{UserID: claims.ID, CompanyID: claims.CompanyID}
+}
+
+func pagination(ctx *gin.Context) (limit, offset int) {
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > maxMediaPerPage {
+		limit = maxMediaPerPage
+	}
+	offset, err = strconv.Atoi(ctx.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+// Upload stores the "files" of a multipart form under a media category.
+// Videos and audio are returned pending, with 202, and processed in the
+// background.
+func Upload(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+
+	files, err := media.SaveForm(ctx, ctx.Param("category"), "files", owner(claims))
+	if media.IsClientError(err) {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid upload", err.Error()))
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save uploads: %v", err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to save files", ""))
+		return
+	}
+
+	status := http.StatusOK
+	for _, file := range files {
+		if file.Status == repo.MediaStatusPending {
+			status = http.StatusAccepted
+		}
+	}
+	ctx.JSON(status, utils.FormatResponse("Files uploaded", files))
+}
+
+// GetMediaList lists the media of the caller's company, or of the caller if
+// they have no company, optionally by ?category= and ?media_type=.
+func GetMediaList(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+	limit, offset := pagination(ctx)
+
+	filter := repo.MediaFilter{
+		CompanyID: claims.CompanyID,
+		Category:  ctx.Query("category"),
+		MediaType: ctx.Query("media_type"),
+	}
+	if claims.CompanyID == 0 {
+		filter.UserID = claims.ID
+	}
+
+	list, err := repo.GetMediaList(filter, limit, offset)
+	if err != nil {
+		log.Printf("Failed to load media: %v", err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to load media", ""))
+		return
+	}
+
+	files := make([]media.File, 0, len(list))
+	for _, m := range list {
+		files = append(files, media.WithURLs(m, claims.ID))
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Media", files))
+}
+
+// loadOwnMedia loads the media of the :id parameter if the caller owns it or
+// holds media.manage. Media of others are reported as missing.
+func loadOwnMedia(ctx *gin.Context) (repo.Media, bool) {
+	claims, _ := middlewares.GetClaims(ctx)
+
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid media id", err.Error()))
+		return repo.Media{}, false
+	}
+
+	m, err := repo.GetMedia(id)
+	if err == nil && !owner(claims).Owns(m) {
+		var manager bool
+		if manager, err = middlewares.HasPermission(claims, "media.manage"); err == nil && !manager {
+			err = repo.ErrMediaNotFound
+		}
+	}
+	if errors.Is(err, repo.ErrMediaNotFound) {
+		ctx.JSON(http.StatusNotFound, utils.FormatErrorResponse("Media not found", ""))
+		return repo.Media{}, false
+	}
+	if err != nil {
+		log.Printf("Failed to load media %d: %v", id, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to load media", ""))
+		return repo.Media{}, false
+	}
+	return m, true
+}
+
+// GetMedia returns a media with the records referencing it.
+func GetMedia(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+	m, ok := loadOwnMedia(ctx)
+	if !ok {
+		return
+	}
+
+	refs, err := repo.GetMediaRefs(m.ID)
+	if err != nil {
+		log.Printf("Failed to load references of media %d: %v", m.ID, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to load media", ""))
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Media", MediaView{File: media.WithURLs(m, claims.ID), Refs: refs}))
+}
+
+// DeleteMedia deletes a media and its files, unless a record still uses it.
+func DeleteMedia(ctx *gin.Context) {
+	m, ok := loadOwnMedia(ctx)
+	if !ok {
+		return
+	}
+
+	_, err := media.Delete(ctx.Request.Context(), m.ID)
+	if errors.Is(err, repo.ErrMediaInUse) {
+		ctx.JSON(http.StatusConflict, utils.FormatErrorResponse("Media is in use", err.Error()))
+		return
+	}
+	if errors.Is(err, repo.ErrMediaNotFound) {
+		ctx.JSON(http.StatusNotFound, utils.FormatErrorResponse("Media not found", ""))
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete media %d: %v", m.ID, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to delete media", ""))
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Media deleted", nil))
+}
+
+// GetOrphanedMedia lists media older than a day that no record references,
+// of the categories that are attached to records.
+func GetOrphanedMedia(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+	limit, offset := pagination(ctx)
+
+	list, err := repo.GetOrphanedMedia(media.ReferencedCategories(), orphanMinAge, limit, offset)
+	if err != nil {
+		log.Printf("Failed to load orphaned media: %v", err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to load media", ""))
+		return
+	}
+
+	files := make([]media.File, 0, len(list))
+	for _, m := range list {
+		files = append(files, media.WithURLs(m, claims.ID))
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Orphaned media", files))
+}
+
+// guardPrivateMedia requires a signed URL for files of private categories.
+func guardPrivateMedia(ctx *gin.Context) {
+	if media.IsPublic(ctx.Param("key")) {
+		ctx.Next()
+		return
+	}
+	middlewares.GuardSignedURL(ctx)
+}
+
+// Serve streams a stored file, addressed by the key of its media. Files on
+// local disk support range requests, so videos can be seeked.
+func Serve(ctx *gin.Context) {
+	key, err := storage.CleanKey(ctx.Param("key"))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, utils.FormatErrorResponse("File not found", ""))
+		return
+	}
+
+	object, err := media.Resolve(key)
+	if err != nil {
+		log.Printf("Failed to resolve %s: %v", key, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to load file", ""))
+		return
+	}
+
+	body, info, err := storage.Default.Get(ctx.Request.Context(), object)
+	if errors.Is(err, storage.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, utils.FormatErrorResponse("File not found", ""))
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load %s: %v", key, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to load file", ""))
+		return
+	}
+	defer body.Close()
+
+	if media.IsPublic(key) {
+		ctx.Header("Cache-Control", "public, max-age=86400")
+	}
+	ctx.Header("Content-Type", info.ContentType)
+	ctx.Header("X-Content-Type-Options", "nosniff")
+	if !isInline(info.ContentType) {
+		ctx.Header("Content-Disposition", "attachment; filename=\""+path.Base(key)+"\"")
+	}
+
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(ctx.Writer, ctx.Request, path.Base(key), info.ModTime, seeker)
+		return
+	}
+	ctx.DataFromReader(http.StatusOK, info.Size, info.ContentType, body, nil)
+}
+
+// isInline reports whether a file may be shown in the browser. Anything else,
+// such as HTML or SVG that could run scripts on the API origin, is downloaded.
+func isInline(contentType string) bool {
+	switch {
+	case contentType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(contentType, "image/"),
+		strings.HasPrefix(contentType, "video/"),
+		strings.HasPrefix(contentType, "audio/"),
+		contentType == "application/pdf":
+		return true
+	}
+	return false
+}
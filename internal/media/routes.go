@@ -0,0 +1,25 @@
+package media
+
+import (
+	"uneexpo/pkg/middlewares"
+
+	"github.com/gin-gonic/gin"
+)
+
+// InitRoutes opens uploads to company API keys holding the media.upload scope.
+func InitRoutes(router *gin.RouterGroup) {
+	canUpload := middlewares.RequirePermission("media.upload")
+
+	router.POST("/media/:category", middlewares.GuardAPI, middlewares.APIRateLimit, canUpload, Upload)
+	// Not under /media: app.InitApp serves the old /media/{uuid}/{file}
+	// URLs there, and gin can't mix them with a catch-all
+	router.GET("/files/*key", guardPrivateMedia, Serve)
+
+	files := router.Group("/media-files", middlewares.GuardAPI, middlewares.APIRateLimit, canUpload)
+	files.GET("", GetMediaList)
+	files.GET("/:id", GetMedia)
+	files.DELETE("/:id", DeleteMedia)
+
+	admin := router.Group("/admin/media", middlewares.Guard, middlewares.RequirePermission("media.manage"))
+	admin.GET("/orphans", GetOrphanedMedia)
+}
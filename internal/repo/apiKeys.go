@@ -0,0 +1,194 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+	"uneexpo/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+type APIKey struct {
+	ID         int        `json:"id"`
+	UUID       string     `json:"uuid"`
+	CompanyID  int        `json:"company_id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIP string     `json:"last_used_ip"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// APIKeyAuth is an API key together with the state of its company and of
+// the user who created it needed to authenticate a request made with it.
+type APIKeyAuth struct {
+	APIKey
+	Role          string
+	RoleID        int
+	CompanyActive bool
+	UserActive    bool
+	APIAccess     bool
+}
+
+const apiKeyColumns = `k.id, k.uuid::TEXT, k.company_id, k.user_id, k.name, k.prefix, k.key_hash, k.scopes,
+	k.last_used_at, k.last_used_ip, k.expires_at, k.revoked_at, k.created_at`
+
+// planAPIAccess is true when the company's current plan includes API access.
+const planAPIAccess = `COALESCE(p.api_access AND c.plan_active = 1 AND p.active = 1 AND p.deleted = 0
+	AND (p.available_until IS NULL OR p.available_until > CURRENT_TIMESTAMP), FALSE)`
+
+func scanAPIKey(row pgx.Row, dest ...any) (APIKey, error) {
+	var k APIKey
+	err := row.Scan(append([]any{
+		&k.ID, &k.UUID, &k.CompanyID, &k.UserID, &k.Name, &k.Prefix, &k.KeyHash, &k.Scopes,
+		&k.LastUsedAt, &k.LastUsedIP, &k.ExpiresAt, &k.RevokedAt, &k.CreatedAt,
+	}, dest...)...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return k, ErrAPIKeyNotFound
+	}
+	return k, err
+}
+
+func GetAPIKeyAuth(prefix string) (APIKeyAuth, error) {
+	var auth APIKeyAuth
+	row := database.DB.QueryRow(
+		context.Background(),
+		`SELECT `+apiKeyColumns+`, c.role, c.role_id, (c.active = 1 AND c.deleted = 0),
+			COALESCE(u.active = 1 AND u.deleted = 0, FALSE), `+planAPIAccess+`
+		FROM tbl_api_key k
+		JOIN tbl_company c ON c.id = k.company_id
+		LEFT JOIN tbl_user u ON u.id = k.user_id
+		LEFT JOIN tbl_plan p ON p.id = c.plan_id
+		WHERE k.prefix = $1 AND k.deleted = 0`,
+		prefix,
+	)
+	key, err := scanAPIKey(row, &auth.Role, &auth.RoleID, &auth.CompanyActive, &auth.UserActive, &auth.APIAccess)
+	auth.APIKey = key
+	return auth, err
+}
+
+func CompanyHasAPIAccess(companyID int) (bool, error) {
+	var access bool
+	err := database.DB.QueryRow(
+		context.Background(),
+		`SELECT `+planAPIAccess+`
+		FROM tbl_company c
+		LEFT JOIN tbl_plan p ON p.id = c.plan_id
+		WHERE c.id = $1`,
+		companyID,
+	).Scan(&access)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return access, err
+}
+
+func CreateAPIKey(k APIKey) (APIKey, error) {
+	row := database.DB.QueryRow(
+		context.Background(),
+		`INSERT INTO tbl_api_key AS k (company_id, user_id, name, prefix, key_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+apiKeyColumns,
+		k.CompanyID, k.UserID, k.Name, k.Prefix, k.KeyHash, k.Scopes, k.ExpiresAt,
+	)
+	return scanAPIKey(row)
+}
+
+func GetCompanyAPIKeys(companyID int) ([]APIKey, error) {
+	rows, err := database.DB.Query(
+		context.Background(),
+		`SELECT `+apiKeyColumns+` FROM tbl_api_key k
+		WHERE k.company_id = $1 AND k.deleted = 0
+		ORDER BY k.created_at DESC`,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func UpdateAPIKey(companyID, id int, name string, scopes []string) (APIKey, error) {
+	row := database.DB.QueryRow(
+		context.Background(),
+		`UPDATE tbl_api_key AS k SET name = $3, scopes = $4, updated_at = CURRENT_TIMESTAMP
+		WHERE k.id = $1 AND k.company_id = $2 AND k.deleted = 0 AND k.revoked_at IS NULL
+		RETURNING `+apiKeyColumns,
+		id, companyID, name, scopes,
+	)
+	return scanAPIKey(row)
+}
+
+// RotateAPIKey replaces the secret of a key, invalidating the previous one at once.
+func RotateAPIKey(companyID, id int, prefix, keyHash string) (APIKey, error) {
+	row := database.DB.QueryRow(
+		context.Background(),
+		`UPDATE tbl_api_key AS k SET prefix = $3, key_hash = $4, last_used_at = NULL, last_used_ip = '',
+			updated_at = CURRENT_TIMESTAMP
+		WHERE k.id = $1 AND k.company_id = $2 AND k.deleted = 0 AND k.revoked_at IS NULL
+		RETURNING `+apiKeyColumns,
+		id, companyID, prefix, keyHash,
+	)
+	return scanAPIKey(row)
+}
+
+func RevokeAPIKey(companyID, id int) (bool, error) {
+	tag, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE tbl_api_key SET revoked_at = CURRENT_TIMESTAMP, active = 0, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND company_id = $2 AND deleted = 0 AND revoked_at IS NULL`,
+		id, companyID,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// APIKeyUse is the last use of an API key.
+type APIKeyUse struct {
+	At time.Time
+	IP string
+}
+
+// UpdateAPIKeysLastUsed records the last use of many keys in one statement.
+// Times are sent as ages so the clock of the database is used.
+func UpdateAPIKeysLastUsed(uses map[int]APIKeyUse) error {
+	ids := make([]int32, 0, len(uses))
+	ages := make([]float64, 0, len(uses))
+	ips := make([]string, 0, len(uses))
+	now := time.Now()
+	for id, use := range uses {
+		ids = append(ids, int32(id))
+		ages = append(ages, now.Sub(use.At).Seconds())
+		ips = append(ips, use.IP)
+	}
+
+	_, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE tbl_api_key AS k
+		SET last_used_at = CURRENT_TIMESTAMP - make_interval(secs => v.age), last_used_ip = v.ip
+		FROM unnest($1::INT[], $2::FLOAT8[], $3::TEXT[]) AS v(id, age, ip)
+		WHERE k.id = v.id`,
+		ids, ages, ips,
+	)
+	return err
+}
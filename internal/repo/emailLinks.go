@@ -0,0 +1,131 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+	"uneexpo/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrEmailLinkNotFound = errors.New("email link not found or expired")
+	ErrLoginUserNotFound = errors.New("user not found")
+)
+
+type EmailLink struct {
+	UserID int
+	Email  string
+}
+
+// LoginUser is what a token subject is built from.
+type LoginUser struct {
+	ID        int
+	RoleID    int
+	CompanyID int
+	DriverID  int
+	Role      string
+	Email     string
+}
+
+// CreateEmailLink stores a link, replacing the unused links of the user with
+// the same purpose so only the latest one works.
+func CreateEmailLink(purpose string, userID int, email, tokenHash string, ttl time.Duration) error {
+	ctx := context.Background()
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(
+		ctx,
+		`DELETE FROM tbl_email_link WHERE user_id = $1 AND (purpose = $2 OR expires_at < CURRENT_TIMESTAMP)`,
+		userID, purpose,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		ctx,
+		`INSERT INTO tbl_email_link (token_hash, purpose, user_id, email, expires_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP + make_interval(secs => $5))`,
+		tokenHash, purpose, userID, email, ttl.Seconds(),
+	); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ConsumeEmailLink deletes a valid link and returns it, so it works only once.
+func ConsumeEmailLink(purpose, tokenHash string) (EmailLink, error) {
+	var link EmailLink
+	err := database.DB.QueryRow(
+		context.Background(),
+		`DELETE FROM tbl_email_link
+		WHERE token_hash = $1 AND purpose = $2 AND expires_at > CURRENT_TIMESTAMP
+		RETURNING user_id, email`,
+		tokenHash, purpose,
+	).Scan(&link.UserID, &link.Email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return link, ErrEmailLinkNotFound
+	}
+	return link, err
+}
+
+// MarkEmailVerified sets email_verified_at if email is still the address of
+// the user, and reports whether it is.
+func MarkEmailVerified(userID int, email string) (bool, error) {
+	tag, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE tbl_user SET email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND LOWER(email) = LOWER($2) AND deleted = 0`,
+		userID, email,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+const loginUserColumns = `id, COALESCE(role_id, 0), company_id, driver_id, role::TEXT, email`
+
+func scanLoginUser(row pgx.Row) (LoginUser, error) {
+	var u LoginUser
+	err := row.Scan(&u.ID, &u.RoleID, &u.CompanyID, &u.DriverID, &u.Role, &u.Email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return u, ErrLoginUserNotFound
+	}
+	return u, err
+}
+
+// GetLoginUserByVerifiedEmail finds the active user whose verified address is email.
+func GetLoginUserByVerifiedEmail(email string) (LoginUser, error) {
+	return scanLoginUser(database.DB.QueryRow(
+		context.Background(),
+		`SELECT `+loginUserColumns+` FROM tbl_user
+		WHERE LOWER(email) = LOWER($1) AND email_verified_at IS NOT NULL AND active = 1 AND deleted = 0
+		ORDER BY id LIMIT 1`,
+		email,
+	))
+}
+
+// GetLoginUserByVerifiedPhone finds the active user whose verified number is phone.
+func GetLoginUserByVerifiedPhone(phone string) (LoginUser, error) {
+	return scanLoginUser(database.DB.QueryRow(
+		context.Background(),
+		`SELECT `+loginUserColumns+` FROM tbl_user
+		WHERE phone = $1 AND phone_verified_at IS NOT NULL AND active = 1 AND deleted = 0
+		ORDER BY id LIMIT 1`,
+		phone,
+	))
+}
+
+func GetLoginUser(userID int) (LoginUser, error) {
+	return scanLoginUser(database.DB.QueryRow(
+		context.Background(),
+		`SELECT `+loginUserColumns+` FROM tbl_user WHERE id = $1 AND active = 1 AND deleted = 0`,
+		userID,
+	))
+}
@@ -0,0 +1,248 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+	"uneexpo/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	EmailStatusQueued  = "queued"
+	EmailStatusSending = "sending"
+	EmailStatusSent    = "sent"
+	EmailStatusFailed  = "failed"
+	EmailStatusDead    = "dead"
+)
+
+var ErrOutboxEmailNotFound = errors.New("email not found")
+
+type OutboxEmail struct {
+	ID            int        `json:"id"`
+	UUID          string     `json:"uuid"`
+	Recipients    []string   `json:"recipients"`
+	Subject       string     `json:"subject"`
+	Message       []byte     `json:"-"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	MaxAttempts   int        `json:"max_attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LastResponse  string     `json:"last_response"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	Sensitive     bool       `json:"sensitive"`
+	SentAt        *time.Time `json:"sent_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+type EmailDelivery struct {
+	Attempt    int       `json:"attempt"`
+	Status     string    `json:"status"`
+	Response   string    `json:"response"`
+	DurationMs int       `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+const outboxColumns = `id, uuid::TEXT, recipients, subject, message, status, attempts, max_attempts,
+	next_attempt_at, last_response, expires_at, sensitive, sent_at, created_at`
+
+func scanOutboxEmail(row pgx.Row) (OutboxEmail, error) {
+	var e OutboxEmail
+	err := row.Scan(
+		&e.ID, &e.UUID, &e.Recipients, &e.Subject, &e.Message, &e.Status, &e.Attempts, &e.MaxAttempts,
+		&e.NextAttemptAt, &e.LastResponse, &e.ExpiresAt, &e.Sensitive, &e.SentAt, &e.CreatedAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return e, ErrOutboxEmailNotFound
+	}
+	return e, err
+}
+
+// CreateOutboxEmail queues an email. It is given up on once expiresAt passes
+// when set, and the message of a sensitive one is dropped once it is finished.
+func CreateOutboxEmail(recipients []string, subject string, message []byte, maxAttempts int, expiresAt *time.Time, sensitive bool) (int, error) {
+	var id int
+	err := database.DB.QueryRow(
+		context.Background(),
+		`INSERT INTO tbl_email_outbox (recipients, subject, message, max_attempts, expires_at, sensitive)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		recipients, subject, message, maxAttempts, expiresAt, sensitive,
+	).Scan(&id)
+	return id, err
+}
+
+// ClaimOutboxEmails locks up to limit emails due for sending for lease. Rows
+// locked by other workers are skipped, and emails of a worker that died
+// mid-send are picked up again once its lease has passed. Expired emails
+// are left to ExpireOutboxEmails.
+func ClaimOutboxEmails(limit int, lease time.Duration) ([]OutboxEmail, error) {
+	rows, err := database.DB.Query(
+		context.Background(),
+		`UPDATE tbl_email_outbox SET status = 'sending', attempts = attempts + 1,
+			locked_until = CURRENT_TIMESTAMP + make_interval(secs => $2), updated_at = CURRENT_TIMESTAMP
+		WHERE id IN (
+			SELECT id FROM tbl_email_outbox
+			WHERE ((status IN ('queued', 'failed') AND next_attempt_at <= CURRENT_TIMESTAMP)
+					OR (status = 'sending' AND locked_until < CURRENT_TIMESTAMP))
+				AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+outboxColumns,
+		limit, lease.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []OutboxEmail{}
+	for rows.Next() {
+		e, err := scanOutboxEmail(rows)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, e)
+	}
+	return emails, rows.Err()
+}
+
+// FinishOutboxAttempt records the result of an attempt. A failed email is
+// retried after retryIn, or marked dead when dead is set. The message of a
+// sensitive email is dropped once it is sent or dead.
+func FinishOutboxAttempt(e OutboxEmail, sent, dead bool, response string, duration, retryIn time.Duration) error {
+	ctx := context.Background()
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	status := EmailStatusSent
+	if !sent {
+		status = EmailStatusFailed
+	}
+	if _, err := tx.Exec(
+		ctx,
+		`INSERT INTO tbl_email_delivery (outbox_id, attempt, status, response, duration_ms) VALUES ($1, $2, $3, $4, $5)`,
+		e.ID, e.Attempts, status, response, duration.Milliseconds(),
+	); err != nil {
+		return err
+	}
+
+	if !sent && dead {
+		status = EmailStatusDead
+	}
+	if _, err := tx.Exec(
+		ctx,
+		`UPDATE tbl_email_outbox SET status = $2, last_response = $3, locked_until = NULL,
+			message = CASE WHEN sensitive AND $2 IN ('sent', 'dead') THEN '{}' ELSE message END,
+			next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $4),
+			sent_at = CASE WHEN $2 = 'sent' THEN CURRENT_TIMESTAMP END, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		e.ID, status, response, retryIn.Seconds(),
+	); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// RequeueOutboxEmail sends an email again from scratch, whatever its status.
+// Sensitive emails are not resent, their codes are requested again instead.
+func RequeueOutboxEmail(id int) (bool, error) {
+	tag, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE tbl_email_outbox SET status = 'queued', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP,
+			locked_until = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status <> 'sending' AND NOT sensitive`,
+		id,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func GetOutboxEmail(id int) (OutboxEmail, error) {
+	row := database.DB.QueryRow(
+		context.Background(),
+		`SELECT `+outboxColumns+` FROM tbl_email_outbox WHERE id = $1`,
+		id,
+	)
+	return scanOutboxEmail(row)
+}
+
+// GetOutboxEmails lists emails newest first, filtered by status and recipient when set.
+func GetOutboxEmails(status, recipient string, limit, offset int) ([]OutboxEmail, error) {
+	rows, err := database.DB.Query(
+		context.Background(),
+		`SELECT `+outboxColumns+` FROM tbl_email_outbox
+		WHERE ($1 = '' OR status = $1) AND ($2 = '' OR $2 = ANY(recipients))
+		ORDER BY created_at DESC
+		LIMIT $3 OFFSET $4`,
+		status, recipient, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []OutboxEmail{}
+	for rows.Next() {
+		e, err := scanOutboxEmail(rows)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, e)
+	}
+	return emails, rows.Err()
+}
+
+func GetEmailDeliveries(outboxID int) ([]EmailDelivery, error) {
+	rows, err := database.DB.Query(
+		context.Background(),
+		`SELECT attempt, status, response, duration_ms, created_at FROM tbl_email_delivery
+		WHERE outbox_id = $1 ORDER BY id`,
+		outboxID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []EmailDelivery{}
+	for rows.Next() {
+		var d EmailDelivery
+		if err := rows.Scan(&d.Attempt, &d.Status, &d.Response, &d.DurationMs, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// ExpireOutboxEmails gives up on unsent emails whose deadline passed, and
+// drops the messages of sensitive ones.
+func ExpireOutboxEmails() error {
+	_, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE tbl_email_outbox SET status = 'dead', last_response = 'expired before it was sent', locked_until = NULL,
+			message = CASE WHEN sensitive THEN '{}' ELSE message END, updated_at = CURRENT_TIMESTAMP
+		WHERE expires_at <= CURRENT_TIMESTAMP
+			AND (status IN ('queued', 'failed') OR (status = 'sending' AND locked_until < CURRENT_TIMESTAMP))`,
+	)
+	return err
+}
+
+// DeleteSentOutboxEmails drops emails sent before the retention period.
+func DeleteSentOutboxEmails(retention time.Duration) error {
+	_, err := database.DB.Exec(
+		context.Background(),
+		`DELETE FROM tbl_email_outbox
+		WHERE status = 'sent' AND sent_at < CURRENT_TIMESTAMP - make_interval(secs => $1)`,
+		retention.Seconds(),
+	)
+	return err
+}
@@ -0,0 +1,31 @@
+package repo
+
+import (
+	"context"
+	"uneexpo/database"
+)
+
+// GetUserFirebaseTokens returns the push tokens of the devices a user is logged into.
+func GetUserFirebaseTokens(userID int) ([]string, error) {
+	rows, err := database.DB.Query(
+		context.Background(),
+		`SELECT token FROM tbl_firebase_token
+		WHERE user_id = $1 AND active = 1 AND deleted = 0
+		ORDER BY updated_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []string{}
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
@@ -0,0 +1,29 @@
+package repo
+
+import (
+	"context"
+	"time"
+	"uneexpo/database"
+)
+
+// UpdateCompaniesLastActive sets tbl_company.last_active of many companies in
+// one statement. Times are sent as ages so the clock of the database is used.
+func UpdateCompaniesLastActive(lastActive map[int]time.Time) error {
+	ids := make([]int32, 0, len(lastActive))
+	ages := make([]float64, 0, len(lastActive))
+	now := time.Now()
+	for companyID, seen := range lastActive {
+		ids = append(ids, int32(companyID))
+		ages = append(ages, now.Sub(seen).Seconds())
+	}
+
+	_, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE tbl_company AS c
+		SET last_active = CURRENT_TIMESTAMP - make_interval(secs => v.age)
+		FROM unnest($1::INT[], $2::FLOAT8[]) AS v(id, age)
+		WHERE c.id = v.id`,
+		ids, ages,
+	)
+	return err
+}
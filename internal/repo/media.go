@@ -0,0 +1,205 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+	"uneexpo/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	MediaStatusPending    = "pending"
+	MediaStatusProcessing = "processing"
+	MediaStatusReady      = "ready"
+	MediaStatusFailed     = "failed"
+)
+
+var (
+	ErrMediaNotFound = errors.New("media not found")
+	ErrMediaInUse    = errors.New("media is still in use")
+)
+
+type Media struct {
+	ID           int       `json:"id"`
+	UUID         string    `json:"uuid"`
+	BlobID       *int      `json:"-"`
+	UserID       *int      `json:"user_id"`
+	CompanyID    int       `json:"company_id"`
+	Category     string    `json:"category"`
+	MediaType    string    `json:"media_type"`
+	MimeType     string    `json:"mime_type"`
+	OriginalName string    `json:"original_name"`
+	StorageKey   string    `json:"storage_key"`
+	ThumbKey     string    `json:"thumb_key"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	Duration     *int      `json:"duration"`
+	Status       string    `json:"status"`
+	Error        string    `json:"error,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// MediaFilter narrows GetMediaList. Zero fields match everything; set
+// CompanyID or UserID to list what one owner may see.
+type MediaFilter struct {
+	UserID    int
+	CompanyID int
+	Category  string
+	MediaType string
+}
+
+// MediaRef is a place a media is referenced from, e.g. tbl_vehicle.photo1
+// of vehicle RefID.
+type MediaRef struct {
+	Ref   string `json:"ref"`
+	RefID int    `json:"ref_id"`
+}
+
+const mediaColumns = `id, uuid::TEXT, blob_id, user_id, company_id, category, media_type, mime_type, original_name,
+	storage_key, thumb_key, size, sha256, width, height, duration, status, error, created_at, updated_at`
+
+func scanMedia(row pgx.Row) (Media, error) {
+	var m Media
+	err := row.Scan(
+		&m.ID, &m.UUID, &m.BlobID, &m.UserID, &m.CompanyID, &m.Category, &m.MediaType, &m.MimeType, &m.OriginalName,
+		&m.StorageKey, &m.ThumbKey, &m.Size, &m.SHA256, &m.Width, &m.Height, &m.Duration, &m.Status, &m.Error,
+		&m.CreatedAt, &m.UpdatedAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return m, ErrMediaNotFound
+	}
+	return m, err
+}
+
+func scanMediaRows(rows pgx.Rows) ([]Media, error) {
+	defer rows.Close()
+
+	media := []Media{}
+	for rows.Next() {
+		m, err := scanMedia(rows)
+		if err != nil {
+			return nil, err
+		}
+		media = append(media, m)
+	}
+	return media, rows.Err()
+}
+
+func GetMedia(id int) (Media, error) {
+	return scanMedia(database.DB.QueryRow(
+		context.Background(),
+		`SELECT `+mediaColumns+` FROM tbl_media WHERE id = $1 AND deleted = 0`,
+		id,
+	))
+}
+
+func GetMediaList(filter MediaFilter, limit, offset int) ([]Media, error) {
+	rows, err := database.DB.Query(
+		context.Background(),
+		`SELECT `+mediaColumns+` FROM tbl_media
+		WHERE deleted = 0
+			AND ($1 = 0 OR user_id = $1) AND ($2 = 0 OR company_id = $2)
+			AND ($3 = '' OR category = $3) AND ($4 = '' OR media_type = $4)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $5 OFFSET $6`,
+		filter.UserID, filter.CompanyID, filter.Category, filter.MediaType, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanMediaRows(rows)
+}
+
+// GetMediaRefs lists where a media is referenced from, see v_media_ref.
+func GetMediaRefs(id int) ([]MediaRef, error) {
+	rows, err := database.DB.Query(
+		context.Background(),
+		`SELECT ref, ref_id FROM v_media_ref WHERE media_id = $1 ORDER BY ref, ref_id`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := []MediaRef{}
+	for rows.Next() {
+		var r MediaRef
+		if err := rows.Scan(&r.Ref, &r.RefID); err != nil {
+			return nil, err
+		}
+		refs = append(refs, r)
+	}
+	return refs, rows.Err()
+}
+
+// DeleteMedia marks a media deleted and releases its blob. It returns the
+// media, and the blob if this was its last reference so its files can be
+// removed from storage. Media still referenced are not deleted.
+func DeleteMedia(id int) (Media, *MediaBlob, error) {
+	ctx := context.Background()
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return Media{}, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	m, err := scanMedia(tx.QueryRow(
+		ctx,
+		`SELECT `+mediaColumns+` FROM tbl_media WHERE id = $1 AND deleted = 0 FOR UPDATE`,
+		id,
+	))
+	if err != nil {
+		return Media{}, nil, err
+	}
+
+	var inUse bool
+	if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM v_media_ref WHERE media_id = $1)`, id).Scan(&inUse); err != nil {
+		return Media{}, nil, err
+	}
+	if inUse {
+		return Media{}, nil, ErrMediaInUse
+	}
+
+	if _, err := tx.Exec(
+		ctx,
+		`UPDATE tbl_media SET deleted = 1, updated_at = CURRENT_TIMESTAMP WHERE id = $1`,
+		id,
+	); err != nil {
+		return Media{}, nil, err
+	}
+
+	var released *MediaBlob
+	if m.BlobID != nil {
+		if released, err = releaseMediaBlob(ctx, tx, *m.BlobID); err != nil {
+			return Media{}, nil, err
+		}
+	}
+	return m, released, tx.Commit(ctx)
+}
+
+// GetOrphanedMedia lists media of categories older than minAge that nothing
+// references: uploads never attached to anything, and files replaced by newer
+// uploads.
+func GetOrphanedMedia(categories []string, minAge time.Duration, limit, offset int) ([]Media, error) {
+	rows, err := database.DB.Query(
+		context.Background(),
+		`SELECT `+mediaColumns+` FROM tbl_media m
+		WHERE deleted = 0
+			AND created_at < CURRENT_TIMESTAMP - make_interval(secs => $1)
+			AND category = ANY($2)
+			AND NOT EXISTS (SELECT 1 FROM v_media_ref r WHERE r.media_id = m.id)
+		ORDER BY created_at, id
+		LIMIT $3 OFFSET $4`,
+		minAge.Seconds(), categories, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanMediaRows(rows)
+}
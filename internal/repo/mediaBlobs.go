@@ -0,0 +1,155 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+	"uneexpo/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrMediaBlobNotFound = errors.New("media blob not found")
+
+// MediaBlob is a stored file shared by all media of a category with the same
+// content.
+type MediaBlob struct {
+	ID         int
+	Category   string
+	SHA256     string
+	StorageKey string
+	ThumbKey   string
+	MediaType  string
+	MimeType   string
+	Size       int64
+	Width      int
+	Height     int
+	Duration   *int
+	RefCount   int
+	CreatedAt  time.Time
+}
+
+const mediaBlobColumns = `id, category, sha256, storage_key, thumb_key, media_type, mime_type,
+	size, width, height, duration, ref_count, created_at`
+
+func scanMediaBlob(row pgx.Row) (MediaBlob, error) {
+	var b MediaBlob
+	err := row.Scan(
+		&b.ID, &b.Category, &b.SHA256, &b.StorageKey, &b.ThumbKey, &b.MediaType, &b.MimeType,
+		&b.Size, &b.Width, &b.Height, &b.Duration, &b.RefCount, &b.CreatedAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return b, ErrMediaBlobNotFound
+	}
+	return b, err
+}
+
+func GetMediaBlob(category, sha256 string) (MediaBlob, error) {
+	return scanMediaBlob(database.DB.QueryRow(
+		context.Background(),
+		`SELECT `+mediaBlobColumns+` FROM tbl_media_blob WHERE category = $1 AND sha256 = $2`,
+		category, sha256,
+	))
+}
+
+// CreateMediaAlias stores m as a new reference to blob. A blob with an ID
+// must still exist; one without is stored, or referenced if an equal blob
+// was stored meanwhile. The file details of m are taken from the blob, and
+// the blob referenced is returned with it.
+func CreateMediaAlias(m Media, blob MediaBlob) (Media, MediaBlob, error) {
+	ctx := context.Background()
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return Media{}, MediaBlob{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	if blob.ID != 0 {
+		blob, err = scanMediaBlob(tx.QueryRow(
+			ctx,
+			`UPDATE tbl_media_blob SET ref_count = ref_count + 1, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1 RETURNING `+mediaBlobColumns,
+			blob.ID,
+		))
+	} else {
+		blob, err = addMediaBlob(ctx, tx, blob)
+	}
+	if err != nil {
+		return Media{}, MediaBlob{}, err
+	}
+
+	if blob.ThumbKey == "" {
+		m.ThumbKey = ""
+	}
+	m, err = scanMedia(tx.QueryRow(
+		ctx,
+		`INSERT INTO tbl_media (blob_id, user_id, company_id, category, media_type, mime_type, original_name,
+			storage_key, thumb_key, size, sha256, width, height, duration, status, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		RETURNING `+mediaColumns,
+		blob.ID, m.UserID, m.CompanyID, m.Category, blob.MediaType, blob.MimeType, m.OriginalName,
+		m.StorageKey, m.ThumbKey, blob.Size, blob.SHA256, blob.Width, blob.Height, blob.Duration, m.Status, m.Error,
+	))
+	if err != nil {
+		return Media{}, MediaBlob{}, err
+	}
+	return m, blob, tx.Commit(ctx)
+}
+
+// addMediaBlob stores a blob with one reference, or adds a reference to an
+// equal blob stored meanwhile. The files of blob are unused then, the keys of
+// the blob returned differ.
+func addMediaBlob(ctx context.Context, tx pgx.Tx, blob MediaBlob) (MediaBlob, error) {
+	return scanMediaBlob(tx.QueryRow(
+		ctx,
+		`INSERT INTO tbl_media_blob (category, sha256, storage_key, thumb_key, media_type, mime_type,
+			size, width, height, duration)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (category, sha256) DO UPDATE
+			SET ref_count = tbl_media_blob.ref_count + 1, updated_at = CURRENT_TIMESTAMP
+		RETURNING `+mediaBlobColumns,
+		blob.Category, blob.SHA256, blob.StorageKey, blob.ThumbKey, blob.MediaType, blob.MimeType,
+		blob.Size, blob.Width, blob.Height, blob.Duration,
+	))
+}
+
+// releaseMediaBlob drops a reference to a blob and deletes the blob with its
+// last reference, returning it then.
+func releaseMediaBlob(ctx context.Context, tx pgx.Tx, id int) (*MediaBlob, error) {
+	blob, err := scanMediaBlob(tx.QueryRow(
+		ctx,
+		`UPDATE tbl_media_blob SET ref_count = ref_count - 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 RETURNING `+mediaBlobColumns,
+		id,
+	))
+	if errors.Is(err, ErrMediaBlobNotFound) {
+		return nil, nil
+	}
+	if err != nil || blob.RefCount > 0 {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM tbl_media_blob WHERE id = $1`, id); err != nil {
+		return nil, err
+	}
+	return &blob, nil
+}
+
+// ResolveMediaKey returns the storage key of the file a media URL key
+// addresses: the blob, or the thumbnail of the blob, of a live alias.
+func ResolveMediaKey(key string) (string, error) {
+	var resolved string
+	err := database.DB.QueryRow(
+		context.Background(),
+		`SELECT CASE WHEN m.storage_key = $1 THEN b.storage_key ELSE b.thumb_key END
+		FROM tbl_media m
+			JOIN tbl_media_blob b ON b.id = m.blob_id
+		WHERE m.deleted = 0 AND (m.storage_key = $1 OR m.thumb_key = $1)
+		LIMIT 1`,
+		key,
+	).Scan(&resolved)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrMediaNotFound
+	}
+	return resolved, err
+}
@@ -0,0 +1,294 @@
+package repo
+
+import (
+	"context"
+	"time"
+	"uneexpo/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	MediaJobStatusQueued  = "queued"
+	MediaJobStatusRunning = "running"
+	MediaJobStatusDone    = "done"
+	MediaJobStatusFailed  = "failed"
+	MediaJobStatusDead    = "dead"
+)
+
+// MediaJob processes the original of a pending media, see tbl_media_job.
+type MediaJob struct {
+	ID            int
+	MediaID       int
+	SourceKey     string
+	Status        string
+	Attempts      int
+	MaxAttempts   int
+	NextAttemptAt time.Time
+	LastError     string
+	CreatedAt     time.Time
+}
+
+const mediaJobColumns = `id, media_id, source_key, status, attempts, max_attempts, next_attempt_at, last_error, created_at`
+
+// mediaJobLostError is recorded for a job whose worker never reported back
+// on its last attempt.
+const mediaJobLostError = "processing did not finish within its lease"
+
+func scanMediaJob(row pgx.Row) (MediaJob, error) {
+	var j MediaJob
+	err := row.Scan(
+		&j.ID, &j.MediaID, &j.SourceKey, &j.Status, &j.Attempts, &j.MaxAttempts, &j.NextAttemptAt, &j.LastError, &j.CreatedAt,
+	)
+	return j, err
+}
+
+// CreatePendingMedia stores m as pending, without a blob, and queues a job
+// to process its original at sourceKey.
+func CreatePendingMedia(m Media, sourceKey string, maxAttempts int) (Media, error) {
+	ctx := context.Background()
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return Media{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	m, err = scanMedia(tx.QueryRow(
+		ctx,
+		`INSERT INTO tbl_media (user_id, company_id, category, media_type, mime_type, original_name,
+			storage_key, size, sha256, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, 'pending')
+		RETURNING `+mediaColumns,
+		m.UserID, m.CompanyID, m.Category, m.MediaType, m.MimeType, m.OriginalName,
+		m.StorageKey, m.Size, m.SHA256,
+	))
+	if err != nil {
+		return Media{}, err
+	}
+
+	if _, err := tx.Exec(
+		ctx,
+		`INSERT INTO tbl_media_job (media_id, source_key, max_attempts) VALUES ($1, $2, $3)`,
+		m.ID, sourceKey, maxAttempts,
+	); err != nil {
+		return Media{}, err
+	}
+	return m, tx.Commit(ctx)
+}
+
+// ClaimMediaJobs locks up to limit due jobs for lease and marks their media
+// as processing. Jobs whose lease passed are claimed again: the worker
+// crashed or hung. If that was their last attempt they are marked dead with
+// their media failed instead, so a file that kills the worker is not
+// retried forever.
+func ClaimMediaJobs(limit int, lease time.Duration) ([]MediaJob, error) {
+	rows, err := database.DB.Query(
+		context.Background(),
+		`WITH exhausted AS (
+			UPDATE tbl_media_job SET status = 'dead', last_error = $3, locked_until = NULL,
+				updated_at = CURRENT_TIMESTAMP
+			WHERE id IN (
+				SELECT id FROM tbl_media_job
+				WHERE status = 'running' AND locked_until < CURRENT_TIMESTAMP AND attempts >= max_attempts
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING media_id
+		), failed AS (
+			UPDATE tbl_media SET status = 'failed', error = $3, updated_at = CURRENT_TIMESTAMP
+			WHERE id IN (SELECT media_id FROM exhausted) AND deleted = 0
+		), claimed AS (
+			UPDATE tbl_media_job SET status = 'running', attempts = attempts + 1,
+				locked_until = CURRENT_TIMESTAMP + make_interval(secs => $2), updated_at = CURRENT_TIMESTAMP
+			WHERE id IN (
+				SELECT id FROM tbl_media_job
+				WHERE (status IN ('queued', 'failed') AND next_attempt_at <= CURRENT_TIMESTAMP)
+					OR (status = 'running' AND locked_until < CURRENT_TIMESTAMP AND attempts < max_attempts)
+				ORDER BY next_attempt_at
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING `+mediaJobColumns+`
+		), processing AS (
+			UPDATE tbl_media SET status = 'processing', updated_at = CURRENT_TIMESTAMP
+			WHERE id IN (SELECT media_id FROM claimed) AND deleted = 0
+		)
+		SELECT `+mediaJobColumns+` FROM claimed`,
+		limit, lease.Seconds(), mediaJobLostError,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []MediaJob{}
+	for rows.Next() {
+		j, err := scanMediaJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// CompleteMediaJob attaches the processed blob to the media of a job and
+// makes it ready. thumbKey is the key of the thumbnail of the media, used
+// if the blob has one. A media deleted meanwhile is not found, and the
+// blob is not stored then. The blob the media references is returned with
+// it, an equal one stored meanwhile rather than blob.
+func CompleteMediaJob(j MediaJob, blob MediaBlob, thumbKey string) (Media, MediaBlob, error) {
+	ctx := context.Background()
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return Media{}, MediaBlob{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Locked against DeleteMedia
+	if _, err := scanMedia(tx.QueryRow(
+		ctx,
+		`SELECT `+mediaColumns+` FROM tbl_media WHERE id = $1 AND deleted = 0 FOR UPDATE`,
+		j.MediaID,
+	)); err != nil {
+		return Media{}, MediaBlob{}, err
+	}
+
+	blob, err = addMediaBlob(ctx, tx, blob)
+	if err != nil {
+		return Media{}, MediaBlob{}, err
+	}
+	if blob.ThumbKey == "" {
+		thumbKey = ""
+	}
+
+	m, err := scanMedia(tx.QueryRow(
+		ctx,
+		`UPDATE tbl_media SET blob_id = $2, media_type = $3, mime_type = $4, thumb_key = $5, size = $6,
+			width = $7, height = $8, duration = $9, status = 'ready', error = '', updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING `+mediaColumns,
+		j.MediaID, blob.ID, blob.MediaType, blob.MimeType, thumbKey, blob.Size,
+		blob.Width, blob.Height, blob.Duration,
+	))
+	if err != nil {
+		return Media{}, MediaBlob{}, err
+	}
+
+	if _, err := tx.Exec(
+		ctx,
+		`UPDATE tbl_media_job SET status = 'done', last_error = '', locked_until = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		j.ID,
+	); err != nil {
+		return Media{}, MediaBlob{}, err
+	}
+	return m, blob, tx.Commit(ctx)
+}
+
+// FailMediaJob records a failed attempt. The job is retried after retryIn,
+// or marked dead with its media failed once it is out of attempts.
+func FailMediaJob(j MediaJob, failure string, retryIn time.Duration) (dead bool, err error) {
+	ctx := context.Background()
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	dead = j.Attempts >= j.MaxAttempts
+	status, mediaStatus := MediaJobStatusFailed, MediaStatusPending
+	if dead {
+		status, mediaStatus = MediaJobStatusDead, MediaStatusFailed
+	}
+	if _, err := tx.Exec(
+		ctx,
+		`UPDATE tbl_media_job SET status = $2, last_error = $3, locked_until = NULL,
+			next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $4), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		j.ID, status, failure, retryIn.Seconds(),
+	); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(
+		ctx,
+		`UPDATE tbl_media SET status = $2, error = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND deleted = 0`,
+		j.MediaID, mediaStatus, failure,
+	); err != nil {
+		return false, err
+	}
+	return dead, tx.Commit(ctx)
+}
+
+// ReleaseMediaJob queues a job interrupted by a shutdown again, due now and
+// without counting the attempt, and makes its media pending again.
+func ReleaseMediaJob(j MediaJob) error {
+	ctx := context.Background()
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(
+		ctx,
+		`UPDATE tbl_media_job SET status = 'queued', attempts = GREATEST(attempts - 1, 0), locked_until = NULL,
+			next_attempt_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'running'`,
+		j.ID,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		ctx,
+		`UPDATE tbl_media SET status = 'pending', updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'processing' AND deleted = 0`,
+		j.MediaID,
+	); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// CancelMediaJob ends the job of a media that was deleted before it was
+// processed.
+func CancelMediaJob(id int) error {
+	_, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE tbl_media_job SET status = 'done', last_error = 'media deleted', locked_until = NULL,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		id,
+	)
+	return err
+}
+
+// MediaSourceInUse reports whether the original of a media at sourceKey is
+// still needed by a blob or by another media waiting for processing.
+func MediaSourceInUse(mediaID int, sourceKey string) (bool, error) {
+	var inUse bool
+	err := database.DB.QueryRow(
+		context.Background(),
+		`SELECT EXISTS (SELECT 1 FROM tbl_media_blob WHERE storage_key = $2)
+			OR EXISTS (
+				SELECT 1 FROM tbl_media_job j
+					JOIN tbl_media m ON m.id = j.media_id
+				WHERE j.source_key = $2 AND j.media_id <> $1 AND m.deleted = 0
+					AND j.status IN ('queued', 'running', 'failed')
+			)`,
+		mediaID, sourceKey,
+	).Scan(&inUse)
+	return inUse, err
+}
+
+// DeleteDoneMediaJobs purges finished jobs older than retention. Dead jobs
+// are kept with their failed media.
+func DeleteDoneMediaJobs(retention time.Duration) error {
+	_, err := database.DB.Exec(
+		context.Background(),
+		`DELETE FROM tbl_media_job
+		WHERE status = 'done' AND updated_at < CURRENT_TIMESTAMP - make_interval(secs => $1)`,
+		retention.Seconds(),
+	)
+	return err
+}
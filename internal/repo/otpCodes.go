@@ -0,0 +1,144 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+	"uneexpo/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrOTPNotFound = errors.New("no active code")
+	ErrOTPCooldown = errors.New("a code was sent recently")
+	ErrOTPDailyCap = errors.New("too many codes sent to this destination today")
+)
+
+type OTPCode struct {
+	ID          int
+	Purpose     string
+	Destination string
+	CodeHash    string
+	Attempts    int
+	MaxAttempts int
+	Expired     bool
+}
+
+// CreateOTPCode stores a new code and supersedes the unused codes of the same
+// purpose and destination. It is refused with ErrOTPCooldown or ErrOTPDailyCap,
+// along with the time to wait, when the destination got a code too recently
+// or too often. Codes to one destination are issued one at a time.
+func CreateOTPCode(c OTPCode, ttl, cooldown time.Duration, dailyCap int) (time.Duration, error) {
+	ctx := context.Background()
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('otp:' || $1))`, c.Destination); err != nil {
+		return 0, err
+	}
+
+	var sinceLast, oldestAge *float64
+	var sentToday int
+	err = tx.QueryRow(
+		ctx,
+		`SELECT EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - MAX(created_at) FILTER (WHERE purpose = $2))::FLOAT8,
+			EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - MIN(created_at))::FLOAT8,
+			COUNT(*)
+		FROM tbl_otp_code
+		WHERE destination = $1 AND created_at > CURRENT_TIMESTAMP - INTERVAL '1 day'`,
+		c.Destination, c.Purpose,
+	).Scan(&sinceLast, &oldestAge, &sentToday)
+	if err != nil {
+		return 0, err
+	}
+
+	if sinceLast != nil {
+		if wait := cooldown - secondsToDuration(*sinceLast); wait > 0 {
+			return wait, ErrOTPCooldown
+		}
+	}
+	if dailyCap > 0 && sentToday >= dailyCap && oldestAge != nil {
+		return 24*time.Hour - secondsToDuration(*oldestAge), ErrOTPDailyCap
+	}
+
+	if _, err := tx.Exec(
+		ctx,
+		`UPDATE tbl_otp_code SET consumed_at = CURRENT_TIMESTAMP
+		WHERE destination = $1 AND purpose = $2 AND consumed_at IS NULL`,
+		c.Destination, c.Purpose,
+	); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(
+		ctx,
+		`INSERT INTO tbl_otp_code (purpose, destination, code_hash, max_attempts, expires_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP + make_interval(secs => $5))`,
+		c.Purpose, c.Destination, c.CodeHash, c.MaxAttempts, ttl.Seconds(),
+	); err != nil {
+		return 0, err
+	}
+	return 0, tx.Commit(ctx)
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// GetActiveOTPCode returns the latest unused code of a purpose and destination.
+func GetActiveOTPCode(purpose, destination string) (OTPCode, error) {
+	c := OTPCode{Purpose: purpose, Destination: destination}
+	err := database.DB.QueryRow(
+		context.Background(),
+		`SELECT id, code_hash, attempts, max_attempts, expires_at < CURRENT_TIMESTAMP
+		FROM tbl_otp_code
+		WHERE purpose = $1 AND destination = $2 AND consumed_at IS NULL
+		ORDER BY created_at DESC LIMIT 1`,
+		purpose, destination,
+	).Scan(&c.ID, &c.CodeHash, &c.Attempts, &c.MaxAttempts, &c.Expired)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c, ErrOTPNotFound
+	}
+	return c, err
+}
+
+// RecordOTPAttempt counts a verification attempt before the code is compared.
+// It returns false once the code has used up its attempts.
+func RecordOTPAttempt(id int) (bool, error) {
+	tag, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE tbl_otp_code SET attempts = attempts + 1
+		WHERE id = $1 AND consumed_at IS NULL AND attempts < max_attempts`,
+		id,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// ConsumeOTPCode marks a code as used, returning false if it already was.
+func ConsumeOTPCode(id int) (bool, error) {
+	tag, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE tbl_otp_code SET consumed_at = CURRENT_TIMESTAMP WHERE id = $1 AND consumed_at IS NULL`,
+		id,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// DeleteOldOTPCodes drops codes no longer needed for the daily caps.
+func DeleteOldOTPCodes() error {
+	_, err := database.DB.Exec(
+		context.Background(),
+		`DELETE FROM tbl_otp_code WHERE created_at < CURRENT_TIMESTAMP - INTERVAL '2 days'`,
+	)
+	return err
+}
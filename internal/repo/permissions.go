@@ -0,0 +1,137 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"uneexpo/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type Role struct {
+	ID          int      `json:"id"`
+	Role        string   `json:"role"`
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+	// RequireTwoFactor makes users of the role enroll in 2FA before they can log in.
+	RequireTwoFactor bool `json:"require_2fa"`
+}
+
+type Permission struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// GetRolesWithPermissions returns every row of tbl_role with the names of its permissions.
+func GetRolesWithPermissions() ([]Role, error) {
+	rows, err := database.DB.Query(
+		context.Background(),
+		`SELECT r.id, r.role, r.name, r.require_2fa, COALESCE(ARRAY_AGG(p.name ORDER BY p.name) FILTER (WHERE p.id IS NOT NULL), '{}')
+		FROM tbl_role r
+		LEFT JOIN tbl_role_permission rp ON rp.role_id = r.id
+		LEFT JOIN tbl_permission p ON p.id = rp.permission_id
+		GROUP BY r.id
+		ORDER BY r.id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.ID, &role.Role, &role.Name, &role.RequireTwoFactor, &role.Permissions); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func GetPermissions() ([]Permission, error) {
+	rows, err := database.DB.Query(
+		context.Background(),
+		`SELECT id, name, description FROM tbl_permission ORDER BY name`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []Permission{}
+	for rows.Next() {
+		var p Permission
+		if err := rows.Scan(&p.ID, &p.Name, &p.Description); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, p)
+	}
+	return permissions, rows.Err()
+}
+
+func CreatePermission(name, description string) (Permission, error) {
+	p := Permission{Name: name, Description: description}
+	err := database.DB.QueryRow(
+		context.Background(),
+		`INSERT INTO tbl_permission (name, description) VALUES ($1, $2) RETURNING id`,
+		name, description,
+	).Scan(&p.ID)
+	return p, err
+}
+
+// SetRolePermissions replaces the permissions of a role with the given names.
+func SetRolePermissions(roleID int, names []string) error {
+	ctx := context.Background()
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM tbl_role_permission WHERE role_id = $1`, roleID); err != nil {
+		return err
+	}
+
+	tag, err := tx.Exec(
+		ctx,
+		`INSERT INTO tbl_role_permission (role_id, permission_id)
+		SELECT $1, id FROM tbl_permission WHERE name = ANY($2)`,
+		roleID, names,
+	)
+	if err != nil {
+		return err
+	}
+	if int(tag.RowsAffected()) != len(names) {
+		return fmt.Errorf("unknown permission in %v", names)
+	}
+
+	return tx.Commit(ctx)
+}
+
+func SetRoleTwoFactorRequired(roleID int, required bool) (bool, error) {
+	tag, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE tbl_role SET require_2fa = $2 WHERE id = $1`,
+		roleID, required,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func RoleRequiresTwoFactor(roleID int) (bool, error) {
+	var required bool
+	err := database.DB.QueryRow(
+		context.Background(),
+		`SELECT require_2fa FROM tbl_role WHERE id = $1`,
+		roleID,
+	).Scan(&required)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return required, err
+}
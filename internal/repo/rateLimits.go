@@ -0,0 +1,57 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+	"uneexpo/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// TakeRateLimitToken refills the bucket under key and consumes a token if one
+// is available, in a single statement so concurrent instances cannot race.
+func TakeRateLimitToken(key string, burst, rate float64) (float64, bool, error) {
+	var tokens float64
+	var allowed bool
+	err := database.DB.QueryRow(
+		context.Background(),
+		`INSERT INTO tbl_rate_limit AS r (key, tokens, allowed, updated_at)
+		VALUES ($1, $2 - 1, $2 >= 1, clock_timestamp())
+		ON CONFLICT (key) DO UPDATE SET
+			tokens = LEAST($2, r.tokens + EXTRACT(EPOCH FROM clock_timestamp() - r.updated_at) * $3)
+				- CASE WHEN LEAST($2, r.tokens + EXTRACT(EPOCH FROM clock_timestamp() - r.updated_at) * $3) >= 1 THEN 1 ELSE 0 END,
+			allowed = LEAST($2, r.tokens + EXTRACT(EPOCH FROM clock_timestamp() - r.updated_at) * $3) >= 1,
+			updated_at = clock_timestamp()
+		RETURNING tokens, allowed`,
+		key, burst, rate,
+	).Scan(&tokens, &allowed)
+	return tokens, allowed, err
+}
+
+func DeleteIdleRateLimits(idle time.Duration) error {
+	_, err := database.DB.Exec(
+		context.Background(),
+		`DELETE FROM tbl_rate_limit WHERE updated_at < clock_timestamp() - make_interval(secs => $1)`,
+		idle.Seconds(),
+	)
+	return err
+}
+
+// GetCompanyPlan returns the plan tier of a company, or "" when its plan is not active.
+func GetCompanyPlan(companyID int) (string, error) {
+	var plan string
+	var active int
+	err := database.DB.QueryRow(
+		context.Background(),
+		`SELECT plan, plan_active FROM tbl_company WHERE id = $1`,
+		companyID,
+	).Scan(&plan, &active)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil || active != 1 {
+		return "", err
+	}
+	return plan, nil
+}
@@ -0,0 +1,202 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+	"uneexpo/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+type Session struct {
+	ID             int        `json:"id"`
+	UserID         int        `json:"user_id"`
+	CompanyID      int        `json:"company_id"`
+	RefreshToken   string     `json:"-"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	DeviceName     string     `json:"device_name"`
+	DeviceModel    string     `json:"device_model"`
+	DeviceFirmware string     `json:"device_firmware"`
+	AppName        string     `json:"app_name"`
+	AppVersion     string     `json:"app_version"`
+	UserAgent      string     `json:"user_agent"`
+	IpAddress      string     `json:"ip_address"`
+	LoginMethod    string     `json:"login_method"`
+	LastUsedAt     time.Time  `json:"last_used_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	IsActive       bool       `json:"is_active"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+	RevokeReason   string     `json:"revoke_reason,omitempty"`
+}
+
+const sessionColumns = `id, user_id, company_id, refresh_token, expires_at, device_name, device_model,
+	device_firmware, app_name, app_version, user_agent, ip_address, login_method,
+	last_used_at, created_at, is_active, revoked_at, revoke_reason`
+
+func scanSession(row pgx.Row) (Session, error) {
+	var s Session
+	err := row.Scan(
+		&s.ID, &s.UserID, &s.CompanyID, &s.RefreshToken, &s.ExpiresAt, &s.DeviceName, &s.DeviceModel,
+		&s.DeviceFirmware, &s.AppName, &s.AppVersion, &s.UserAgent, &s.IpAddress, &s.LoginMethod,
+		&s.LastUsedAt, &s.CreatedAt, &s.IsActive, &s.RevokedAt, &s.RevokeReason,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return s, ErrSessionNotFound
+	}
+	return s, err
+}
+
+// CreateSession inserts a new session. RefreshToken is filled in by the first
+// RotateSessionToken call, once the token carrying the new session id exists.
+func CreateSession(s Session) (int, error) {
+	var id int
+	err := database.DB.QueryRow(
+		context.Background(),
+		`INSERT INTO tbl_sessions (user_id, company_id, refresh_token, expires_at, device_name, device_model,
+			device_firmware, app_name, app_version, user_agent, ip_address, login_method)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id`,
+		s.UserID, s.CompanyID, s.RefreshToken, s.ExpiresAt, s.DeviceName, s.DeviceModel,
+		s.DeviceFirmware, s.AppName, s.AppVersion, s.UserAgent, s.IpAddress, s.LoginMethod,
+	).Scan(&id)
+	return id, err
+}
+
+func GetSession(id int) (Session, error) {
+	row := database.DB.QueryRow(
+		context.Background(),
+		`SELECT `+sessionColumns+` FROM tbl_sessions WHERE id = $1`,
+		id,
+	)
+	return scanSession(row)
+}
+
+// RotateSessionToken swaps the stored refresh token hash from oldHash to newHash.
+// It reports false when the session is inactive, expired or holds a different hash.
+func RotateSessionToken(id int, oldHash, newHash string, expiresAt time.Time, ipAddress string) (bool, error) {
+	tag, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE tbl_sessions
+		SET refresh_token = $3, expires_at = $4, ip_address = $5,
+			last_used_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND refresh_token = $2 AND is_active = TRUE AND expires_at > CURRENT_TIMESTAMP`,
+		id, oldHash, newHash, expiresAt, ipAddress,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func RevokeSession(id int, reason string) error {
+	_, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE tbl_sessions
+		SET is_active = FALSE, revoked_at = CURRENT_TIMESTAMP, revoke_reason = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND is_active = TRUE`,
+		id, reason,
+	)
+	return err
+}
+
+// ListUserSessions returns the active, unexpired sessions of a user, most recently used first.
+func ListUserSessions(userID int) ([]Session, error) {
+	rows, err := database.DB.Query(
+		context.Background(),
+		`SELECT `+sessionColumns+` FROM tbl_sessions
+		WHERE user_id = $1 AND is_active = TRUE AND expires_at > CURRENT_TIMESTAMP
+		ORDER BY last_used_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeUserSession revokes a session only if it belongs to the user.
+func RevokeUserSession(userID, sessionID int, reason string) (bool, error) {
+	tag, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE tbl_sessions
+		SET is_active = FALSE, revoked_at = CURRENT_TIMESTAMP, revoke_reason = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND user_id = $2 AND is_active = TRUE`,
+		sessionID, userID, reason,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// RevokeOtherSessions revokes every active session of the user except keepID
+// and returns the ids of the revoked ones.
+func RevokeOtherSessions(userID, keepID int, reason string) ([]int, error) {
+	rows, err := database.DB.Query(
+		context.Background(),
+		`UPDATE tbl_sessions
+		SET is_active = FALSE, revoked_at = CURRENT_TIMESTAMP, revoke_reason = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND id <> $2 AND is_active = TRUE
+		RETURNING id`,
+		userID, keepID, reason,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// IsNewDevice reports whether the user has logged in before, but never from this device.
+func IsNewDevice(s Session) (bool, error) {
+	var known, total int
+	err := database.DB.QueryRow(
+		context.Background(),
+		`SELECT
+			COUNT(*) FILTER (WHERE device_name = $3 AND device_model = $4 AND device_firmware = $5),
+			COUNT(*)
+		FROM tbl_sessions WHERE user_id = $1 AND id <> $2`,
+		s.UserID, s.ID, s.DeviceName, s.DeviceModel, s.DeviceFirmware,
+	).Scan(&known, &total)
+	if err != nil {
+		return false, err
+	}
+	return total > 0 && known == 0, nil
+}
+
+// RevokeCompanySessions revokes every active session of the users of a company.
+func RevokeCompanySessions(companyID int, reason string) (int64, error) {
+	tag, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE tbl_sessions
+		SET is_active = FALSE, revoked_at = CURRENT_TIMESTAMP, revoke_reason = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE company_id = $1 AND is_active = TRUE`,
+		companyID, reason,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
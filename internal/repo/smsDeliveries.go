@@ -0,0 +1,31 @@
+package repo
+
+import (
+	"context"
+	"uneexpo/database"
+)
+
+const (
+	SMSStatusSent    = "sent"
+	SMSStatusFailed  = "failed"
+	SMSStatusSkipped = "skipped"
+)
+
+type SMSDelivery struct {
+	Provider   string
+	Phone      string
+	Attempt    int
+	Status     string
+	Error      string
+	DurationMs int
+}
+
+func CreateSMSDelivery(d SMSDelivery) error {
+	_, err := database.DB.Exec(
+		context.Background(),
+		`INSERT INTO tbl_sms_delivery (provider, phone, attempt, status, error, duration_ms)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		d.Provider, d.Phone, d.Attempt, d.Status, d.Error, d.DurationMs,
+	)
+	return err
+}
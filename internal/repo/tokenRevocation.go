@@ -0,0 +1,70 @@
+package repo
+
+import (
+	"context"
+	"time"
+	"uneexpo/database"
+)
+
+const (
+	RevocationKindToken   = "token"
+	RevocationKindUser    = "user"
+	RevocationKindCompany = "company"
+	RevocationKindSession = "session"
+)
+
+type TokenRevocation struct {
+	ID            int
+	Kind          string
+	Jti           string
+	SubjectID     int
+	RevokedBefore *time.Time
+	Reason        string
+	ExpiresAt     time.Time
+}
+
+func CreateTokenRevocation(r TokenRevocation) (int, error) {
+	var id int
+	err := database.DB.QueryRow(
+		context.Background(),
+		`INSERT INTO tbl_token_revocation (kind, jti, subject_id, revoked_before, reason, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`,
+		r.Kind, r.Jti, r.SubjectID, r.RevokedBefore, r.Reason, r.ExpiresAt,
+	).Scan(&id)
+	return id, err
+}
+
+// GetTokenRevocationsSince returns unexpired revocations created after since.
+func GetTokenRevocationsSince(since time.Time) ([]TokenRevocation, error) {
+	rows, err := database.DB.Query(
+		context.Background(),
+		`SELECT id, kind, jti, subject_id, revoked_before, reason, expires_at
+		FROM tbl_token_revocation
+		WHERE created_at > $1 AND expires_at > CURRENT_TIMESTAMP
+		ORDER BY id`,
+		since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revocations := []TokenRevocation{}
+	for rows.Next() {
+		var r TokenRevocation
+		if err := rows.Scan(&r.ID, &r.Kind, &r.Jti, &r.SubjectID, &r.RevokedBefore, &r.Reason, &r.ExpiresAt); err != nil {
+			return nil, err
+		}
+		revocations = append(revocations, r)
+	}
+	return revocations, rows.Err()
+}
+
+func DeleteExpiredTokenRevocations() error {
+	_, err := database.DB.Exec(
+		context.Background(),
+		`DELETE FROM tbl_token_revocation WHERE expires_at <= CURRENT_TIMESTAMP`,
+	)
+	return err
+}
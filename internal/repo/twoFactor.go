@@ -0,0 +1,165 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+	"uneexpo/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrTwoFactorNotFound = errors.New("two-factor authentication is not set up")
+
+type TwoFactor struct {
+	UserID       int
+	Secret       string // sealed, see auth.sealSecret
+	LastUsedStep int64
+	EnabledAt    *time.Time
+}
+
+// Enabled reports whether enrollment has been confirmed with a code.
+func (t TwoFactor) Enabled() bool {
+	return t.EnabledAt != nil
+}
+
+func GetTwoFactor(userID int) (TwoFactor, error) {
+	t := TwoFactor{UserID: userID}
+	err := database.DB.QueryRow(
+		context.Background(),
+		`SELECT secret, last_used_step, enabled_at FROM tbl_user_totp WHERE user_id = $1`,
+		userID,
+	).Scan(&t.Secret, &t.LastUsedStep, &t.EnabledAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return t, ErrTwoFactorNotFound
+	}
+	return t, err
+}
+
+// StartTwoFactorEnrollment stores a new pending secret. It returns false when
+// 2FA is already enabled, which has to be disabled first.
+func StartTwoFactorEnrollment(userID int, secret string) (bool, error) {
+	tag, err := database.DB.Exec(
+		context.Background(),
+		`INSERT INTO tbl_user_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_used_step = 0,
+			created_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE tbl_user_totp.enabled_at IS NULL`,
+		userID, secret,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// EnableTwoFactor confirms a pending enrollment with the step of a valid code
+// and stores the hashes of a fresh set of recovery codes.
+func EnableTwoFactor(userID int, step int64, codeHashes []string) (bool, error) {
+	ctx := context.Background()
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(
+		ctx,
+		`UPDATE tbl_user_totp SET enabled_at = CURRENT_TIMESTAMP, last_used_step = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND enabled_at IS NULL AND last_used_step < $2`,
+		userID, step,
+	)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() != 1 {
+		return false, nil
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// UseTwoFactorStep records a code as used. It returns false when a code of
+// the same or a later step was already accepted, i.e. on replay.
+func UseTwoFactorStep(userID int, step int64) (bool, error) {
+	tag, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE tbl_user_totp SET last_used_step = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND last_used_step < $2`,
+		userID, step,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func DisableTwoFactor(userID int) error {
+	ctx := context.Background()
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM tbl_user_totp WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM tbl_user_recovery_code WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	ctx := context.Background()
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userID int, codeHashes []string) error {
+	if _, err := tx.Exec(ctx, `DELETE FROM tbl_user_recovery_code WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(
+		ctx,
+		`INSERT INTO tbl_user_recovery_code (user_id, code_hash) SELECT $1, unnest($2::VARCHAR[])`,
+		userID, codeHashes,
+	)
+	return err
+}
+
+// UseRecoveryCode spends a recovery code, returning false if it does not exist or was used.
+func UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	tag, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE tbl_user_recovery_code SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, codeHash,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func CountRecoveryCodes(userID int) (int, error) {
+	var count int
+	err := database.DB.QueryRow(
+		context.Background(),
+		`SELECT COUNT(*) FROM tbl_user_recovery_code WHERE user_id = $1 AND used_at IS NULL`,
+		userID,
+	).Scan(&count)
+	return count, err
+}
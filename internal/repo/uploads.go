@@ -0,0 +1,235 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+	"uneexpo/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	UploadStatusUploading  = "uploading"
+	UploadStatusProcessing = "processing"
+	UploadStatusCompleted  = "completed"
+	UploadStatusFailed     = "failed"
+)
+
+var (
+	ErrUploadNotFound       = errors.New("upload not found")
+	ErrUploadOffsetMismatch = errors.New("upload offset does not match")
+)
+
+// Upload is a resumable upload, see tbl_upload.
+type Upload struct {
+	ID        int       `json:"-"`
+	UUID      string    `json:"uuid"`
+	UserID    int       `json:"user_id"`
+	CompanyID int       `json:"company_id"`
+	Category  string    `json:"category"`
+	Filename  string    `json:"filename"`
+	Metadata  string    `json:"-"`
+	Length    int64     `json:"upload_length"`
+	Offset    int64     `json:"upload_offset"`
+	Status    string    `json:"status"`
+	MediaID   *int      `json:"media_id"`
+	Error     string    `json:"error,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Expired   bool      `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	// ProcessingAttempts counts the times the complete upload was taken up to be saved.
+	ProcessingAttempts int `json:"-"`
+}
+
+type UploadPart struct {
+	Offset     int64
+	Size       int64
+	StorageKey string
+}
+
+const uploadColumns = `id, uuid::TEXT, user_id, company_id, category, filename, metadata, upload_length,
+	upload_offset, status, media_id, error, expires_at, expires_at < CURRENT_TIMESTAMP, created_at, processing_attempts`
+
+func scanUpload(row pgx.Row) (Upload, error) {
+	var u Upload
+	err := row.Scan(
+		&u.ID, &u.UUID, &u.UserID, &u.CompanyID, &u.Category, &u.Filename, &u.Metadata, &u.Length,
+		&u.Offset, &u.Status, &u.MediaID, &u.Error, &u.ExpiresAt, &u.Expired, &u.CreatedAt, &u.ProcessingAttempts,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return u, ErrUploadNotFound
+	}
+	return u, err
+}
+
+// CreateUpload starts an upload that expires after ttl without progress.
+func CreateUpload(u Upload, ttl time.Duration) (Upload, error) {
+	return scanUpload(database.DB.QueryRow(
+		context.Background(),
+		`INSERT INTO tbl_upload (user_id, company_id, category, filename, metadata, upload_length, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP + make_interval(secs => $7))
+		RETURNING `+uploadColumns,
+		u.UserID, u.CompanyID, u.Category, u.Filename, u.Metadata, u.Length, ttl.Seconds(),
+	))
+}
+
+// GetUpload looks an upload up by its UUID. Invalid UUIDs are not found.
+func GetUpload(uuid string) (Upload, error) {
+	return scanUpload(database.DB.QueryRow(
+		context.Background(),
+		`SELECT `+uploadColumns+` FROM tbl_upload WHERE uuid::TEXT = $1`,
+		uuid,
+	))
+}
+
+// AddUploadPart records a part received at offset and moves the offset past
+// it. Parts for an offset other than the current one are refused, so of two
+// chunks sent for the same offset only one counts. The upload turns to
+// processing with its last part, leased to the caller for lease, and expires
+// ttl after it.
+func AddUploadPart(id int, part UploadPart, ttl, lease time.Duration) (Upload, error) {
+	ctx := context.Background()
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return Upload{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	u, err := scanUpload(tx.QueryRow(
+		ctx,
+		`UPDATE tbl_upload SET upload_offset = upload_offset + $3,
+			status = CASE WHEN upload_offset + $3 = upload_length THEN 'processing' ELSE status END,
+			processing_until = CASE WHEN upload_offset + $3 = upload_length
+				THEN CURRENT_TIMESTAMP + make_interval(secs => $5) END,
+			processing_attempts = CASE WHEN upload_offset + $3 = upload_length THEN 1 ELSE 0 END,
+			expires_at = CURRENT_TIMESTAMP + make_interval(secs => $4), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND upload_offset = $2 AND status = 'uploading' AND upload_offset + $3 <= upload_length
+		RETURNING `+uploadColumns,
+		id, part.Offset, part.Size, ttl.Seconds(), lease.Seconds(),
+	))
+	if errors.Is(err, ErrUploadNotFound) {
+		return Upload{}, ErrUploadOffsetMismatch
+	}
+	if err != nil {
+		return Upload{}, err
+	}
+
+	if _, err := tx.Exec(
+		ctx,
+		`INSERT INTO tbl_upload_part (upload_id, part_offset, size, storage_key) VALUES ($1, $2, $3, $4)`,
+		id, part.Offset, part.Size, part.StorageKey,
+	); err != nil {
+		return Upload{}, err
+	}
+	return u, tx.Commit(ctx)
+}
+
+func GetUploadParts(id int) ([]UploadPart, error) {
+	rows, err := database.DB.Query(
+		context.Background(),
+		`SELECT part_offset, size, storage_key FROM tbl_upload_part WHERE upload_id = $1 ORDER BY part_offset`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parts := []UploadPart{}
+	for rows.Next() {
+		var p UploadPart
+		if err := rows.Scan(&p.Offset, &p.Size, &p.StorageKey); err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+	return parts, rows.Err()
+}
+
+// FinishUpload records the media an upload became, or why it failed. Its
+// parts are no longer needed.
+func FinishUpload(id int, mediaID *int, failure string) error {
+	ctx := context.Background()
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	status := UploadStatusCompleted
+	if mediaID == nil {
+		status = UploadStatusFailed
+	}
+	if _, err := tx.Exec(
+		ctx,
+		`UPDATE tbl_upload SET status = $2, media_id = $3, error = $4, processing_until = NULL,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		id, status, mediaID, failure,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM tbl_upload_part WHERE upload_id = $1`, id); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func DeleteUpload(id int) error {
+	_, err := database.DB.Exec(context.Background(), `DELETE FROM tbl_upload WHERE id = $1`, id)
+	return err
+}
+
+// GetExpiredUploads lists up to limit uploads past their expiry. Complete
+// uploads still being saved are left to ClaimStaleUploads.
+func GetExpiredUploads(limit int) ([]Upload, error) {
+	rows, err := database.DB.Query(
+		context.Background(),
+		`SELECT `+uploadColumns+` FROM tbl_upload
+		WHERE expires_at < CURRENT_TIMESTAMP AND status <> 'processing'
+		ORDER BY expires_at LIMIT $1`,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanUploadRows(rows)
+}
+
+// ClaimStaleUploads leases up to limit complete uploads whose lease passed
+// without them being saved: the instance saving them crashed or hung.
+func ClaimStaleUploads(limit int, lease time.Duration) ([]Upload, error) {
+	rows, err := database.DB.Query(
+		context.Background(),
+		`UPDATE tbl_upload SET processing_until = CURRENT_TIMESTAMP + make_interval(secs => $2),
+			processing_attempts = processing_attempts + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id IN (
+			SELECT id FROM tbl_upload
+			WHERE status = 'processing' AND processing_until < CURRENT_TIMESTAMP
+			ORDER BY processing_until
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+uploadColumns,
+		limit, lease.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanUploadRows(rows)
+}
+
+func scanUploadRows(rows pgx.Rows) ([]Upload, error) {
+	defer rows.Close()
+
+	uploads := []Upload{}
+	for rows.Next() {
+		u, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, rows.Err()
+}
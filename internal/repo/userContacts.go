@@ -0,0 +1,50 @@
+package repo
+
+import (
+	"context"
+	"time"
+	"uneexpo/database"
+)
+
+type UserContact struct {
+	UserID          int        `json:"user_id"`
+	CompanyID       int        `json:"company_id"`
+	Email           string     `json:"email"`
+	Phone           string     `json:"phone"`
+	Verified        int        `json:"verified"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	PhoneVerifiedAt *time.Time `json:"phone_verified_at"`
+	// OTPChannel is the channel the user prefers codes on, empty for automatic.
+	OTPChannel string `json:"otp_channel"`
+}
+
+func (c UserContact) EmailVerified() bool {
+	return c.Email != "" && c.EmailVerifiedAt != nil
+}
+
+func (c UserContact) PhoneVerified() bool {
+	return c.Phone != "" && c.PhoneVerifiedAt != nil
+}
+
+func GetUserContact(userID int) (UserContact, error) {
+	contact := UserContact{UserID: userID}
+	err := database.DB.QueryRow(
+		context.Background(),
+		`SELECT company_id, email, phone, verified, email_verified_at, phone_verified_at, otp_channel
+		FROM tbl_user WHERE id = $1 AND deleted = 0`,
+		userID,
+	).Scan(
+		&contact.CompanyID, &contact.Email, &contact.Phone, &contact.Verified,
+		&contact.EmailVerifiedAt, &contact.PhoneVerifiedAt, &contact.OTPChannel,
+	)
+	return contact, err
+}
+
+func SetUserOTPChannel(userID int, channel string) error {
+	_, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE tbl_user SET otp_channel = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $1`,
+		userID, channel,
+	)
+	return err
+}
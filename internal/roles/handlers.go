@@ -0,0 +1,122 @@
+package roles
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/middlewares"
+	"uneexpo/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+type permissionRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+}
+
+type rolePermissionsRequest struct {
+	Permissions []string `json:"permissions" binding:"required"`
+}
+
+func GetRoles(ctx *gin.Context) {
+	roles, err := repo.GetRolesWithPermissions()
+	if err != nil {
+		log.Printf("Failed to load roles: %v", err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to load roles", ""))
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Roles", roles))
+}
+
+func GetPermissions(ctx *gin.Context) {
+	permissions, err := repo.GetPermissions()
+	if err != nil {
+		log.Printf("Failed to load permissions: %v", err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to load permissions", ""))
+		return
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Permissions", permissions))
+}
+
+func CreatePermission(ctx *gin.Context) {
+	var body permissionRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	permission, err := repo.CreatePermission(strings.TrimSpace(body.Name), body.Description)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Failed to create permission", err.Error()))
+		return
+	}
+	ctx.JSON(http.StatusCreated, utils.FormatResponse("Permission created", permission))
+}
+
+// SetRolePermissions replaces the permission set of a role.
+func SetRolePermissions(ctx *gin.Context) {
+	roleID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid role id", err.Error()))
+		return
+	}
+
+	var body rolePermissionsRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	seen := map[string]bool{}
+	names := []string{}
+	for _, name := range body.Permissions {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	if err := repo.SetRolePermissions(roleID, names); err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Failed to update role permissions", err.Error()))
+		return
+	}
+	middlewares.InvalidatePermissions()
+
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Role permissions updated", gin.H{"id": roleID, "permissions": names}))
+}
+
+type roleTwoFactorRequest struct {
+	Required *bool `json:"required" binding:"required"`
+}
+
+// SetRoleTwoFactor makes 2FA mandatory, or optional again, for users of a role.
+// Users of the role without 2FA are asked to enroll on their next login.
+func SetRoleTwoFactor(ctx *gin.Context) {
+	roleID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid role id", err.Error()))
+		return
+	}
+
+	var body roleTwoFactorRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	updated, err := repo.SetRoleTwoFactorRequired(roleID, *body.Required)
+	if err != nil {
+		log.Printf("Failed to update 2FA requirement of role %d: %v", roleID, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to update role", ""))
+		return
+	}
+	if !updated {
+		ctx.JSON(http.StatusNotFound, utils.FormatErrorResponse("Role not found", ""))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Role updated", gin.H{"id": roleID, "require_2fa": *body.Required}))
+}
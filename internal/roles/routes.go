@@ -0,0 +1,16 @@
+package roles
+
+import (
+	"uneexpo/pkg/middlewares"
+
+	"github.com/gin-gonic/gin"
+)
+
+func InitRoutes(router *gin.RouterGroup) {
+	admin := router.Group("/admin", middlewares.Guard, middlewares.RequirePermission("role.manage"))
+	admin.GET("/roles", GetRoles)
+	admin.GET("/permissions", GetPermissions)
+	admin.POST("/permissions", CreatePermission)
+	admin.PUT("/roles/:id/permissions", SetRolePermissions)
+	admin.PUT("/roles/:id/two-factor", SetRoleTwoFactor)
+}
@@ -0,0 +1,305 @@
+package uploads
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"uneexpo/config"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/media"
+	"uneexpo/pkg/middlewares"
+	"uneexpo/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-with-upload,termination,expiration"
+	chunkType     = "application/offset+octet-stream"
+)
+
+type UploadView struct {
+	repo.Upload
+	Media *media.File `json:"media"`
+}
+
+// tusResumable rejects requests of other protocol versions and marks every
+// response with the version.
+func tusResumable(ctx *gin.Context) {
+	ctx.Header("Tus-Resumable", tusVersion)
+	if ctx.Request.Method != http.MethodOptions && ctx.GetHeader("Tus-Resumable") != tusVersion {
+		ctx.Header("Tus-Version", tusVersion)
+		ctx.AbortWithStatusJSON(http.StatusPreconditionFailed, utils.FormatErrorResponse("Unsupported tus version", ""))
+		return
+	}
+	ctx.Next()
+}
+
+// Options describes the server to tus clients.
+func Options(ctx *gin.Context) {
+	ctx.Header("Tus-Version", tusVersion)
+	ctx.Header("Tus-Extension", tusExtensions)
+	ctx.Header("Tus-Max-Size", strconv.FormatInt(config.ENV.FileUpload.MaxFileSize, 10))
+	ctx.Status(http.StatusNoContent)
+}
+
+// parseMetadata parses Upload-Metadata: comma-separated keys, each with an
+// optional base64 value.
+func parseMetadata(header string) (map[string]string, bool) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, false
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, true
+}
+
+func uploadURL(u repo.Upload) string {
+	return strings.Join([]string{config.ENV.API_SERVER_URL, config.ENV.API_PREFIX, "uploads", u.UUID}, "/")
+}
+
+func setProgressHeaders(ctx *gin.Context, u repo.Upload) {
+	ctx.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	if u.Status == repo.UploadStatusUploading {
+		ctx.Header("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	if u.MediaID != nil {
+		ctx.Header("Upload-Media-ID", strconv.Itoa(*u.MediaID))
+	}
+}
+
+// Create starts an upload. Upload-Metadata must name the file ("filename" or
+// "name") and its media category ("category"). The first chunk may come in
+// the same request.
+func Create(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+
+	if ctx.GetHeader("Upload-Defer-Length") != "" {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Upload-Length is required", "deferred lengths are not supported"))
+		return
+	}
+	length, err := strconv.ParseInt(ctx.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid Upload-Length", ""))
+		return
+	}
+	if length > config.ENV.FileUpload.MaxFileSize {
+		ctx.JSON(http.StatusRequestEntityTooLarge, utils.FormatErrorResponse("Upload too large", ""))
+		return
+	}
+
+	metadata, ok := parseMetadata(ctx.GetHeader("Upload-Metadata"))
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid Upload-Metadata", ""))
+		return
+	}
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	if filename == "" || metadata["category"] == "" {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid Upload-Metadata", "filename and category are required"))
+		return
+	}
+	if err := media.CheckSize(metadata["category"], filename, length); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, media.ErrInvalidFile) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		ctx.JSON(status, utils.FormatErrorResponse("Invalid upload", err.Error()))
+		return
+	}
+
+	u, err := repo.CreateUpload(repo.Upload{
+		UserID:    claims.ID,
+		CompanyID: claims.CompanyID,
+		Category:  metadata["category"],
+		Filename:  filename,
+		Metadata:  ctx.GetHeader("Upload-Metadata"),
+		Length:    length,
+	}, Expiry)
+	if err != nil {
+		log.Printf("Failed to create upload: %v", err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to create upload", ""))
+		return
+	}
+	ctx.Header("Location", uploadURL(u))
+
+	if ctx.ContentType() == chunkType && ctx.Request.ContentLength != 0 {
+		if u, ok = receiveChunk(ctx, u, 0); !ok {
+			return
+		}
+	}
+
+	setProgressHeaders(ctx, u)
+	ctx.Status(http.StatusCreated)
+}
+
+// loadOwnUpload loads the upload of the :id parameter if it belongs to the
+// caller. Uploads of others are reported as missing.
+func loadOwnUpload(ctx *gin.Context) (repo.Upload, bool) {
+	claims, _ := middlewares.GetClaims(ctx)
+
+	u, err := repo.GetUpload(ctx.Param("id"))
+	if err == nil && u.UserID != claims.ID {
+		err = repo.ErrUploadNotFound
+	}
+	if errors.Is(err, repo.ErrUploadNotFound) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, utils.FormatErrorResponse("Upload not found", ""))
+		return repo.Upload{}, false
+	}
+	if err != nil {
+		log.Printf("Failed to load upload %s: %v", ctx.Param("id"), err)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to load upload", ""))
+		return repo.Upload{}, false
+	}
+	if u.Expired && u.Status == repo.UploadStatusUploading {
+		ctx.AbortWithStatusJSON(http.StatusGone, utils.FormatErrorResponse("Upload expired", ""))
+		return repo.Upload{}, false
+	}
+	return u, true
+}
+
+// Head reports how much of an upload was received.
+func Head(ctx *gin.Context) {
+	u, ok := loadOwnUpload(ctx)
+	if !ok {
+		return
+	}
+	ctx.Header("Cache-Control", "no-store")
+	ctx.Header("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if u.Metadata != "" {
+		ctx.Header("Upload-Metadata", u.Metadata)
+	}
+	setProgressHeaders(ctx, u)
+	ctx.Status(http.StatusOK)
+}
+
+// Patch appends a chunk at Upload-Offset. The chunk completing the upload
+// is answered once the file is saved as media, with its id in Upload-Media-ID.
+// Videos and audio are still pending then, see GET /media-files/:id.
+func Patch(ctx *gin.Context) {
+	if ctx.ContentType() != chunkType {
+		ctx.JSON(http.StatusUnsupportedMediaType, utils.FormatErrorResponse("Content-Type must be "+chunkType, ""))
+		return
+	}
+	offset, err := strconv.ParseInt(ctx.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid Upload-Offset", ""))
+		return
+	}
+
+	u, ok := loadOwnUpload(ctx)
+	if !ok || !checkOffset(ctx, u, offset) {
+		return
+	}
+
+	if u, ok = receiveChunk(ctx, u, offset); !ok {
+		return
+	}
+	setProgressHeaders(ctx, u)
+	ctx.Status(http.StatusNoContent)
+}
+
+// checkOffset reports whether u takes a chunk at offset, and answers with
+// the offset it expects if not.
+func checkOffset(ctx *gin.Context, u repo.Upload, offset int64) bool {
+	if u.Status == repo.UploadStatusUploading && u.Offset == offset {
+		return true
+	}
+	setProgressHeaders(ctx, u)
+	ctx.JSON(http.StatusConflict, utils.FormatErrorResponse("Upload offset does not match", ""))
+	return false
+}
+
+// receiveChunk appends the request body to u, and saves the upload as media
+// if that completed it. It answers the request itself on failure.
+func receiveChunk(ctx *gin.Context, u repo.Upload, offset int64) (repo.Upload, bool) {
+	updated, err := appendChunk(u, offset, ctx.Request.Body)
+	if errors.Is(err, repo.ErrUploadOffsetMismatch) {
+		ctx.JSON(http.StatusConflict, utils.FormatErrorResponse("Upload offset does not match", ""))
+		return u, false
+	}
+	if errors.Is(err, ErrChunkTooLarge) {
+		ctx.JSON(http.StatusRequestEntityTooLarge, utils.FormatErrorResponse("Chunk exceeds Upload-Length", ""))
+		return u, false
+	}
+	if err != nil {
+		// What arrived before the client went away was kept
+		log.Printf("Failed to receive chunk of upload %s: %v", u.UUID, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to receive chunk", ""))
+		return u, false
+	}
+	if updated.Status != repo.UploadStatusProcessing {
+		return updated, true
+	}
+
+	file, err := finish(updated)
+	if media.IsClientError(err) {
+		ctx.JSON(http.StatusBadRequest, utils.FormatErrorResponse("Invalid upload", err.Error()))
+		return updated, false
+	}
+	if err != nil {
+		log.Printf("Failed to finish upload %s: %v", u.UUID, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to save upload", ""))
+		return updated, false
+	}
+	updated.Status = repo.UploadStatusCompleted
+	updated.MediaID = &file.ID
+	return updated, true
+}
+
+// Terminate deletes an upload. Media made of completed uploads are kept.
+func Terminate(ctx *gin.Context) {
+	u, ok := loadOwnUpload(ctx)
+	if !ok {
+		return
+	}
+	if u.Status == repo.UploadStatusProcessing {
+		ctx.JSON(http.StatusConflict, utils.FormatErrorResponse("Upload is being processed", ""))
+		return
+	}
+	if err := terminate(u); err != nil {
+		log.Printf("Failed to delete upload %s: %v", u.UUID, err)
+		ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to delete upload", ""))
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// GetUpload returns an upload with the media it became, for clients that
+// are not tus clients.
+func GetUpload(ctx *gin.Context) {
+	claims, _ := middlewares.GetClaims(ctx)
+	u, ok := loadOwnUpload(ctx)
+	if !ok {
+		return
+	}
+
+	view := UploadView{Upload: u}
+	if u.MediaID != nil {
+		m, err := repo.GetMedia(*u.MediaID)
+		if err != nil && !errors.Is(err, repo.ErrMediaNotFound) {
+			log.Printf("Failed to load media %d: %v", *u.MediaID, err)
+			ctx.JSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to load upload", ""))
+			return
+		}
+		if err == nil {
+			file := media.WithURLs(m, claims.ID)
+			view.Media = &file
+		}
+	}
+	ctx.JSON(http.StatusOK, utils.FormatResponse("Upload", view))
+}
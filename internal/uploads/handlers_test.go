@@ -0,0 +1,146 @@
+package uploads
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/fileUtils"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestParseMetadata(t *testing.T) {
+	metadata, ok := parseMetadata("filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==, category Y2hhdA==,is_confidential")
+	if !ok {
+		t.Fatal("valid metadata refused")
+	}
+	if metadata["filename"] != "world_domination_plan.pdf" || metadata["category"] != "chat" {
+		t.Errorf("parsed %v", metadata)
+	}
+	if value, ok := metadata["is_confidential"]; !ok || value != "" {
+		t.Errorf("key without a value parsed as %q, %v", value, ok)
+	}
+
+	if _, ok := parseMetadata("filename not-base64!"); ok {
+		t.Error("invalid base64 accepted")
+	}
+}
+
+func TestTusResumable(t *testing.T) {
+	tests := []struct {
+		method, version string
+		want            int
+	}{
+		{http.MethodPatch, tusVersion, http.StatusOK},
+		{http.MethodPatch, "0.2.2", http.StatusPreconditionFailed},
+		{http.MethodHead, "", http.StatusPreconditionFailed},
+		{http.MethodOptions, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		router := gin.New()
+		router.Use(tusResumable)
+		router.Handle(tt.method, "/uploads", func(ctx *gin.Context) { ctx.Status(http.StatusOK) })
+
+		req := httptest.NewRequest(tt.method, "/uploads", nil)
+		if tt.version != "" {
+			req.Header.Set("Tus-Resumable", tt.version)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s with version %q = %d, want %d", tt.method, tt.version, w.Code, tt.want)
+		}
+		if w.Header().Get("Tus-Resumable") != tusVersion {
+			t.Errorf("%s response has no Tus-Resumable", tt.method)
+		}
+	}
+}
+
+func TestPatchRejectsInvalidHeaders(t *testing.T) {
+	tests := []struct {
+		name, contentType, offset string
+		want                      int
+	}{
+		{"wrong content type", "application/octet-stream", "0", http.StatusUnsupportedMediaType},
+		{"missing offset", chunkType, "", http.StatusBadRequest},
+		{"negative offset", chunkType, "-1", http.StatusBadRequest},
+		{"offset not a number", chunkType, "ten", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPatch, "/uploads/id", strings.NewReader("data"))
+			ctx.Request.Header.Set("Content-Type", tt.contentType)
+			if tt.offset != "" {
+				ctx.Request.Header.Set("Upload-Offset", tt.offset)
+			}
+
+			Patch(ctx)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckOffset(t *testing.T) {
+	mediaID := 7
+	tests := []struct {
+		name   string
+		upload repo.Upload
+		offset int64
+		ok     bool
+	}{
+		{"at the offset", repo.Upload{Status: repo.UploadStatusUploading, Offset: 100, Length: 300}, 100, true},
+		{"behind the offset", repo.Upload{Status: repo.UploadStatusUploading, Offset: 100, Length: 300}, 0, false},
+		{"past the offset", repo.Upload{Status: repo.UploadStatusUploading, Offset: 100, Length: 300}, 200, false},
+		{"complete", repo.Upload{Status: repo.UploadStatusCompleted, Offset: 300, Length: 300, MediaID: &mediaID}, 300, false},
+		{"being saved", repo.Upload{Status: repo.UploadStatusProcessing, Offset: 300, Length: 300}, 300, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+
+			if ok := checkOffset(ctx, tt.upload, tt.offset); ok != tt.ok {
+				t.Fatalf("checkOffset = %v, want %v", ok, tt.ok)
+			}
+			if tt.ok {
+				return
+			}
+			if w.Code != http.StatusConflict {
+				t.Errorf("status = %d, want 409", w.Code)
+			}
+			// The client resumes from the offset in the answer
+			if got, want := w.Header().Get("Upload-Offset"), strconv.FormatInt(tt.upload.Offset, 10); got != want {
+				t.Errorf("Upload-Offset = %q, want %q", got, want)
+			}
+			if tt.upload.MediaID != nil && w.Header().Get("Upload-Media-ID") != "7" {
+				t.Errorf("Upload-Media-ID = %q", w.Header().Get("Upload-Media-ID"))
+			}
+		})
+	}
+}
+
+func TestAppendChunkRefusesBytesPastLength(t *testing.T) {
+	fileUtils.StagingDir = t.TempDir()
+	u := repo.Upload{UUID: "u", Length: 10, Offset: 6, Status: repo.UploadStatusUploading}
+
+	if _, err := appendChunk(u, 6, strings.NewReader("12345")); !errors.Is(err, ErrChunkTooLarge) {
+		t.Errorf("err = %v, want ErrChunkTooLarge", err)
+	}
+	// Nothing is recorded for an empty chunk
+	got, err := appendChunk(u, 6, strings.NewReader(""))
+	if err != nil || got.Offset != 6 {
+		t.Errorf("empty chunk = %+v, %v", got, err)
+	}
+}
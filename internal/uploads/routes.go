@@ -0,0 +1,20 @@
+package uploads
+
+import (
+	"uneexpo/pkg/middlewares"
+
+	"github.com/gin-gonic/gin"
+)
+
+func InitRoutes(router *gin.RouterGroup) {
+	uploads := router.Group("/uploads", tusResumable)
+	uploads.OPTIONS("", Options)
+	uploads.OPTIONS("/:id", Options)
+
+	uploads.Use(middlewares.GuardAPI, middlewares.APIRateLimit, middlewares.RequirePermission("media.upload"))
+	uploads.POST("", Create)
+	uploads.HEAD("/:id", Head)
+	uploads.PATCH("/:id", Patch)
+	uploads.DELETE("/:id", Terminate)
+	uploads.GET("/:id", GetUpload)
+}
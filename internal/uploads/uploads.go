@@ -0,0 +1,269 @@
+// Package uploads implements resumable uploads with the tus 1.0 protocol
+// (https://tus.io/protocols/resumable-upload), with the creation,
+// creation-with-upload, termination and expiration extensions. Chunks are
+// kept in storage.Default until the upload is complete, then the file is
+// saved through the media service like any other upload.
+package uploads
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/fileUtils"
+	"uneexpo/pkg/media"
+	"uneexpo/pkg/storage"
+)
+
+// Expiry is how long an upload is kept without progress.
+var Expiry = 24 * time.Hour
+
+// ProcessingLease is how long an instance may take to save a complete
+// upload before another one saves it instead.
+var ProcessingLease = 15 * time.Minute
+
+// maxProcessingAttempts bounds how often a complete upload is taken up again,
+// so one that crashes whoever saves it is given up on.
+const maxProcessingAttempts = 3
+
+var ErrChunkTooLarge = errors.New("chunk exceeds the upload length")
+
+func partsPrefix(u repo.Upload) string {
+	return "tus/" + u.UUID + "/"
+}
+
+// appendChunk stores the chunk read from r as the part of u at offset. What
+// arrived before the client disconnected is kept, so the upload can resume
+// from there.
+func appendChunk(u repo.Upload, offset int64, r io.Reader) (repo.Upload, error) {
+	if err := os.MkdirAll(fileUtils.StagingDir, os.ModePerm); err != nil {
+		return u, err
+	}
+	chunk, err := os.CreateTemp(fileUtils.StagingDir, "tus-chunk-*")
+	if err != nil {
+		return u, err
+	}
+	defer os.Remove(chunk.Name())
+	defer chunk.Close()
+
+	size, readErr := io.Copy(chunk, io.LimitReader(r, u.Length-offset))
+	if readErr == nil {
+		var extra [1]byte
+		if _, err := io.ReadFull(r, extra[:]); err == nil {
+			return u, ErrChunkTooLarge
+		}
+	}
+	if size == 0 {
+		return u, readErr
+	}
+
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return u, err
+	}
+	key := fmt.Sprintf("%s%020d-%s", partsPrefix(u), offset, hex.EncodeToString(random))
+
+	// The request context ends with the connection, and the chunk should
+	// be kept anyway
+	if _, err := chunk.Seek(0, io.SeekStart); err != nil {
+		return u, err
+	}
+	if err := storage.Default.Put(context.Background(), key, chunk, size, storage.PutOptions{ContentType: "application/octet-stream"}); err != nil {
+		return u, err
+	}
+
+	updated, err := repo.AddUploadPart(u.ID, repo.UploadPart{Offset: offset, Size: size, StorageKey: key}, Expiry, ProcessingLease)
+	if err != nil {
+		if err := storage.Default.Delete(context.Background(), key); err != nil {
+			log.Printf("Failed to delete refused part %s: %v", key, err)
+		}
+		return u, err
+	}
+	return updated, readErr
+}
+
+// finish assembles a complete upload and saves it as media.
+func finish(u repo.Upload) (media.File, error) {
+	ctx := context.Background()
+	defer deleteParts(u)
+
+	file, err := assemble(ctx, u)
+	if err == nil {
+		var m media.File
+		m, err = media.SaveSource(ctx, u.Category, fileUtils.Source{
+			Filename: u.Filename,
+			Size:     u.Length,
+			Open: func() (io.ReadCloser, error) {
+				return os.Open(file)
+			},
+		}, media.Owner{UserID: u.UserID, CompanyID: u.CompanyID})
+		os.Remove(file)
+		if err == nil {
+			return m, repo.FinishUpload(u.ID, &m.ID, "")
+		}
+	}
+
+	failure := "processing failed"
+	if media.IsClientError(err) {
+		failure = err.Error()
+	}
+	if finishErr := repo.FinishUpload(u.ID, nil, failure); finishErr != nil {
+		log.Printf("Failed to record failure of upload %s: %v", u.UUID, finishErr)
+	}
+	return media.File{}, err
+}
+
+// assemble concatenates the parts of an upload into a staged file.
+func assemble(ctx context.Context, u repo.Upload) (string, error) {
+	parts, err := repo.GetUploadParts(u.ID)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp(fileUtils.StagingDir, "tus-*")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var written int64
+	for _, part := range parts {
+		if part.Offset != written {
+			err = fmt.Errorf("part at %d missing", written)
+			break
+		}
+		var body io.ReadCloser
+		if body, _, err = storage.Default.Get(ctx, part.StorageKey); err != nil {
+			break
+		}
+		var n int64
+		n, err = io.Copy(file, body)
+		body.Close()
+		written += n
+		if err != nil {
+			break
+		}
+	}
+	if err == nil && written != u.Length {
+		err = fmt.Errorf("assembled %d of %d bytes", written, u.Length)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to assemble upload %s: %w", u.UUID, err)
+	}
+	return file.Name(), nil
+}
+
+// deleteParts removes all parts of an upload from storage, including those
+// of chunks that were refused.
+func deleteParts(u repo.Upload) {
+	ctx := context.Background()
+	var keys []string
+	err := storage.Default.List(ctx, partsPrefix(u), func(info storage.ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to list parts of upload %s: %v", u.UUID, err)
+	}
+	for _, key := range keys {
+		if err := storage.Default.Delete(ctx, key); err != nil {
+			log.Printf("Failed to delete part %s: %v", key, err)
+		}
+	}
+}
+
+// terminate deletes an upload and what was received of it.
+func terminate(u repo.Upload) error {
+	if err := repo.DeleteUpload(u.ID); err != nil {
+		return err
+	}
+	deleteParts(u)
+	return nil
+}
+
+// expireUploads deletes uploads that made no progress for Expiry, and the
+// records of finished ones.
+func expireUploads() error {
+	for {
+		expired, err := repo.GetExpiredUploads(100)
+		if err != nil {
+			return err
+		}
+		for _, u := range expired {
+			if err := terminate(u); err != nil {
+				return err
+			}
+		}
+		if len(expired) < 100 {
+			return nil
+		}
+	}
+}
+
+// recoverUploads saves complete uploads left processing by an instance that
+// died before saving them.
+func recoverUploads() error {
+	for {
+		stale, err := repo.ClaimStaleUploads(10, ProcessingLease)
+		if err != nil {
+			return err
+		}
+		for _, u := range stale {
+			if u.ProcessingAttempts > maxProcessingAttempts {
+				if err := repo.FinishUpload(u.ID, nil, "processing failed"); err != nil {
+					return err
+				}
+				deleteParts(u)
+				continue
+			}
+			if _, err := finish(u); err != nil {
+				log.Printf("Failed to finish upload %s: %v", u.UUID, err)
+			}
+		}
+		if len(stale) < 10 {
+			return nil
+		}
+	}
+}
+
+var (
+	stopOnce sync.Once
+	stopCh   = make(chan struct{})
+)
+
+// Start expires abandoned uploads every interval, and saves complete ones
+// whose lease passed, until Stop is called.
+func Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		recovery := time.NewTicker(time.Minute)
+		defer recovery.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := expireUploads(); err != nil {
+					log.Printf("Failed to expire uploads: %v", err)
+				}
+			case <-recovery.C:
+				if err := recoverUploads(); err != nil {
+					log.Printf("Failed to recover uploads: %v", err)
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func Stop() {
+	stopOnce.Do(func() { close(stopCh) })
+}
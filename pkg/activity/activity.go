@@ -0,0 +1,174 @@
+package activity
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+	"uneexpo/internal/repo"
+)
+
+var (
+	// FlushInterval is how often collected activity is written to tbl_company.last_active
+	// and tbl_api_key.last_used_at.
+	FlushInterval = 30 * time.Second
+	// OnlineWindow is how recent the last request of a company must be for it to count as online.
+	OnlineWindow = 2 * time.Minute
+)
+
+// Activity is coalesced per company in memory: however many requests a
+// company makes between two flushes, it costs a single row in one UPDATE.
+// Uses of API keys are coalesced per key the same way.
+var tracker = struct {
+	sync.Mutex
+	pending  map[int]time.Time // not flushed yet
+	lastSeen map[int]time.Time // presence as seen by this instance
+	apiKeys  map[int]repo.APIKeyUse
+}{
+	pending:  map[int]time.Time{},
+	lastSeen: map[int]time.Time{},
+	apiKeys:  map[int]repo.APIKeyUse{},
+}
+
+var (
+	stopCh    = make(chan struct{})
+	doneCh    = make(chan struct{})
+	startOnce sync.Once
+	stopOnce  sync.Once
+)
+
+// Touch records a request made by a company.
+func Touch(companyID int) {
+	if companyID == 0 {
+		return
+	}
+	now := time.Now()
+
+	tracker.Lock()
+	tracker.pending[companyID] = now
+	tracker.lastSeen[companyID] = now
+	tracker.Unlock()
+}
+
+// TouchAPIKey records a request made with an API key.
+func TouchAPIKey(id int, ip string) {
+	tracker.Lock()
+	tracker.apiKeys[id] = repo.APIKeyUse{At: time.Now(), IP: ip}
+	tracker.Unlock()
+}
+
+// LastSeen returns when this instance last served a request of the company.
+func LastSeen(companyID int) (time.Time, bool) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	seen, ok := tracker.lastSeen[companyID]
+	return seen, ok
+}
+
+// IsOnline reports whether the company made a request within OnlineWindow.
+func IsOnline(companyID int) bool {
+	seen, ok := LastSeen(companyID)
+	return ok && time.Since(seen) < OnlineWindow
+}
+
+// Flush writes the pending activity in one batch. On failure the activity is
+// put back so the next flush retries it.
+func Flush() error {
+	return errors.Join(flushCompanies(), flushAPIKeys())
+}
+
+func flushCompanies() error {
+	tracker.Lock()
+	pending := tracker.pending
+	tracker.pending = map[int]time.Time{}
+	tracker.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if err := repo.UpdateCompaniesLastActive(pending); err != nil {
+		tracker.Lock()
+		for companyID, seen := range pending {
+			if current, ok := tracker.pending[companyID]; !ok || current.Before(seen) {
+				tracker.pending[companyID] = seen
+			}
+		}
+		tracker.Unlock()
+		return err
+	}
+	return nil
+}
+
+func flushAPIKeys() error {
+	tracker.Lock()
+	uses := tracker.apiKeys
+	tracker.apiKeys = map[int]repo.APIKeyUse{}
+	tracker.Unlock()
+
+	if len(uses) == 0 {
+		return nil
+	}
+
+	if err := repo.UpdateAPIKeysLastUsed(uses); err != nil {
+		tracker.Lock()
+		for id, use := range uses {
+			if current, ok := tracker.apiKeys[id]; !ok || current.At.Before(use.At) {
+				tracker.apiKeys[id] = use
+			}
+		}
+		tracker.Unlock()
+		return err
+	}
+	return nil
+}
+
+// forgetIdle drops presence entries that can no longer count as online.
+func forgetIdle() {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	for companyID, seen := range tracker.lastSeen {
+		if time.Since(seen) > OnlineWindow {
+			delete(tracker.lastSeen, companyID)
+		}
+	}
+}
+
+// Start flushes collected activity every FlushInterval until Stop is called.
+func Start() {
+	startOnce.Do(func() { go loop() })
+}
+
+func loop() {
+	defer close(doneCh)
+
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := Flush(); err != nil {
+				log.Printf("Failed to flush last active: %v", err)
+			}
+			forgetIdle()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// Stop ends the flush loop and writes whatever activity is still pending.
+// It also works when Start was never called, and Start does nothing after it.
+func Stop() {
+	stopOnce.Do(func() {
+		startOnce.Do(func() { close(doneCh) })
+		close(stopCh)
+		<-doneCh
+		if err := Flush(); err != nil {
+			log.Printf("Failed to flush last active on shutdown: %v", err)
+		}
+	})
+}
@@ -1,18 +1,26 @@
 package fileUtils
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"math"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"uneexpo/config"
+	"uneexpo/pkg/mediaurl"
+	"uneexpo/pkg/storage"
 	"time"
 
 	"github.com/disintegration/imaging"
@@ -25,10 +33,18 @@ type FileValidationResult struct {
 	ValidationErrors []string
 }
 
+// StagingDir holds uploads while they are processed, because ffmpeg and
+// imaging need local files. ProcessMediaFiles moves them to storage.Default.
+var StagingDir = filepath.Join(os.TempDir(), "uneexpo-uploads")
+
 type ProcessedFile struct {
 	UniqueFileName string
-	StoragePath    string
-	MediaType      string
+	// KeyName replaces UniqueFileName in storage keys if set, e.g. with a
+	// checksum of the file.
+	KeyName string
+	// StoragePath is the staged file, see StagingDir.
+	StoragePath string
+	MediaType   string
 
 	FilePath   string
 	ThumbPath  string
@@ -36,9 +52,33 @@ type ProcessedFile struct {
 	OriginalFn string
 	MimeType   string
 	FileSize   int64
-	Duration   *int
-	Width      int
-	Height     int
+	// SHA256 is the hex checksum of the upload, set by SaveFile.
+	SHA256   string
+	Duration *int
+	Width    int
+	Height   int
+}
+
+// Key is where the file is kept in storage.Default.
+func (p ProcessedFile) Key() string {
+	name := p.UniqueFileName
+	if p.KeyName != "" {
+		name = p.KeyName
+	}
+	return path.Join(filepath.ToSlash(p.FilePath), name)
+}
+
+// ThumbKey is where the thumbnail of the file is kept in storage.Default,
+// "" if it has none.
+func (p ProcessedFile) ThumbKey() string {
+	if p.ThumbFn == "" {
+		return ""
+	}
+	name := p.ThumbFn
+	if p.KeyName != "" {
+		name = "thumb_" + strings.TrimSuffix(p.KeyName, path.Ext(p.KeyName)) + path.Ext(p.ThumbFn)
+	}
+	return path.Join(filepath.ToSlash(p.ThumbPath), name)
 }
 
 func IsImageFile(filePath string) bool {
@@ -50,6 +90,9 @@ func IsImageFile(filePath string) bool {
 	return imageExts[ext]
 }
 
+// GenerateMediaURL builds URLs of the old /media/{uuid}/{file} form.
+//
+// Deprecated: use media.URL, which addresses files by their storage key.
 func GenerateMediaURL(uuid, filename string) map[string]string {
 	return map[string]string{
 		"url":       strings.Join([]string{config.ENV.API_SERVER_URL, config.ENV.API_PREFIX, "media", uuid, filename}, "/"),
@@ -57,8 +100,45 @@ func GenerateMediaURL(uuid, filename string) map[string]string {
 	}
 }
 
+// GenerateSignedMediaURL is GenerateMediaURL for private files such as vehicle
+// documents: both URLs carry a short-lived signature issued to userID, which
+// GuardURLParam accepts in place of ?token=.
+//
+// Deprecated: use media.URL.
+func GenerateSignedMediaURL(uuid, filename string, userID int) map[string]string {
+	urls := GenerateMediaURL(uuid, filename)
+	for key, value := range urls {
+		urls[key] = mediaurl.SignURL(value, userID)
+	}
+	return urls
+}
+
+// Source is an upload to validate and stage: a multipart file, or a file
+// assembled from a resumable upload.
+type Source struct {
+	Filename string
+	Size     int64
+	Open     func() (io.ReadCloser, error)
+}
+
+func MultipartSource(fileHeader *multipart.FileHeader) Source {
+	return Source{
+		Filename: fileHeader.Filename,
+		Size:     fileHeader.Size,
+		Open: func() (io.ReadCloser, error) {
+			return fileHeader.Open()
+		},
+	}
+}
+
+// SaveFile stages an upload for ProcessMediaFiles.
 func SaveFile(fileHeader *multipart.FileHeader, processedFile *ProcessedFile) error {
-	file, err := fileHeader.Open()
+	return SaveSource(MultipartSource(fileHeader), processedFile)
+}
+
+// SaveSource stages an upload, see SaveFile.
+func SaveSource(source Source, processedFile *ProcessedFile) error {
+	file, err := source.Open()
 	if err != nil {
 		return fmt.Errorf("cannot open file: %v", err)
 	}
@@ -70,22 +150,31 @@ func SaveFile(fileHeader *multipart.FileHeader, processedFile *ProcessedFile) er
 	}
 	defer outFile.Close()
 
-	_, err = io.Copy(outFile, file)
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(outFile, hash), file)
 	if err != nil {
 		return fmt.Errorf("failed to save file: %v", err)
 	}
+	processedFile.SHA256 = hex.EncodeToString(hash.Sum(nil))
 
 	return nil
 }
 
 func ValidateSingleFile(fileHeader *multipart.FileHeader, categoryFN string) FileValidationResult {
-	result := FileValidationResult{File: fileHeader}
-	if fileHeader.Size > config.ENV.FileUpload.MaxFileSize {
+	result := ValidateSource(MultipartSource(fileHeader), categoryFN)
+	result.File = fileHeader
+	return result
+}
+
+// ValidateSource is ValidateSingleFile for any upload.
+func ValidateSource(source Source, categoryFN string) FileValidationResult {
+	var result FileValidationResult
+	if source.Size > config.ENV.FileUpload.MaxFileSize {
 		result.ValidationErrors = append(result.ValidationErrors, fmt.Sprintf("File too large. Max size: %d bytes", config.ENV.FileUpload.MaxFileSize))
 		return result
 	}
 
-	file, err := fileHeader.Open()
+	file, err := source.Open()
 	if err != nil {
 		result.ValidationErrors = append(result.ValidationErrors, "Cannot open file")
 		return result
@@ -93,28 +182,29 @@ func ValidateSingleFile(fileHeader *multipart.FileHeader, categoryFN string) Fil
 	defer file.Close()
 
 	buffer := make([]byte, 512)
-	_, err = file.Read(buffer)
-	if err != nil {
+	n, err := io.ReadFull(file, buffer)
+	if n == 0 || (err != nil && err != io.ErrUnexpectedEOF) {
 		result.ValidationErrors = append(result.ValidationErrors, "Cannot read file")
 		return result
 	}
-	mimeType := DetectMimeType(buffer)
+	// Padding would make short text files look binary
+	mimeType := DetectMimeType(buffer[:n])
 
 	if !config.ENV.FileUpload.AllowedMimeTypes[mimeType] {
 		result.ValidationErrors = append(result.ValidationErrors, fmt.Sprintf("Unsupported file type: %s", mimeType))
 		return result
 	}
 
-	ext := filepath.Ext(fileHeader.Filename)
+	ext := filepath.Ext(source.Filename)
 	mediaType := DetermineMediaType(mimeType)
-	uniqueFileName := GenerateUniqueFileName(fileHeader.Filename, ext)
-	storagePath, filePath, err := GenerateStoragePath(config.ENV.FileUpload.StorageBasePath, categoryFN, mediaType, uniqueFileName)
+	uniqueFileName := GenerateUniqueFileName(source.Filename, ext)
+	storagePath, filePath, err := GenerateStoragePath(StagingDir, categoryFN, mediaType, uniqueFileName)
 	if err != nil {
 		result.ValidationErrors = append(result.ValidationErrors, "Cannot generate storage path")
 	}
 
 	result.ProcessedFile = ProcessedFile{
-		OriginalFn:     fileHeader.Filename,
+		OriginalFn:     source.Filename,
 		UniqueFileName: uniqueFileName,
 		StoragePath:    storagePath,
 		MediaType:      mediaType,
@@ -123,7 +213,7 @@ func ValidateSingleFile(fileHeader *multipart.FileHeader, categoryFN string) Fil
 		ThumbPath: filepath.Join(filePath, "thumbnails"),
 		ThumbFn:   "thumb_" + uniqueFileName,
 		MimeType:  mimeType,
-		FileSize:  fileHeader.Size,
+		FileSize:  source.Size,
 	}
 
 	return result
@@ -138,26 +228,9 @@ func ProcessMediaFiles(fileResults []FileValidationResult) ([]ProcessedFile, err
 			continue
 		}
 
-		processedFile := result.ProcessedFile
-		var tempFile ProcessedFile
-		var err error
-
-		switch processedFile.MediaType {
-		case "image":
-			tempFile, err = ProcessImageFile(processedFile)
-		case "video":
-			tempFile, err = ProcessVideoFile(processedFile)
-		case "audio":
-			tempFile, err = ProcessAudioFile(processedFile)
-		case "document":
-			tempFile, err = ProcessDocumentFile(processedFile)
-		default:
-			errorMessages = append(errorMessages, fmt.Sprintf("Unsupported media type: %s", processedFile.MediaType))
-			continue
-		}
-
+		tempFile, err := ProcessFile(context.Background(), result.ProcessedFile)
 		if err != nil {
-			errorMessages = append(errorMessages, fmt.Sprintf("Error processing %s: %v", processedFile.OriginalFn, err))
+			errorMessages = append(errorMessages, fmt.Sprintf("Error processing %s: %v", result.ProcessedFile.OriginalFn, err))
 			continue
 		}
 
@@ -171,11 +244,123 @@ func ProcessMediaFiles(fileResults []FileValidationResult) ([]ProcessedFile, err
 	return processedFiles, nil
 }
 
+// ProcessFile processes a staged file by its media type, moves it to
+// storage.Default and removes the staged files. ThumbFn is emptied when no
+// thumbnail could be made.
+func ProcessFile(ctx context.Context, processedFile ProcessedFile) (ProcessedFile, error) {
+	return processStaged(ctx, processedFile, true)
+}
+
+// ProcessStoredFile is ProcessFile for a staged copy of a file that is
+// already in storage.Default under its Key: only the thumbnail is stored.
+// ffmpeg and ffprobe are stopped when ctx ends.
+func ProcessStoredFile(ctx context.Context, processedFile ProcessedFile) (ProcessedFile, error) {
+	return processStaged(ctx, processedFile, false)
+}
+
+func processStaged(ctx context.Context, processedFile ProcessedFile, storeOriginal bool) (ProcessedFile, error) {
+	defer removeStagedFiles(processedFile)
+
+	var tempFile ProcessedFile
+	var err error
+
+	switch processedFile.MediaType {
+	case "image":
+		tempFile, err = ProcessImageFile(processedFile)
+	case "video":
+		tempFile, err = ProcessVideoFileContext(ctx, processedFile)
+	case "audio":
+		tempFile, err = ProcessAudioFileContext(ctx, processedFile)
+	case "document":
+		tempFile, err = ProcessDocumentFile(processedFile)
+	default:
+		return processedFile, fmt.Errorf("unsupported media type: %s", processedFile.MediaType)
+	}
+	if err != nil {
+		return tempFile, err
+	}
+
+	// Images may have been compressed
+	if stat, err := os.Stat(tempFile.StoragePath); err == nil {
+		tempFile.FileSize = stat.Size()
+	}
+
+	if storeOriginal {
+		if err := putFile(ctx, tempFile.Key(), tempFile.StoragePath, tempFile.MimeType); err != nil {
+			return tempFile, err
+		}
+	}
+	hasThumb, err := storeThumbnail(ctx, tempFile)
+	if err != nil {
+		return tempFile, err
+	}
+	if !hasThumb {
+		tempFile.ThumbFn = ""
+	}
+	return tempFile, nil
+}
+
+// StoreProcessedFile puts a processed file and its thumbnail, if one was
+// made, into storage.Default.
+func StoreProcessedFile(ctx context.Context, processedFile ProcessedFile) (hasThumb bool, err error) {
+	if err := putFile(ctx, processedFile.Key(), processedFile.StoragePath, processedFile.MimeType); err != nil {
+		return false, err
+	}
+	return storeThumbnail(ctx, processedFile)
+}
+
+// StoreStagedFile moves a staged file to storage.Default unprocessed, to be
+// processed later with ProcessStoredFile.
+func StoreStagedFile(ctx context.Context, processedFile ProcessedFile) error {
+	defer os.Remove(processedFile.StoragePath)
+	return putFile(ctx, processedFile.Key(), processedFile.StoragePath, processedFile.MimeType)
+}
+
+func storeThumbnail(ctx context.Context, processedFile ProcessedFile) (bool, error) {
+	if processedFile.ThumbFn == "" {
+		return false, nil
+	}
+
+	thumbnail := filepath.Join(filepath.Dir(processedFile.StoragePath), "thumbnails", processedFile.ThumbFn)
+	err := putFile(ctx, processedFile.ThumbKey(), thumbnail, "")
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func putFile(ctx context.Context, key, name, contentType string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return storage.Default.Put(ctx, key, file, stat.Size(), storage.PutOptions{ContentType: contentType})
+}
+
+func removeStagedFiles(processedFile ProcessedFile) {
+	dir := filepath.Dir(processedFile.StoragePath)
+	base := strings.TrimSuffix(processedFile.UniqueFileName, filepath.Ext(processedFile.UniqueFileName))
+	os.Remove(processedFile.StoragePath)
+	os.Remove(filepath.Join(dir, "thumbnails", "thumb_"+processedFile.UniqueFileName))
+	os.Remove(filepath.Join(dir, "thumbnails", "thumb_"+base+".jpg"))
+}
+
 func CompressImageIfNeeded(imagePath string) error {
 	if config.ENV.COMPRESS_IMAGES != 1 {
 		return nil
 	}
+	return ResizeImage(imagePath, config.ENV.COMPRESS_SIZE, config.ENV.COMPRESS_QUALITY)
+}
 
+// ResizeImage shrinks an image in place to fit in maxSide by maxSide pixels.
+// Smaller images are left alone.
+func ResizeImage(imagePath string, maxSide, quality int) error {
 	img, err := imaging.Open(imagePath)
 	if err != nil {
 		return fmt.Errorf("failed to open image for compression: %w", err)
@@ -184,10 +369,9 @@ func CompressImageIfNeeded(imagePath string) error {
 	origWidth := img.Bounds().Dx()
 	origHeight := img.Bounds().Dy()
 
-	maxSize := config.ENV.COMPRESS_SIZE
-	if origWidth > maxSize || origHeight > maxSize {
-		img = imaging.Fit(img, maxSize, maxSize, imaging.Lanczos)
-		err = imaging.Save(img, imagePath, imaging.JPEGQuality(config.ENV.COMPRESS_QUALITY))
+	if origWidth > maxSide || origHeight > maxSide {
+		img = imaging.Fit(img, maxSide, maxSide, imaging.Lanczos)
+		err = imaging.Save(img, imagePath, imaging.JPEGQuality(quality))
 		if err != nil {
 			return fmt.Errorf("failed to save compressed image: %w", err)
 		}
@@ -226,7 +410,6 @@ func ProcessImageFile(processedFile ProcessedFile) (ProcessedFile, error) {
 		log.Printf("Failed to save thumbnail: %s, error: %v", thumbnailPath, err)
 		return processedFile, err
 	}
-	processedFile.ThumbPath = strings.TrimPrefix(thumbDir, config.ENV.UPLOAD_PATH)
 
 	return processedFile, nil
 }
@@ -286,6 +469,12 @@ func GenerateThumbPath(originalPath string) string {
 }
 
 func GenerateVideoThumbnail(videoPath string) (string, error) {
+	return GenerateVideoThumbnailContext(context.Background(), videoPath)
+}
+
+// GenerateVideoThumbnailContext is GenerateVideoThumbnail with ffmpeg killed
+// when ctx ends.
+func GenerateVideoThumbnailContext(ctx context.Context, videoPath string) (string, error) {
 	thumbnailPath := strings.TrimSuffix(GenerateThumbPath(videoPath), filepath.Ext(videoPath)) + ".jpg"
 	thumbDir := filepath.Dir(thumbnailPath)
 
@@ -293,7 +482,7 @@ func GenerateVideoThumbnail(videoPath string) (string, error) {
 		return "", fmt.Errorf("failed to create thumbnail directory: %v", err)
 	}
 
-	cmd := exec.Command("ffmpeg",
+	cmd := exec.CommandContext(ctx, "ffmpeg",
 		"-i", videoPath,
 		"-ss", "00:00:01",
 		"-vframes", "1",
@@ -309,19 +498,24 @@ func GenerateVideoThumbnail(videoPath string) (string, error) {
 }
 
 func ProcessVideoFile(processedFile ProcessedFile) (ProcessedFile, error) {
+	return ProcessVideoFileContext(context.Background(), processedFile)
+}
+
+// ProcessVideoFileContext is ProcessVideoFile with ffmpeg and ffprobe killed
+// when ctx ends, which fails the processing rather than leaving the video
+// without a thumbnail.
+func ProcessVideoFileContext(ctx context.Context, processedFile ProcessedFile) (ProcessedFile, error) {
 	if _, err := os.Stat(processedFile.StoragePath); os.IsNotExist(err) {
 		return processedFile, fmt.Errorf("video file does not exist: %s", processedFile.StoragePath)
 	}
 
-	thumbnailPath, err := GenerateVideoThumbnail(processedFile.StoragePath)
-	if err != nil {
+	if _, err := GenerateVideoThumbnailContext(ctx, processedFile.StoragePath); err != nil {
 		log.Printf("Failed to generate video thumbnail: %v", err)
 	} else {
 		processedFile.ThumbFn = "thumb_" + strings.TrimSuffix(processedFile.UniqueFileName, filepath.Ext(processedFile.UniqueFileName)) + ".jpg"
-		thumbnailPath = strings.TrimSuffix(strings.TrimPrefix(thumbnailPath, config.ENV.UPLOAD_PATH), processedFile.ThumbFn)
 	}
 
-	cmd := exec.Command("ffprobe",
+	cmd := exec.CommandContext(ctx, "ffprobe",
 		"-v", "error",
 		"-select_streams", "v:0",
 		"-show_entries", "stream=width,height,duration",
@@ -345,16 +539,21 @@ func ProcessVideoFile(processedFile ProcessedFile) (ProcessedFile, error) {
 		}
 	}
 
-	return processedFile, nil
+	return processedFile, ctx.Err()
 }
 
 func ProcessAudioFile(processedFile ProcessedFile) (ProcessedFile, error) {
+	return ProcessAudioFileContext(context.Background(), processedFile)
+}
+
+// ProcessAudioFileContext is ProcessAudioFile with ffmpeg and ffprobe killed
+// when ctx ends.
+func ProcessAudioFileContext(ctx context.Context, processedFile ProcessedFile) (ProcessedFile, error) {
 	if _, err := os.Stat(processedFile.StoragePath); os.IsNotExist(err) {
 		return processedFile, fmt.Errorf("audio file does not exist: %s", processedFile.StoragePath)
 	}
 
-	// Generate a thumbnail for audio files (optional, could use a default audio icon)
-	// For demonstration, we'll create a waveform image using ffmpeg
+	// The thumbnail of an audio file is its waveform drawn by ffmpeg
 	thumbnailPath := strings.TrimSuffix(GenerateThumbPath(processedFile.StoragePath), filepath.Ext(processedFile.StoragePath)) + ".jpg"
 	thumbDir := filepath.Dir(thumbnailPath)
 
@@ -362,7 +561,7 @@ func ProcessAudioFile(processedFile ProcessedFile) (ProcessedFile, error) {
 		return processedFile, fmt.Errorf("failed to create thumbnail directory: %v", err)
 	}
 
-	cmd := exec.Command("ffmpeg",
+	cmd := exec.CommandContext(ctx, "ffmpeg",
 		"-i", processedFile.StoragePath,
 		"-filter_complex", "showwavespic=s=640x120:colors=#3498db",
 		"-frames:v", "1",
@@ -375,7 +574,7 @@ func ProcessAudioFile(processedFile ProcessedFile) (ProcessedFile, error) {
 		processedFile.ThumbFn = "thumb_" + strings.TrimSuffix(processedFile.UniqueFileName, filepath.Ext(processedFile.UniqueFileName)) + ".jpg"
 	}
 
-	cmd = exec.Command("ffprobe",
+	cmd = exec.CommandContext(ctx, "ffprobe",
 		"-v", "error",
 		"-show_entries", "format=duration",
 		"-of", "csv=p=0",
@@ -394,7 +593,7 @@ func ProcessAudioFile(processedFile ProcessedFile) (ProcessedFile, error) {
 		}
 	}
 
-	return processedFile, nil
+	return processedFile, ctx.Err()
 }
 
 func ProcessDocumentFile(processedFile ProcessedFile) (ProcessedFile, error) {
@@ -0,0 +1,205 @@
+package hmacauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of a signed request.
+const (
+	HeaderClient    = "X-Client-ID"
+	HeaderTimestamp = "X-Timestamp"
+	HeaderNonce     = "X-Nonce"
+	HeaderSignature = "X-Signature"
+)
+
+var (
+	ErrMissingHeaders = errors.New("request is not signed")
+	ErrUnknownClient  = errors.New("unknown client")
+	ErrClockSkew      = errors.New("request timestamp is outside the allowed window")
+	ErrReplayed       = errors.New("nonce has already been used")
+	ErrBadSignature   = errors.New("signature mismatch")
+)
+
+var (
+	// MaxSkew is how far the timestamp of a request may be from the server clock.
+	MaxSkew = 5 * time.Minute
+	// MaxBodySize bounds how much of the body is read to verify its hash.
+	MaxBodySize int64 = 10 << 20
+)
+
+// Every internal caller has its own secret so it can be revoked on its own by
+// dropping it from SYSTEM_CLIENTS.
+var clients = struct {
+	sync.RWMutex
+	secrets map[string][]byte
+}{secrets: map[string][]byte{}}
+
+// SetClients replaces the known clients, keyed by client id.
+func SetClients(secrets map[string]string) {
+	loaded := make(map[string][]byte, len(secrets))
+	for id, secret := range secrets {
+		loaded[id] = []byte(secret)
+	}
+
+	clients.Lock()
+	clients.secrets = loaded
+	clients.Unlock()
+}
+
+// ParseClients reads a "name:secret,name:secret" list.
+func ParseClients(value string) (map[string]string, error) {
+	secrets := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, secret, found := strings.Cut(entry, ":")
+		if !found || id == "" || secret == "" {
+			return nil, fmt.Errorf("invalid client entry %q", id)
+		}
+		secrets[id] = secret
+	}
+	return secrets, nil
+}
+
+// Nonces are remembered for twice the skew window: a request outside the
+// window is already refused by its timestamp, so older nonces are not needed.
+var nonces = struct {
+	sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}{seen: map[string]time.Time{}}
+
+func useNonce(clientID, nonce string, now time.Time) bool {
+	key := clientID + ":" + nonce
+
+	nonces.Lock()
+	defer nonces.Unlock()
+
+	if now.Sub(nonces.lastPrune) > MaxSkew {
+		for k, expiresAt := range nonces.seen {
+			if now.After(expiresAt) {
+				delete(nonces.seen, k)
+			}
+		}
+		nonces.lastPrune = now
+	}
+
+	if expiresAt, ok := nonces.seen[key]; ok && now.Before(expiresAt) {
+		return false
+	}
+	nonces.seen[key] = now.Add(2 * MaxSkew)
+	return true
+}
+
+// canonical is the string that is signed:
+//
+//	METHOD\nPATH?QUERY\nTIMESTAMP\nNONCE\nhex(sha256(body))
+func canonical(method, uri, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{
+		strings.ToUpper(method), uri, timestamp, nonce, hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+}
+
+func signature(secret []byte, message string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, MaxBodySize+1))
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > MaxBodySize {
+		return nil, errors.New("request body is too large to verify")
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// Sign adds the signature headers to an outgoing request. The body is read
+// and put back so the request can still be sent.
+func Sign(req *http.Request, clientID, secret string) error {
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	message := canonical(req.Method, req.URL.RequestURI(), timestamp, nonce, body)
+	req.Header.Set(HeaderClient, clientID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, hex.EncodeToString(signature([]byte(secret), message)))
+	return nil
+}
+
+// Verify checks the signature of an incoming request and returns the id of
+// the client that signed it. The body stays readable for the handler.
+func Verify(req *http.Request) (string, error) {
+	clientID := req.Header.Get(HeaderClient)
+	timestamp := req.Header.Get(HeaderTimestamp)
+	nonce := req.Header.Get(HeaderNonce)
+	sig, err := hex.DecodeString(req.Header.Get(HeaderSignature))
+	if clientID == "" || timestamp == "" || nonce == "" || err != nil || len(sig) == 0 {
+		return "", ErrMissingHeaders
+	}
+
+	clients.RLock()
+	secret, ok := clients.secrets[clientID]
+	clients.RUnlock()
+	if !ok {
+		return "", ErrUnknownClient
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", ErrClockSkew
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(unix, 0)); skew > MaxSkew || skew < -MaxSkew {
+		return "", ErrClockSkew
+	}
+
+	body, err := readBody(req)
+	if err != nil {
+		return "", err
+	}
+
+	expected := signature(secret, canonical(req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+	if !hmac.Equal(sig, expected) {
+		return "", ErrBadSignature
+	}
+
+	// Checked last so a forged request cannot burn the nonce of a real one
+	if !useNonce(clientID, nonce, now) {
+		return "", ErrReplayed
+	}
+	return clientID, nil
+}
@@ -0,0 +1,232 @@
+package keyring
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrNoSigningKey = errors.New("keyring has no private key to sign with")
+	ErrUnknownKey   = errors.New("token signed with an unknown key")
+)
+
+// Key is one Ed25519 key of the ring. Private is nil for verification-only keys.
+type Key struct {
+	ID      string
+	Public  ed25519.PublicKey
+	Private ed25519.PrivateKey
+}
+
+// KeyRing holds every key tokens may be verified with and the single key new
+// tokens are signed with. Keys are read from a directory of PEM files where
+// the file name without extension is the key id ("kid"):
+//
+//   - a PKCS#8 private key can sign and verify,
+//   - a PKIX public key can only verify.
+//
+// The private key with the greatest id signs, so naming keys by date makes
+// the newest one take over. To rotate without downtime, first ship only the
+// public half of the new key to every instance, then its private half, and
+// delete the old key once the longest-lived token signed with it has expired.
+type KeyRing struct {
+	dir string
+
+	mu      sync.RWMutex
+	keys    map[string]*Key
+	signing *Key
+}
+
+// Load reads every key of dir into a new KeyRing.
+func Load(dir string) (*KeyRing, error) {
+	ring := &KeyRing{dir: dir}
+	if err := ring.Reload(); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// Reload re-reads the key directory, picking up added, promoted and removed keys.
+func (r *KeyRing) Reload() error {
+	paths, err := filepath.Glob(filepath.Join(r.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*Key, len(paths))
+	ids := make([]string, 0, len(paths))
+	for _, path := range paths {
+		key, err := readKey(path)
+		if err != nil {
+			return fmt.Errorf("failed to read key %s: %w", path, err)
+		}
+		keys[key.ID] = key
+		ids = append(ids, key.ID)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys found in %s", r.dir)
+	}
+
+	sort.Strings(ids)
+	var signing *Key
+	for i := len(ids) - 1; i >= 0; i-- {
+		if keys[ids[i]].Private != nil {
+			signing = keys[ids[i]]
+			break
+		}
+	}
+
+	r.mu.Lock()
+	r.keys = keys
+	r.signing = signing
+	r.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the ring every interval until the returned stop function is called.
+func (r *KeyRing) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.Reload(); err != nil {
+					log.Printf("Failed to reload signing keys: %v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// CanSign reports whether the ring holds a private key.
+func (r *KeyRing) CanSign() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.signing != nil
+}
+
+// Sign signs claims with EdDSA and stamps the token header with the key id.
+func (r *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	r.mu.RLock()
+	signing := r.signing
+	r.mu.RUnlock()
+	if signing == nil {
+		return "", ErrNoSigningKey
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = signing.ID
+	return token.SignedString(signing.Private)
+}
+
+// Keyfunc resolves the verification key of an EdDSA token from its kid header.
+func (r *KeyRing) Keyfunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodEd25519); !ok {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+	kid, _ := token.Header["kid"].(string)
+
+	r.mu.RLock()
+	key, ok := r.keys[kid]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key.Public, nil
+}
+
+func readKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	key := &Key{ID: strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		private, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("private key is not Ed25519")
+		}
+		key.Private = private
+		key.Public = private.Public().(ed25519.PublicKey)
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		public, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("public key is not Ed25519")
+		}
+		key.Public = public
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	return key, nil
+}
+
+// GenerateKey writes a new Ed25519 private key to dir/<kid>.pem and its public
+// half to publicDir/<kid>.pem when publicDir is not empty.
+func GenerateKey(dir, publicDir, kid string) error {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(dir, kid+".pem"), "PRIVATE KEY", privateDER, 0600); err != nil {
+		return err
+	}
+
+	if publicDir == "" {
+		return nil
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(publicDir, kid+".pem"), "PUBLIC KEY", publicDER, 0644)
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return pem.Encode(file, &pem.Block{Type: blockType, Bytes: der})
+}
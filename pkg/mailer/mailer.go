@@ -0,0 +1,414 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Names of the templates every Mailer knows.
+const (
+	TemplateOTP                  = "otp"
+	TemplateVerifyEmail          = "verify_email"
+	TemplateMagicLink            = "magic_link"
+	TemplatePasswordReset        = "password_reset"
+	TemplateInvoice              = "invoice"
+	TemplateVerificationApproved = "verification_approved"
+	TemplateWeeklyDigest         = "weekly_digest"
+	TemplateNewLogin             = "new_login"
+)
+
+var templateNames = []string{
+	TemplateOTP, TemplateVerifyEmail, TemplateMagicLink, TemplatePasswordReset, TemplateInvoice,
+	TemplateVerificationApproved, TemplateWeeklyDigest, TemplateNewLogin,
+}
+
+// Locales with a catalog in locales/. DefaultLocale is the fallback for
+// missing locales and keys.
+var (
+	Locales       = []string{"en", "ru", "tk"}
+	DefaultLocale = "en"
+)
+
+var ErrNotConfigured = errors.New("mailer is not configured")
+
+//go:embed templates/*.html templates/*.txt locales/*.json
+var embedded embed.FS
+
+// EmailData fills the templates. Each template reads the fields it needs.
+type EmailData struct {
+	Name             string
+	OTP              string
+	Link             string
+	ExpiresInMinutes int
+	// Device describes the device of a new login.
+	Device string
+	// LogoURL overrides the logo of the Mailer for this message.
+	LogoURL string
+	Invoice *Invoice
+	Digest  *Digest
+}
+
+type Invoice struct {
+	Number   string
+	Date     time.Time
+	Items    []InvoiceItem
+	Total    string
+	Currency string
+	Link     string
+}
+
+type InvoiceItem struct {
+	Description string
+	Quantity    int
+	Amount      string
+}
+
+type Digest struct {
+	PeriodStart time.Time
+	PeriodEnd   time.Time
+	Stats       []DigestStat
+	Highlights  []DigestHighlight
+}
+
+type DigestStat struct {
+	Label string
+	Value string
+}
+
+type DigestHighlight struct {
+	Title string
+	Link  string
+}
+
+// credentialTemplates send codes or links that log in or prove a contact.
+var credentialTemplates = map[string]bool{
+	TemplateOTP:           true,
+	TemplateVerifyEmail:   true,
+	TemplateMagicLink:     true,
+	TemplatePasswordReset: true,
+}
+
+// Email is a message to render from a template.
+type Email struct {
+	To       string
+	Template string
+	// Locale is one of Locales, or an Accept-Language value. Empty uses the default.
+	Locale string
+	Data   EmailData
+
+	CC          []string
+	BCC         []string
+	ReplyTo     string
+	Attachments []Attachment
+
+	// Immediate skips the queue of an Outbox, so the caller learns at once
+	// whether the server took the message, e.g. to send a code another way.
+	Immediate bool
+}
+
+// Message is a rendered email handed to a Transport.
+type Message struct {
+	To      []string
+	CC      []string `json:",omitempty"`
+	BCC     []string `json:",omitempty"`
+	ReplyTo string   `json:",omitempty"`
+	Subject string
+	HTML    string
+	Text    string
+
+	Attachments []Attachment `json:",omitempty"`
+
+	// ExpiresAt, when set, is when the message stops being of use, e.g. the
+	// code in it expires. An Outbox gives up on it then.
+	ExpiresAt time.Time `json:"-"`
+	// Sensitive messages carry credentials, an Outbox does not keep their
+	// bodies once they are sent or given up on.
+	Sensitive bool `json:"-"`
+}
+
+// Recipients returns every address the message is delivered to.
+func (m Message) Recipients() []string {
+	recipients := make([]string, 0, len(m.To)+len(m.CC)+len(m.BCC))
+	recipients = append(recipients, m.To...)
+	recipients = append(recipients, m.CC...)
+	return append(recipients, m.BCC...)
+}
+
+// Attachment is a file sent along with a message, e.g. a PDF invoice.
+type Attachment struct {
+	Filename string
+	// ContentType defaults to one guessed from the extension of Filename.
+	ContentType string `json:",omitempty"`
+	Data        []byte
+}
+
+// Transport delivers rendered messages, e.g. over SMTP.
+type Transport interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// ImmediateTransport is a Transport that queues messages but can also send
+// one right away, see Email.Immediate.
+type ImmediateTransport interface {
+	Transport
+	SendNow(ctx context.Context, msg Message) error
+}
+
+// ResponseTransport is a Transport that also reports the reply of the server
+// accepting the message, which the Outbox keeps in its delivery log.
+type ResponseTransport interface {
+	Transport
+	SendWithResponse(ctx context.Context, msg Message) (string, error)
+}
+
+type Options struct {
+	AppName string
+	LogoURL string
+	// TemplatesDir holds files overriding the embedded ones by name, e.g.
+	// layout.html to restyle every email. Empty uses the embedded files only.
+	TemplatesDir string
+}
+
+type Mailer struct {
+	transport Transport
+	options   Options
+	catalogs  map[string]map[string]string
+	html      map[string]*htmltemplate.Template
+	text      map[string]*texttemplate.Template
+}
+
+// Default is the Mailer used by the smtp helpers, set up in main.
+var Default *Mailer
+
+// New parses every template up front, so a broken override fails at startup.
+func New(transport Transport, options Options) (*Mailer, error) {
+	templates, err := fs.Sub(embedded, "templates")
+	if err != nil {
+		return nil, err
+	}
+	if options.TemplatesDir != "" {
+		templates = overlayFS{over: os.DirFS(options.TemplatesDir), base: templates}
+	}
+
+	m := &Mailer{
+		transport: transport,
+		options:   options,
+		catalogs:  map[string]map[string]string{},
+		html:      map[string]*htmltemplate.Template{},
+		text:      map[string]*texttemplate.Template{},
+	}
+
+	for _, locale := range Locales {
+		data, err := embedded.ReadFile("locales/" + locale + ".json")
+		if err != nil {
+			return nil, err
+		}
+		catalog := map[string]string{}
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return nil, fmt.Errorf("failed to parse locale %s: %w", locale, err)
+		}
+		m.catalogs[locale] = catalog
+	}
+
+	funcs := m.funcs(DefaultLocale)
+	for _, name := range templateNames {
+		html, err := htmltemplate.New(name).Funcs(funcs).ParseFS(templates, "layout.html", name+".html")
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template %s: %w", name, err)
+		}
+		text, err := texttemplate.New(name).Funcs(funcs).ParseFS(templates, "layout.txt", name+".txt")
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template %s: %w", name, err)
+		}
+		m.html[name] = html
+		m.text[name] = text
+	}
+	return m, nil
+}
+
+// translate looks key up in the locale, then in DefaultLocale.
+func (m *Mailer) translate(locale, key string, args ...any) string {
+	format, ok := m.catalogs[locale][key]
+	if !ok {
+		if format, ok = m.catalogs[DefaultLocale][key]; !ok {
+			return key
+		}
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+func (m *Mailer) funcs(locale string) map[string]any {
+	return map[string]any{
+		"t": func(key string, args ...any) string {
+			return m.translate(locale, key, args...)
+		},
+		"greeting": func(name string) string {
+			if name == "" {
+				return m.translate(locale, "common.greeting_anonymous")
+			}
+			return m.translate(locale, "common.greeting", name)
+		},
+		"date": func(t time.Time) string {
+			return t.Format("02.01.2006")
+		},
+	}
+}
+
+// view is what the templates execute against.
+type view struct {
+	Data    EmailData
+	Subject string
+	AppName string
+	LogoURL string
+	Locale  string
+	Year    int
+}
+
+// Render builds the subject, HTML and plain-text bodies of an email.
+func (m *Mailer) Render(email Email) (Message, error) {
+	html, ok := m.html[email.Template]
+	if !ok {
+		return Message{}, fmt.Errorf("unknown email template %q", email.Template)
+	}
+	text := m.text[email.Template]
+	locale := NormalizeLocale(email.Locale)
+
+	v := view{
+		Data:    email.Data,
+		AppName: m.options.AppName,
+		LogoURL: m.options.LogoURL,
+		Locale:  locale,
+		Year:    time.Now().Year(),
+	}
+	if email.Data.LogoURL != "" {
+		v.LogoURL = email.Data.LogoURL
+	}
+	v.Subject = m.translate(locale, email.Template+".subject", m.subjectArgs(email)...)
+
+	funcs := m.funcs(locale)
+	htmlBody, err := executeHTML(html, funcs, v)
+	if err != nil {
+		return Message{}, err
+	}
+	textBody, err := executeText(text, funcs, v)
+	if err != nil {
+		return Message{}, err
+	}
+
+	msg := Message{
+		To:          []string{email.To},
+		CC:          email.CC,
+		BCC:         email.BCC,
+		ReplyTo:     email.ReplyTo,
+		Subject:     v.Subject,
+		HTML:        htmlBody,
+		Text:        strings.TrimSpace(textBody) + "\n",
+		Attachments: email.Attachments,
+		Sensitive:   credentialTemplates[email.Template],
+	}
+	if email.Data.ExpiresInMinutes > 0 {
+		msg.ExpiresAt = time.Now().Add(time.Duration(email.Data.ExpiresInMinutes) * time.Minute)
+	}
+	return msg, nil
+}
+
+func (m *Mailer) subjectArgs(email Email) []any {
+	switch email.Template {
+	case TemplateOTP, TemplateMagicLink, TemplateWeeklyDigest:
+		return []any{m.options.AppName}
+	case TemplateInvoice:
+		number := ""
+		if email.Data.Invoice != nil {
+			number = email.Data.Invoice.Number
+		}
+		return []any{number, m.options.AppName}
+	}
+	return nil
+}
+
+// Templates are cloned per message so "t" speaks the locale of the message.
+func executeHTML(tmpl *htmltemplate.Template, funcs map[string]any, v view) (string, error) {
+	clone, err := tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := clone.Funcs(funcs).ExecuteTemplate(&buf, "layout", v); err != nil {
+		return "", fmt.Errorf("failed to execute template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+func executeText(tmpl *texttemplate.Template, funcs map[string]any, v view) (string, error) {
+	clone, err := tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := clone.Funcs(funcs).ExecuteTemplate(&buf, "layout", v); err != nil {
+		return "", fmt.Errorf("failed to execute template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// Send renders an email and hands it to the transport.
+func (m *Mailer) Send(ctx context.Context, email Email) error {
+	msg, err := m.Render(email)
+	if err != nil {
+		return err
+	}
+	if transport, ok := m.transport.(ImmediateTransport); ok && email.Immediate {
+		return transport.SendNow(ctx, msg)
+	}
+	return m.transport.Send(ctx, msg)
+}
+
+// Send sends an email with Default.
+func Send(ctx context.Context, email Email) error {
+	if Default == nil {
+		return ErrNotConfigured
+	}
+	return Default.Send(ctx, email)
+}
+
+// NormalizeLocale maps a locale or Accept-Language value such as
+// "ru-RU,ru;q=0.9" to one of Locales.
+func NormalizeLocale(value string) string {
+	for _, part := range strings.Split(value, ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		language, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		for _, locale := range Locales {
+			if language == locale {
+				return locale
+			}
+		}
+	}
+	return DefaultLocale
+}
+
+// overlayFS serves files of over in place of those of base.
+type overlayFS struct {
+	over fs.FS
+	base fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if file, err := o.over.Open(path.Clean(name)); err == nil {
+		return file, nil
+	}
+	return o.base.Open(name)
+}
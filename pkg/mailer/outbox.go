@@ -0,0 +1,167 @@
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+	"uneexpo/pkg/worker"
+)
+
+// QueuedEmail is a message held in the queue of an Outbox.
+type QueuedEmail struct {
+	ID          int
+	Message     []byte
+	Attempts    int
+	MaxAttempts int
+	ExpiresAt   *time.Time
+}
+
+// Store keeps the queue of an Outbox, e.g. in tbl_email_outbox.
+type Store interface {
+	// Create queues a message, given up on once expiresAt passes when it is
+	// set. The body of a sensitive one is dropped once it is sent or dead.
+	Create(recipients []string, subject string, message []byte, maxAttempts int, expiresAt *time.Time, sensitive bool) error
+	// Claim locks up to limit unexpired messages due for sending for lease.
+	Claim(limit int, lease time.Duration) ([]QueuedEmail, error)
+	// Finish records an attempt. A failed message is retried after retryIn unless it is dead.
+	Finish(email QueuedEmail, sent, dead bool, response string, duration, retryIn time.Duration) error
+	// Expire gives up on unsent messages whose deadline passed.
+	Expire() error
+	// Purge drops messages sent before retention.
+	Purge(retention time.Duration) error
+}
+
+// Outbox is a Transport that stores messages in a Store and sends them from
+// background workers, so a slow or failing SMTP server never holds up a
+// request and no email is lost to a transient error.
+type Outbox struct {
+	*worker.Pool
+
+	transport Transport
+	store     Store
+
+	BatchSize   int
+	MaxAttempts int
+	// Lease is how long a worker may take to send before others retry the email.
+	Lease time.Duration
+	// Retention is how long sent emails are kept for admins to look at.
+	Retention time.Duration
+}
+
+// NewOutbox queues messages in store for delivery through transport.
+func NewOutbox(transport Transport, store Store) *Outbox {
+	return &Outbox{
+		Pool: &worker.Pool{
+			Workers:      2,
+			PollInterval: 5 * time.Second,
+			Backoff:      30 * time.Second,
+			MaxBackoff:   6 * time.Hour,
+		},
+		transport:   transport,
+		store:       store,
+		BatchSize:   10,
+		MaxAttempts: 8,
+		Lease:       5 * time.Minute,
+		Retention:   30 * 24 * time.Hour,
+	}
+}
+
+// Send implements Transport by queueing the message.
+func (o *Outbox) Send(ctx context.Context, msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	var expiresAt *time.Time
+	if !msg.ExpiresAt.IsZero() {
+		expiresAt = &msg.ExpiresAt
+	}
+	if err := o.store.Create(msg.Recipients(), msg.Subject, data, o.MaxAttempts, expiresAt, msg.Sensitive); err != nil {
+		return err
+	}
+	o.Wake()
+	return nil
+}
+
+// SendNow implements ImmediateTransport by sending the message through the
+// transport of the outbox without queueing it. Failures are returned, not retried.
+func (o *Outbox) SendNow(ctx context.Context, msg Message) error {
+	return o.transport.Send(ctx, msg)
+}
+
+// Start runs the workers until Stop is called.
+func (o *Outbox) Start() {
+	o.Pool.Start(o.processBatch)
+	// Expired codes are dropped within a minute, so their bodies are not kept
+	o.Every(time.Minute, func() {
+		if err := o.store.Expire(); err != nil {
+			log.Printf("Failed to expire queued emails: %v", err)
+		}
+		if err := o.store.Purge(o.Retention); err != nil {
+			log.Printf("Failed to purge sent emails: %v", err)
+		}
+	})
+}
+
+// Stop waits for the emails being sent to finish. Queued ones stay queued
+// for the next start.
+func (o *Outbox) Stop() {
+	o.Pool.Stop(nil)
+}
+
+// processBatch sends one batch and reports whether it was full. The whole
+// batch shares one lease: emails whose turn comes after it ended are left
+// for whichever worker claimed them again, so none is sent twice.
+func (o *Outbox) processBatch() bool {
+	leaseEnd := time.Now().Add(o.Lease)
+	emails, err := o.store.Claim(o.BatchSize, o.Lease)
+	if err != nil {
+		log.Printf("Failed to claim queued emails: %v", err)
+		return false
+	}
+	for i, email := range emails {
+		if !time.Now().Before(leaseEnd) {
+			log.Printf("Lease of queued emails ended, leaving %d for a retry", len(emails)-i)
+			return false
+		}
+		o.deliver(email, leaseEnd)
+	}
+	return len(emails) == o.BatchSize
+}
+
+// deliver sends an email and records the attempt. The send is cut off at
+// leaseEnd, when other workers may claim the email again.
+func (o *Outbox) deliver(email QueuedEmail, leaseEnd time.Time) {
+	var msg Message
+	sendErr := json.Unmarshal(email.Message, &msg)
+
+	startedAt := time.Now()
+	response := ""
+	if sendErr == nil {
+		deadline := leaseEnd
+		if email.ExpiresAt != nil && email.ExpiresAt.Before(deadline) {
+			deadline = *email.ExpiresAt
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		if transport, ok := o.transport.(ResponseTransport); ok {
+			response, sendErr = transport.SendWithResponse(ctx, msg)
+		} else {
+			sendErr = o.transport.Send(ctx, msg)
+		}
+		cancel()
+	}
+	if sendErr != nil {
+		response = sendErr.Error()
+		log.Printf("Failed to send email %d (attempt %d/%d): %v", email.ID, email.Attempts, email.MaxAttempts, sendErr)
+	}
+
+	retryIn := o.RetryIn(email.Attempts)
+	// Not retried when out of attempts, or when the retry would come too late
+	dead := sendErr != nil && (email.Attempts >= email.MaxAttempts ||
+		email.ExpiresAt != nil && !time.Now().Add(retryIn).Before(*email.ExpiresAt))
+	err := o.store.Finish(email, sendErr == nil, dead, response, time.Since(startedAt), retryIn)
+	if err != nil {
+		log.Printf("Failed to record delivery of email %d: %v", email.ID, err)
+	}
+}
@@ -0,0 +1,64 @@
+package media
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Upload helpers kept for handlers written before categories and aliases.
+
+// formOwner reads the owner of uploads from the keys set by Guard.
+func formOwner(ctx *gin.Context) Owner {
+	return Owner{UserID: ctx.GetInt("id"), CompanyID: ctx.GetInt("companyID")}
+}
+
+// SaveFiles stores the "files" of a multipart form as CMS content and
+// returns their URLs.
+//
+// Deprecated: use SaveForm with the category of the files.
+func SaveFiles(ctx *gin.Context) ([]string, error) {
+	files, err := SaveForm(ctx, CategoryContent, "files", formOwner(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	filePaths := make([]string, 0, len(files))
+	for _, file := range files {
+		filePaths = append(filePaths, file.URL)
+	}
+	return filePaths, nil
+}
+
+// WriteImage stores the "image" of a multipart form and returns its storage
+// key, which is kept in place of the file name it used to return and served
+// under /files/{key}. dir is the media category; images of other directories
+// are stored as CMS content. Images are no longer converted to WebP.
+//
+// Deprecated: use Save.
+func WriteImage(ctx *gin.Context, dir string) (string, error) {
+	_, header, err := ctx.Request.FormFile("image")
+	if err != nil {
+		return "", errors.New("no image file provided")
+	}
+
+	category := dir
+	if _, err := RuleFor(category); err != nil {
+		category = CategoryContent
+	}
+
+	// Checked before anything is stored
+	staged, err := Validate(category, header)
+	if err != nil {
+		return "", err
+	}
+	if staged.MediaType != "image" {
+		return "", errors.New("uploaded file is not a valid image")
+	}
+
+	file, err := Save(ctx.Request.Context(), category, header, formOwner(ctx))
+	if err != nil {
+		return "", err
+	}
+	return file.StorageKey, nil
+}
@@ -0,0 +1,360 @@
+// Package media is the one way uploads enter the API. Every file is checked
+// against the rule of its category, sniffed rather than trusted by its
+// extension, named {category}/{media type}/{date}/{name}_{id}.{ext}, recorded
+// in tbl_media and addressed by a single URL format,
+// {API_SERVER_URL}/{API_PREFIX}/files/{key}. Equal uploads of a category share
+// one file in storage.Default, see tbl_media_blob. Videos and audio are
+// processed in the background, see Processor.
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"os"
+	"path"
+	"strings"
+	"uneexpo/config"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/fileUtils"
+	"uneexpo/pkg/mediaurl"
+	"uneexpo/pkg/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrUnknownCategory = errors.New("unknown media category")
+	ErrNoFiles         = errors.New("no files uploaded")
+	ErrTooManyFiles    = errors.New("too many files")
+	ErrInvalidFile     = errors.New("invalid file")
+)
+
+// IsClientError separates rejected uploads from processing and storage failures.
+func IsClientError(err error) bool {
+	return errors.Is(err, ErrUnknownCategory) ||
+		errors.Is(err, ErrNoFiles) ||
+		errors.Is(err, ErrTooManyFiles) ||
+		errors.Is(err, ErrInvalidFile)
+}
+
+// defaultImageQuality is used when COMPRESS_QUALITY is not set.
+const defaultImageQuality = 85
+
+// File is a stored upload with its URLs.
+type File struct {
+	repo.Media
+	URL      string `json:"url"`
+	ThumbURL string `json:"thumb_url,omitempty"`
+}
+
+// Owner is who an upload is stored for. Files belong to the company of the
+// user who uploaded them, or to the user alone if they have no company.
+type Owner struct {
+	UserID    int
+	CompanyID int
+}
+
+// Owns reports whether m belongs to the owner.
+func (o Owner) Owns(m repo.Media) bool {
+	if o.CompanyID != 0 && m.CompanyID == o.CompanyID {
+		return true
+	}
+	return m.UserID != nil && *m.UserID == o.UserID
+}
+
+// URL is the address of a stored file. Files of private categories get a
+// short-lived URL signed for userID, see mediaurl.
+func URL(key string, userID int) string {
+	if key == "" {
+		return ""
+	}
+	link := strings.Join([]string{config.ENV.API_SERVER_URL, config.ENV.API_PREFIX, "files", strings.TrimPrefix(key, "/")}, "/")
+	if IsPublic(key) {
+		return link
+	}
+	return mediaurl.SignURL(link, userID)
+}
+
+// WithURLs returns m with URLs for userID.
+func WithURLs(m repo.Media, userID int) File {
+	return File{
+		Media:    m,
+		URL:      URL(m.StorageKey, userID),
+		ThumbURL: URL(m.ThumbKey, userID),
+	}
+}
+
+// Validate checks an upload against the rule of its category and prepares
+// it for staging.
+func Validate(category string, header *multipart.FileHeader) (fileUtils.ProcessedFile, error) {
+	rule, err := RuleFor(category)
+	if err != nil {
+		return fileUtils.ProcessedFile{}, err
+	}
+	return validate(category, rule, fileUtils.MultipartSource(header))
+}
+
+// CheckSize checks the announced size of an upload before it is received.
+func CheckSize(category, filename string, size int64) error {
+	rule, err := RuleFor(category)
+	if err != nil {
+		return err
+	}
+	return checkSize(rule, filename, size)
+}
+
+func checkSize(rule Rule, filename string, size int64) error {
+	if size > rule.maxSize() {
+		return fmt.Errorf("%w: %s is too large, max size: %d bytes", ErrInvalidFile, filename, rule.maxSize())
+	}
+	return nil
+}
+
+func validate(category string, rule Rule, source fileUtils.Source) (fileUtils.ProcessedFile, error) {
+	if err := checkSize(rule, source.Filename, source.Size); err != nil {
+		return fileUtils.ProcessedFile{}, err
+	}
+
+	result := fileUtils.ValidateSource(source, category)
+	if len(result.ValidationErrors) > 0 {
+		return fileUtils.ProcessedFile{}, fmt.Errorf("%w: %s: %s", ErrInvalidFile, source.Filename, strings.Join(result.ValidationErrors, "; "))
+	}
+
+	file := result.ProcessedFile
+	if !rule.allows(file.MediaType, file.MimeType) {
+		return fileUtils.ProcessedFile{}, fmt.Errorf("%w: %s: %s files are not allowed in %s", ErrInvalidFile, source.Filename, file.MimeType, category)
+	}
+	return file, nil
+}
+
+// Save validates, processes and stores one upload and records it in tbl_media.
+func Save(ctx context.Context, category string, header *multipart.FileHeader, owner Owner) (File, error) {
+	return SaveSource(ctx, category, fileUtils.MultipartSource(header), owner)
+}
+
+// SaveSource is Save for uploads that did not come in a multipart form.
+func SaveSource(ctx context.Context, category string, source fileUtils.Source, owner Owner) (File, error) {
+	rule, err := RuleFor(category)
+	if err != nil {
+		return File{}, err
+	}
+	staged, err := validate(category, rule, source)
+	if err != nil {
+		return File{}, err
+	}
+	return store(ctx, category, rule, source, staged, owner)
+}
+
+// SaveForm saves all files of a multipart form field. Either all of them are
+// stored or none: files are validated before any is stored, and the stored
+// ones are deleted if a later one fails.
+func SaveForm(ctx *gin.Context, category, field string, owner Owner) ([]File, error) {
+	rule, err := RuleFor(category)
+	if err != nil {
+		return nil, err
+	}
+
+	form, err := ctx.MultipartForm()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoFiles, err)
+	}
+	headers := form.File[field]
+	if len(headers) == 0 {
+		return nil, ErrNoFiles
+	}
+	if len(headers) > rule.maxFiles() {
+		return nil, fmt.Errorf("%w: maximum %d allowed", ErrTooManyFiles, rule.maxFiles())
+	}
+
+	staged := make([]fileUtils.ProcessedFile, len(headers))
+	for i, header := range headers {
+		if staged[i], err = validate(category, rule, fileUtils.MultipartSource(header)); err != nil {
+			return nil, err
+		}
+	}
+
+	files := make([]File, 0, len(headers))
+	for i, header := range headers {
+		file, err := store(ctx.Request.Context(), category, rule, fileUtils.MultipartSource(header), staged[i], owner)
+		if err != nil {
+			for _, stored := range files {
+				if _, err := Delete(context.Background(), stored.ID); err != nil {
+					log.Printf("Failed to delete media %d after a failed upload: %v", stored.ID, err)
+				}
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// store stages an upload, hashing it on the way, and records it as an alias
+// of the blob with its content. Only content not stored in the category
+// before is processed and put into storage; videos and audio are processed
+// later by a Processor and returned pending.
+func store(ctx context.Context, category string, rule Rule, source fileUtils.Source, staged fileUtils.ProcessedFile, owner Owner) (File, error) {
+	if err := fileUtils.SaveSource(source, &staged); err != nil {
+		os.Remove(staged.StoragePath)
+		return File{}, err
+	}
+
+	var userID *int
+	if owner.UserID != 0 {
+		userID = &owner.UserID
+	}
+	alias := repo.Media{
+		UserID:       userID,
+		CompanyID:    owner.CompanyID,
+		Category:     category,
+		OriginalName: staged.OriginalFn,
+		StorageKey:   staged.Key(),
+		Status:       repo.MediaStatusReady,
+	}
+
+	blob, err := repo.GetMediaBlob(category, staged.SHA256)
+	if err == nil {
+		alias.ThumbKey = aliasThumbKey(alias.StorageKey, blob.ThumbKey)
+		m, _, err := repo.CreateMediaAlias(alias, blob)
+		// A blob released meanwhile is stored again below
+		if !errors.Is(err, repo.ErrMediaBlobNotFound) {
+			os.Remove(staged.StoragePath)
+			if err != nil {
+				return File{}, err
+			}
+			return WithURLs(m, owner.UserID), nil
+		}
+	} else if !errors.Is(err, repo.ErrMediaBlobNotFound) {
+		os.Remove(staged.StoragePath)
+		return File{}, err
+	}
+
+	if staged.MediaType == "image" && rule.ImageMaxSide > 0 {
+		quality := config.ENV.COMPRESS_QUALITY
+		if quality <= 0 {
+			quality = defaultImageQuality
+		}
+		if err := fileUtils.ResizeImage(staged.StoragePath, rule.ImageMaxSide, quality); err != nil {
+			log.Printf("Warning: Failed to resize image: %s, error: %v", staged.StoragePath, err)
+		}
+	}
+
+	// Blob keys are unique, so files of a blob released meanwhile are never
+	// the files of this one, whatever order their deletion and this upload run in
+	blobFile := staged
+	blobFile.KeyName = staged.SHA256 + "_" + uuid.New().String()[:12] + strings.ToLower(path.Ext(staged.UniqueFileName))
+	blobFile.FilePath = path.Join(category, "blobs", staged.SHA256[:2])
+	blobFile.ThumbPath = path.Join(blobFile.FilePath, "thumbnails")
+
+	if asyncMediaTypes[blobFile.MediaType] {
+		return enqueue(ctx, alias, blobFile, owner.UserID)
+	}
+
+	processed, err := fileUtils.ProcessFile(ctx, blobFile)
+	if err != nil {
+		return File{}, fmt.Errorf("failed to process %s: %w", source.Filename, err)
+	}
+
+	alias.ThumbKey = aliasThumbKey(alias.StorageKey, processed.ThumbKey())
+	m, blob, err := repo.CreateMediaAlias(alias, repo.MediaBlob{
+		Category:   category,
+		SHA256:     processed.SHA256,
+		StorageKey: processed.Key(),
+		ThumbKey:   processed.ThumbKey(),
+		MediaType:  processed.MediaType,
+		MimeType:   processed.MimeType,
+		Size:       processed.FileSize,
+		Width:      processed.Width,
+		Height:     processed.Height,
+		Duration:   processed.Duration,
+	})
+	if err != nil {
+		deleteObjects(context.Background(), processed.Key(), processed.ThumbKey())
+		return File{}, err
+	}
+	if blob.StorageKey != processed.Key() {
+		// An equal upload was stored meanwhile, its files are used
+		deleteObjects(context.Background(), processed.Key(), processed.ThumbKey())
+	}
+	return WithURLs(m, owner.UserID), nil
+}
+
+// aliasThumbKey names the thumbnail of an alias after the alias, with the
+// extension of the thumbnail of its blob.
+func aliasThumbKey(aliasKey, blobThumbKey string) string {
+	if blobThumbKey == "" {
+		return ""
+	}
+	name := strings.TrimSuffix(path.Base(aliasKey), path.Ext(aliasKey))
+	return path.Join(path.Dir(aliasKey), "thumbnails", "thumb_"+name+path.Ext(blobThumbKey))
+}
+
+// enqueue moves an original into storage where its blob will keep it and
+// records a pending media for a Processor to finish.
+func enqueue(ctx context.Context, alias repo.Media, blobFile fileUtils.ProcessedFile, userID int) (File, error) {
+	if err := fileUtils.StoreStagedFile(ctx, blobFile); err != nil {
+		return File{}, err
+	}
+
+	maxAttempts := defaultMaxJobAttempts
+	if DefaultProcessor != nil {
+		maxAttempts = DefaultProcessor.MaxAttempts
+	}
+	alias.MediaType = blobFile.MediaType
+	alias.MimeType = blobFile.MimeType
+	alias.Size = blobFile.FileSize
+	alias.SHA256 = blobFile.SHA256
+	m, err := repo.CreatePendingMedia(alias, blobFile.Key(), maxAttempts)
+	if err != nil {
+		deleteSource(repo.MediaJob{SourceKey: blobFile.Key()})
+		return File{}, err
+	}
+
+	if DefaultProcessor != nil {
+		DefaultProcessor.Wake()
+	}
+	return WithURLs(m, userID), nil
+}
+
+// Delete deletes a media that nothing references. The files are deleted
+// with the last media sharing them.
+func Delete(ctx context.Context, id int) (repo.Media, error) {
+	m, released, err := repo.DeleteMedia(id)
+	if err != nil {
+		return m, err
+	}
+	if released != nil {
+		deleteObjects(ctx, released.StorageKey, released.ThumbKey)
+	} else if m.BlobID == nil {
+		deleteObjects(ctx, m.StorageKey, m.ThumbKey)
+	}
+	return m, nil
+}
+
+// Resolve returns the storage key of the file a media URL key addresses.
+// Keys of aliases resolve to their blob, other keys address files directly.
+func Resolve(key string) (string, error) {
+	resolved, err := repo.ResolveMediaKey(key)
+	if errors.Is(err, repo.ErrMediaNotFound) {
+		return key, nil
+	}
+	return resolved, err
+}
+
+// deleteObjects removes files from storage. Failures are only logged: the
+// record is gone either way, and leftover files can be found by listing the
+// storage.
+func deleteObjects(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err := storage.Default.Delete(ctx, key); err != nil {
+			log.Printf("Failed to delete %s from storage: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/fileUtils"
+	"uneexpo/pkg/storage"
+	"uneexpo/pkg/worker"
+)
+
+// asyncMediaTypes are processed by a Processor rather than during the
+// upload, because ffmpeg may take minutes on them. Their media are pending
+// until then; clients poll GET /media-files/:id for the status.
+var asyncMediaTypes = map[string]bool{
+	"video": true,
+	"audio": true,
+}
+
+// DefaultProcessor is woken when media are queued. Without one, queued
+// media wait for the processor of another instance.
+var DefaultProcessor *Processor
+
+// defaultMaxJobAttempts is used when there is no DefaultProcessor.
+const defaultMaxJobAttempts = 5
+
+// Processor processes queued media from tbl_media_job with a bounded number
+// of workers. Any number of instances may run one: jobs are claimed with
+// FOR UPDATE SKIP LOCKED, and a job whose worker died is claimed again once
+// its lease passed.
+type Processor struct {
+	*worker.Pool
+
+	MaxAttempts int
+	// Timeout bounds one attempt, ffmpeg and ffprobe are killed after it.
+	Timeout time.Duration
+	// Retention is how long finished jobs are kept.
+	Retention time.Duration
+
+	// ctx is cancelled by Stop to kill the running ffmpeg
+	ctx  context.Context
+	kill context.CancelFunc
+}
+
+func NewProcessor() *Processor {
+	ctx, kill := context.WithCancel(context.Background())
+	return &Processor{
+		Pool: &worker.Pool{
+			Workers:      2,
+			PollInterval: 5 * time.Second,
+			Backoff:      30 * time.Second,
+			MaxBackoff:   time.Hour,
+		},
+		MaxAttempts: defaultMaxJobAttempts,
+		Timeout:     15 * time.Minute,
+		Retention:   7 * 24 * time.Hour,
+		ctx:         ctx,
+		kill:        kill,
+	}
+}
+
+// Start runs the workers until Stop is called. Each takes jobs one by one,
+// so it runs at most one ffmpeg.
+func (p *Processor) Start() {
+	p.Pool.Start(p.processNext)
+	p.Every(time.Hour, func() {
+		if err := repo.DeleteDoneMediaJobs(p.Retention); err != nil {
+			log.Printf("Failed to purge media jobs: %v", err)
+		}
+	})
+}
+
+// Stop interrupts the files being processed, which are queued again without
+// using up an attempt. Queued ones stay queued.
+func (p *Processor) Stop() {
+	p.Pool.Stop(p.kill)
+}
+
+// lease is how long a claimed job is left to its worker: the timeout, and
+// time to store the results.
+func (p *Processor) lease() time.Duration {
+	return p.Timeout + 5*time.Minute
+}
+
+// processNext processes one job and reports whether there was one.
+func (p *Processor) processNext() bool {
+	jobs, err := repo.ClaimMediaJobs(1, p.lease())
+	if err != nil {
+		log.Printf("Failed to claim media jobs: %v", err)
+		return false
+	}
+	for _, job := range jobs {
+		p.run(job)
+	}
+	return len(jobs) > 0
+}
+
+func (p *Processor) run(job repo.MediaJob) {
+	m, err := repo.GetMedia(job.MediaID)
+	if errors.Is(err, repo.ErrMediaNotFound) {
+		p.abandon(job)
+		return
+	}
+
+	var blob repo.MediaBlob
+	if err == nil {
+		ctx, cancel := context.WithTimeout(p.ctx, p.Timeout)
+		blob, err = process(ctx, m, job.SourceKey)
+		cancel()
+	}
+	if err == nil {
+		var stored repo.MediaBlob
+		m, stored, err = repo.CompleteMediaJob(job, blob, aliasThumbKey(m.StorageKey, blob.ThumbKey))
+		if errors.Is(err, repo.ErrMediaNotFound) {
+			// Deleted while it was processed. The source key is unique to
+			// the job, so nothing else uses the thumbnail made next to it
+			deleteObjects(context.Background(), blob.ThumbKey)
+			p.abandon(job)
+			return
+		}
+		if err == nil {
+			if stored.StorageKey != blob.StorageKey {
+				// An equal file was stored meanwhile, the media uses its files
+				deleteObjects(context.Background(), blob.ThumbKey)
+				deleteSource(job)
+			}
+			return
+		}
+	}
+
+	if p.ctx.Err() != nil {
+		// Interrupted by Stop: the file is fine, it goes back to the queue as it was
+		if err := repo.ReleaseMediaJob(job); err != nil {
+			log.Printf("Failed to release media job %d: %v", job.ID, err)
+		}
+		return
+	}
+
+	retryIn := p.RetryIn(job.Attempts)
+	log.Printf("Failed to process media %d (attempt %d/%d): %v", job.MediaID, job.Attempts, job.MaxAttempts, err)
+	dead, err := repo.FailMediaJob(job, err.Error(), retryIn)
+	if err != nil {
+		log.Printf("Failed to record failure of media job %d: %v", job.ID, err)
+		return
+	}
+	if dead {
+		deleteSource(job)
+	}
+}
+
+// abandon ends the job of a deleted media.
+func (p *Processor) abandon(job repo.MediaJob) {
+	if err := repo.CancelMediaJob(job.ID); err != nil {
+		log.Printf("Failed to cancel media job %d: %v", job.ID, err)
+		return
+	}
+	deleteSource(job)
+}
+
+// deleteSource deletes the original of a job that will not become a blob,
+// unless an equal upload still needs it.
+func deleteSource(job repo.MediaJob) {
+	inUse, err := repo.MediaSourceInUse(job.MediaID, job.SourceKey)
+	if err != nil {
+		log.Printf("Failed to check whether %s is in use: %v", job.SourceKey, err)
+		return
+	}
+	if !inUse {
+		deleteObjects(context.Background(), job.SourceKey)
+	}
+}
+
+// process stages the original of m from sourceKey, makes its thumbnail next
+// to it and reads its metadata, and returns the blob to store for it.
+func process(ctx context.Context, m repo.Media, sourceKey string) (repo.MediaBlob, error) {
+	dir := filepath.Join(fileUtils.StagingDir, "jobs")
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return repo.MediaBlob{}, err
+	}
+	name := m.UUID + path.Ext(sourceKey)
+	if err := download(ctx, sourceKey, filepath.Join(dir, name)); err != nil {
+		return repo.MediaBlob{}, fmt.Errorf("failed to stage %s: %w", sourceKey, err)
+	}
+
+	processed, err := fileUtils.ProcessStoredFile(ctx, fileUtils.ProcessedFile{
+		OriginalFn:     m.OriginalName,
+		UniqueFileName: name,
+		StoragePath:    filepath.Join(dir, name),
+		KeyName:        path.Base(sourceKey),
+		FilePath:       path.Dir(sourceKey),
+		ThumbPath:      path.Join(path.Dir(sourceKey), "thumbnails"),
+		MediaType:      m.MediaType,
+		MimeType:       m.MimeType,
+		FileSize:       m.Size,
+		SHA256:         m.SHA256,
+	})
+	if err != nil {
+		return repo.MediaBlob{}, err
+	}
+
+	return repo.MediaBlob{
+		Category:   m.Category,
+		SHA256:     m.SHA256,
+		StorageKey: sourceKey,
+		ThumbKey:   processed.ThumbKey(),
+		MediaType:  processed.MediaType,
+		MimeType:   processed.MimeType,
+		Size:       processed.FileSize,
+		Width:      processed.Width,
+		Height:     processed.Height,
+		Duration:   processed.Duration,
+	}, nil
+}
+
+func download(ctx context.Context, key, name string) error {
+	body, _, err := storage.Default.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		os.Remove(name)
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,146 @@
+package media
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"uneexpo/config"
+	"uneexpo/pkg/mediaurl"
+)
+
+// Categories of uploads. The category is the first segment of the storage
+// key of every file, so the category of a stored file is always known.
+const (
+	CategoryAvatar       = "avatar"
+	CategoryVehiclePhoto = "vehicle_photo"
+	CategoryVehicleDoc   = "vehicle_doc"
+	CategoryChat         = "chat"
+	CategoryContent      = "content"
+)
+
+// Rule is the upload policy of a category. It narrows the global policy of
+// config.ENV.FileUpload, which still applies to every file.
+type Rule struct {
+	// MediaTypes lists the allowed types as returned by
+	// fileUtils.DetermineMediaType: image, video, audio or document.
+	MediaTypes []string
+	// MimeTypes narrows MediaTypes further if set. Types are sniffed from
+	// the content, never taken from the file name.
+	MimeTypes map[string]bool
+	// MaxSize in bytes, 0 for FileUpload.MaxFileSize.
+	MaxSize int64
+	// MaxFiles per request, 0 for MAX_FILES_UPLOAD.
+	MaxFiles int
+	// ImageMaxSide shrinks images to fit in a square of that many pixels.
+	// 0 leaves them to the global COMPRESS_* settings.
+	ImageMaxSide int
+	// Referenced categories are attached to records through *_media_id
+	// columns (see v_media_ref), so their unreferenced files are orphans.
+	Referenced bool
+}
+
+const mb = 1024 * 1024
+
+var webImages = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+// Rules are the upload policies by category. Whether a category is served
+// without signed URLs is decided by mediaurl.PublicCategories.
+var Rules = map[string]Rule{
+	CategoryAvatar: {
+		MediaTypes:   []string{"image"},
+		MimeTypes:    webImages,
+		MaxSize:      5 * mb,
+		MaxFiles:     1,
+		ImageMaxSide: 1024,
+		Referenced:   true,
+	},
+	CategoryVehiclePhoto: {
+		MediaTypes:   []string{"image"},
+		MimeTypes:    webImages,
+		MaxSize:      15 * mb,
+		ImageMaxSide: 2560,
+		Referenced:   true,
+	},
+	// Documents keep their resolution so that they stay legible
+	CategoryVehicleDoc: {
+		MediaTypes: []string{"image", "document"},
+		MimeTypes: map[string]bool{
+			"image/jpeg":      true,
+			"image/png":       true,
+			"application/pdf": true,
+		},
+		MaxSize:    20 * mb,
+		Referenced: true,
+	},
+	CategoryChat: {
+		MediaTypes: []string{"image", "video", "audio", "document"},
+		MaxFiles:   10,
+	},
+	CategoryContent: {
+		MediaTypes: []string{"image", "video", "document"},
+		Referenced: true,
+	},
+}
+
+// RuleFor returns the rule of a category.
+func RuleFor(category string) (Rule, error) {
+	rule, ok := Rules[category]
+	if !ok {
+		return Rule{}, fmt.Errorf("%w: %q", ErrUnknownCategory, category)
+	}
+	return rule, nil
+}
+
+func (r Rule) maxSize() int64 {
+	if r.MaxSize > 0 && r.MaxSize < config.ENV.FileUpload.MaxFileSize {
+		return r.MaxSize
+	}
+	return config.ENV.FileUpload.MaxFileSize
+}
+
+func (r Rule) maxFiles() int {
+	if r.MaxFiles > 0 {
+		return r.MaxFiles
+	}
+	return config.ENV.MAX_FILES_UPLOAD
+}
+
+func (r Rule) allows(mediaType, mimeType string) bool {
+	if r.MimeTypes != nil && !r.MimeTypes[mimeType] {
+		return false
+	}
+	for _, allowed := range r.MediaTypes {
+		if allowed == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// CategoryOf returns the category of a storage key.
+func CategoryOf(key string) string {
+	category, _, _ := strings.Cut(strings.TrimPrefix(key, "/"), "/")
+	return category
+}
+
+// IsPublic reports whether a stored file is served without a signed URL.
+func IsPublic(key string) bool {
+	return mediaurl.IsPublic(CategoryOf(key))
+}
+
+// ReferencedCategories lists the categories whose files are attached to
+// records, sorted.
+func ReferencedCategories() []string {
+	var categories []string
+	for category, rule := range Rules {
+		if rule.Referenced {
+			categories = append(categories, category)
+		}
+	}
+	sort.Strings(categories)
+	return categories
+}
@@ -0,0 +1,113 @@
+package middlewares
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/activity"
+	"uneexpo/pkg/revocation"
+	"uneexpo/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const HeaderAPIKey = "X-API-Key"
+
+// apiKeyFromRequest reads a key from X-API-Key or from a bearer token that looks like one.
+func apiKeyFromRequest(ctx *gin.Context) string {
+	if key := ctx.GetHeader(HeaderAPIKey); key != "" {
+		return key
+	}
+	if token := bearerToken(ctx); strings.HasPrefix(token, utils.APIKeyPrefix) {
+		return token
+	}
+	return ""
+}
+
+func authenticateAPIKey(ctx *gin.Context, key string) (*utils.Claims, bool) {
+	prefix, ok := utils.ParseAPIKey(key)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", "Invalid API key"))
+		return nil, false
+	}
+
+	auth, err := repo.GetAPIKeyAuth(prefix)
+	if err != nil {
+		if errors.Is(err, repo.ErrAPIKeyNotFound) {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", "Invalid API key"))
+			return nil, false
+		}
+		log.Printf("Failed to load API key %s: %v", prefix, err)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to check API key", ""))
+		return nil, false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(utils.HashToken(key)), []byte(auth.KeyHash)) != 1 {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", "Invalid API key"))
+		return nil, false
+	}
+	if auth.RevokedAt != nil {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", "API key has been revoked"))
+		return nil, false
+	}
+	if auth.ExpiresAt != nil && auth.ExpiresAt.Before(time.Now()) {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", "API key has expired"))
+		return nil, false
+	}
+	if !auth.UserActive {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, utils.FormatErrorResponse("Forbidden", "User is not active"))
+		return nil, false
+	}
+	if !auth.CompanyActive {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, utils.FormatErrorResponse("Forbidden", "Company is not active"))
+		return nil, false
+	}
+	if !auth.APIAccess {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, utils.FormatErrorResponse("Forbidden", "Your plan does not include API access"))
+		return nil, false
+	}
+
+	claims := &utils.Claims{
+		ID:        auth.UserID,
+		RoleID:    auth.RoleID,
+		CompanyID: auth.CompanyID,
+		Role:      auth.Role,
+		TokenType: utils.TokenTypeAPIKey,
+		Scopes:    auth.Scopes,
+	}
+	if revocation.IsCompanyRevoked(auth.CompanyID) {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", "Company access has been revoked"))
+		return nil, false
+	}
+	if revocation.IsUserRevoked(auth.UserID) {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", "User access has been revoked"))
+		return nil, false
+	}
+
+	setClaims(ctx, claims)
+	ctx.Set("apiKeyID", auth.ID)
+
+	activity.TouchAPIKey(auth.ID, ctx.ClientIP())
+
+	return claims, true
+}
+
+// GuardAPI authenticates either a bearer JWT or a company API key, passed in
+// X-API-Key or as the bearer token. Pair it with RequirePermission so API keys
+// are held to their scopes.
+func GuardAPI(ctx *gin.Context) {
+	key := apiKeyFromRequest(ctx)
+	if key == "" {
+		Guard(ctx)
+		return
+	}
+
+	if _, ok := authenticateAPIKey(ctx, key); !ok {
+		return
+	}
+	ctx.Next()
+}
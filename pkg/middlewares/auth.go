@@ -1,159 +1,207 @@
 package middlewares
 
 import (
+	"crypto/subtle"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
-	"uneexpo/config"
-	"uneexpo/internal/repo"
+	"time"
+	"uneexpo/pkg/activity"
+	"uneexpo/pkg/hmacauth"
+	"uneexpo/pkg/mediaurl"
+	"uneexpo/pkg/revocation"
 	"uneexpo/pkg/utils"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 )
 
-func GuardURLParam(ctx *gin.Context) {
-	token := ctx.Query("token")
-	if len(token) == 0 {
-		ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", "Token is missing"))
-		return
-	}
-	claims := jwt.MapClaims{}
-	_, err := jwt.ParseWithClaims(
-		token, claims, func(t *jwt.Token) (interface{}, error) {
-			return []byte(config.ENV.ACCESS_KEY), nil
-		},
-	)
-	if err != nil {
-		ctx.AbortWithStatusJSON(http.StatusForbidden, utils.FormatErrorResponse("Forbidden", err.Error()))
-		return
+const claimsKey = "claims"
+
+// GetClaims returns the verified token claims stored by one of the guards.
+func GetClaims(ctx *gin.Context) (*utils.Claims, bool) {
+	value, exists := ctx.Get(claimsKey)
+	if !exists {
+		return nil, false
 	}
-	ctx.Set("id", int(claims["id"].(float64)))
-	ctx.Set("roleID", int(claims["roleID"].(float64)))
-	ctx.Set("companyID", int(claims["companyID"].(float64)))
-	ctx.Set("role", claims["role"])
-	ctx.Next()
+	claims, ok := value.(*utils.Claims)
+	return claims, ok
 }
 
-func SysGuard(ctx *gin.Context) {
-	token := ctx.GetHeader(config.ENV.SYSTEM_HEADER)
-	if token != config.ENV.API_SECRET {
-		ctx.AbortWithStatusJSON(http.StatusUnauthorized,
-			utils.FormatErrorResponse("Unauthorized", "This endpoint is for internal use only"))
-		return
+func setClaims(ctx *gin.Context, claims *utils.Claims) {
+	ctx.Set(claimsKey, claims)
+
+	// Kept for handlers still reading the individual keys
+	ctx.Set("id", claims.ID)
+	ctx.Set("roleID", claims.RoleID)
+	ctx.Set("companyID", claims.CompanyID)
+	ctx.Set("driverID", claims.DriverID)
+	ctx.Set("role", claims.Role)
+}
+
+func bearerToken(ctx *gin.Context) string {
+	token, found := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if !found {
+		return ""
 	}
-	ctx.Next()
+	return strings.TrimSpace(token)
 }
 
-func Guard(ctx *gin.Context) {
-	authorization := ctx.Request.Header["Authorization"]
-	if len(authorization) == 0 {
-		ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", ""))
-		return
+// authenticate verifies the token and stores its claims, aborting with 401 on failure.
+func authenticate(ctx *gin.Context, token string) (*utils.Claims, bool) {
+	if token == "" {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", "Token is missing"))
+		return nil, false
 	}
 
-	bearer := strings.Split(authorization[0], "Bearer ")
-	if len(bearer) == 0 || len(bearer) == 1 {
-		ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", ""))
-		return
+	claims, err := utils.ParseAccessToken(token)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", err.Error()))
+		return nil, false
 	}
 
-	token := bearer[1]
-	claims := jwt.MapClaims{}
+	if revocation.IsRevoked(claims) {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", "Token has been revoked"))
+		return nil, false
+	}
 
-	_, err := jwt.ParseWithClaims(
-		token, claims, func(t *jwt.Token) (interface{}, error) {
-			return []byte(config.ENV.ACCESS_KEY), nil
-		},
-	)
-	if err != nil {
-		ctx.AbortWithStatusJSON(http.StatusForbidden, utils.FormatErrorResponse("Forbidden", err.Error()))
+	setClaims(ctx, claims)
+	return claims, true
+}
+
+// GuardSignedURL serves private media to holders of a URL signed by the
+// mediaurl package, for places like <img> tags that cannot send a header.
+// The user the URL was issued to is stored under "mediaUserID".
+func GuardSignedURL(ctx *gin.Context) {
+	if _, ok := verifySignedURL(ctx); !ok {
 		return
 	}
-
-	ctx.Set("id", int(claims["id"].(float64)))
-	ctx.Set("roleID", int(claims["roleID"].(float64)))
-	ctx.Set("companyID", int(claims["companyID"].(float64)))
-	ctx.Set("role", claims["role"])
 	ctx.Next()
 }
 
-func GuardAdmin(ctx *gin.Context) {
-	authorization := ctx.Request.Header["Authorization"]
-	if len(authorization) == 0 {
-		ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", ""))
+func verifySignedURL(ctx *gin.Context) (int, bool) {
+	userID, expiresAt, err := mediaurl.Verify(ctx.Request.URL.EscapedPath(), ctx.Request.URL.Query())
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", err.Error()))
+		return 0, false
+	}
+
+	// Keep the signed URL out of shared caches and Referer headers
+	maxAge := int(time.Until(expiresAt).Seconds())
+	ctx.Header("Cache-Control", "private, max-age="+strconv.Itoa(maxAge))
+	ctx.Header("Referrer-Policy", "no-referrer")
+
+	ctx.Set("mediaUserID", userID)
+	return userID, true
+}
+
+// GuardURLParam guards the routes of the old /media/{uuid}/{file} URLs. It
+// accepts URLs signed by fileUtils.GenerateSignedMediaURL and, until every
+// client has moved to them, an access token in ?token=, which leaks into
+// logs and shared links. Either way the user is stored under "id".
+//
+// Deprecated: use GuardSignedURL once no client sends ?token=.
+func GuardURLParam(ctx *gin.Context) {
+	token := ctx.Query("token")
+	if token == "" {
+		userID, ok := verifySignedURL(ctx)
+		if !ok {
+			return
+		}
+		ctx.Set("id", userID)
+		ctx.Next()
 		return
 	}
 
-	bearer := strings.Split(authorization[0], "Bearer ")
-	if len(bearer) == 0 || len(bearer) == 1 {
-		ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", ""))
+	log.Printf("Deprecated: %s from %s authenticated with ?token=, send a signed URL instead", ctx.FullPath(), ctx.ClientIP())
+	ctx.Header("Referrer-Policy", "no-referrer")
+	if _, ok := authenticate(ctx, token); !ok {
 		return
 	}
+	ctx.Next()
+}
 
-	token := bearer[1]
-	claims := jwt.MapClaims{}
+// legacySystem is the static header SysGuard used to accept, see AllowLegacySystemHeader.
+var legacySystem struct {
+	header, secret string
+}
 
-	_, err := jwt.ParseWithClaims(
-		token, claims, func(t *jwt.Token) (interface{}, error) {
-			return []byte(config.ENV.ACCESS_KEY), nil
-		},
-	)
-	if err != nil {
-		ctx.AbortWithStatusJSON(http.StatusForbidden, utils.FormatErrorResponse("Forbidden", err.Error()))
-		return
+// AllowLegacySystemHeader makes SysGuard also accept requests that carry
+// secret in header, as the "system" client, while callers move to signed
+// requests. Every such request is logged.
+func AllowLegacySystemHeader(header, secret string) {
+	legacySystem.header, legacySystem.secret = header, secret
+}
+
+func isLegacySystemRequest(ctx *gin.Context) bool {
+	if legacySystem.header == "" || legacySystem.secret == "" {
+		return false
 	}
+	value := ctx.GetHeader(legacySystem.header)
+	if subtle.ConstantTimeCompare([]byte(value), []byte(legacySystem.secret)) != 1 {
+		return false
+	}
+	log.Printf("Deprecated: %s %s from %s authenticated with the static %s header, sign it with hmacauth instead",
+		ctx.Request.Method, ctx.FullPath(), ctx.ClientIP(), legacySystem.header)
+	return true
+}
 
-	if !(claims["role"] == "admin" || claims["role"] == "system") {
-		ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Permission denied!", ""))
-		return
+// SysGuard lets through requests signed by a known internal client, see the
+// hmacauth package. The client id is stored under "systemClient".
+func SysGuard(ctx *gin.Context) {
+	clientID, err := hmacauth.Verify(ctx.Request)
+	if err != nil {
+		if !isLegacySystemRequest(ctx) {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized,
+				utils.FormatErrorResponse("Unauthorized", "This endpoint is for internal use only"))
+			return
+		}
+		clientID = "system"
 	}
 
-	ctx.Set("id", int(claims["id"].(float64)))
-	ctx.Set("roleID", int(claims["roleID"].(float64)))
-	ctx.Set("companyID", int(claims["companyID"].(float64)))
-	ctx.Set("role", claims["role"])
+	ctx.Set("systemClient", clientID)
 	ctx.Next()
 }
 
-func UpdateLastActive(ctx *gin.Context) {
-	authorization := ctx.Request.Header["Authorization"]
-	if len(authorization) == 0 {
-		ctx.Next()
-		return
-	}
-	bearer := strings.Split(authorization[0], "Bearer ")
-	if len(bearer) == 0 || len(bearer) == 1 {
-		ctx.Next()
+func Guard(ctx *gin.Context) {
+	if _, ok := authenticate(ctx, bearerToken(ctx)); !ok {
 		return
 	}
+	ctx.Next()
+}
 
-	token := bearer[1]
-	claims := jwt.MapClaims{}
-	_, err := jwt.ParseWithClaims(
-		token, claims, func(t *jwt.Token) (interface{}, error) {
-			return []byte(config.ENV.ACCESS_KEY), nil
-		},
-	)
-	if err != nil {
-		ctx.Next()
+// GuardAdmin is Guard followed by RequireRoles("admin", "system").
+func GuardAdmin(ctx *gin.Context) {
+	claims, ok := authenticate(ctx, bearerToken(ctx))
+	if !ok {
 		return
 	}
 
-	companyID := int(claims["companyID"].(float64))
-	if companyID == 0 {
-		ctx.Next()
+	if !isSuperuser(claims) {
+		deny(ctx, "role:admin|system")
 		return
 	}
+	ctx.Next()
+}
 
-	go func() {
-		err := repo.UpdateUserLastActive(companyID)
-		if err != nil {
-			log.Print("Failed to update last seen", err)
-			ctx.Next()
+// UpdateLastActive records the activity of the caller's company once the
+// request is handled. Writes are batched by the activity package.
+func UpdateLastActive(ctx *gin.Context) {
+	ctx.Next()
+
+	claims, ok := GetClaims(ctx)
+	if !ok {
+		token := bearerToken(ctx)
+		if token == "" || strings.HasPrefix(token, utils.APIKeyPrefix) {
 			return
 		}
-	}()
 
-	ctx.Next()
+		parsed, err := utils.ParseAccessToken(token)
+		if err != nil || revocation.IsRevoked(parsed) {
+			return
+		}
+		claims = parsed
+	}
+
+	activity.Touch(claims.CompanyID)
 }
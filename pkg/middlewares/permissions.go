@@ -0,0 +1,221 @@
+package middlewares
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrResourceNotFound is returned by an OwnerResolver when the resource does not exist.
+var ErrResourceNotFound = errors.New("resource not found")
+
+// OwnerResolver returns the id of the company owning the resource addressed by the request.
+type OwnerResolver func(ctx *gin.Context) (int, error)
+
+// PermissionCacheTTL bounds how long an edit made on another instance takes to apply here.
+var PermissionCacheTTL = time.Minute
+
+type roleEntry struct {
+	name        string
+	permissions map[string]bool
+}
+
+var permissionCache = struct {
+	sync.RWMutex
+	roles    map[int]roleEntry
+	loadedAt time.Time
+}{}
+
+// InvalidatePermissions drops the cached role→permission mapping so the next check reloads it.
+func InvalidatePermissions() {
+	permissionCache.Lock()
+	permissionCache.loadedAt = time.Time{}
+	permissionCache.Unlock()
+}
+
+func lookupRole(roleID int) (roleEntry, error) {
+	permissionCache.RLock()
+	fresh := time.Since(permissionCache.loadedAt) < PermissionCacheTTL
+	entry, ok := permissionCache.roles[roleID]
+	permissionCache.RUnlock()
+	if fresh {
+		return entry, nil
+	}
+
+	roles, err := repo.GetRolesWithPermissions()
+	if err != nil {
+		if ok {
+			// Serve the stale mapping rather than locking everybody out
+			log.Printf("Failed to reload role permissions: %v", err)
+			return entry, nil
+		}
+		return roleEntry{}, err
+	}
+
+	loaded := make(map[int]roleEntry, len(roles))
+	for _, role := range roles {
+		permissions := make(map[string]bool, len(role.Permissions))
+		for _, name := range role.Permissions {
+			permissions[name] = true
+		}
+		loaded[role.ID] = roleEntry{name: role.Name, permissions: permissions}
+	}
+
+	permissionCache.Lock()
+	permissionCache.roles = loaded
+	permissionCache.loadedAt = time.Now()
+	permissionCache.Unlock()
+
+	return loaded[roleID], nil
+}
+
+// RoleHasPermission reports whether a role, by tbl_role id, holds a permission.
+func RoleHasPermission(roleID int, permission string) (bool, error) {
+	entry, err := lookupRole(roleID)
+	if err != nil {
+		return false, err
+	}
+	return entry.permissions[permission], nil
+}
+
+func isSuperuser(claims *utils.Claims) bool {
+	return claims.Role == "admin" || claims.Role == "system"
+}
+
+func deny(ctx *gin.Context, missing string) {
+	response := utils.FormatErrorResponse("Permission denied", "missing permission: "+missing)
+	response.Data = gin.H{"missing_permission": missing}
+	ctx.AbortWithStatusJSON(http.StatusForbidden, response)
+}
+
+func requireClaims(ctx *gin.Context) (*utils.Claims, bool) {
+	claims, ok := GetClaims(ctx)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormatErrorResponse("Unauthorized", ""))
+	}
+	return claims, ok
+}
+
+// RequireRoles lets the request through when the caller's role_t value or
+// tbl_role name is one of roles, e.g. RequireRoles("carrier", "driver") or
+// RequireRoles("carrier_owner"). It must run after Guard.
+func RequireRoles(roles ...string) gin.HandlerFunc {
+	allowed := make(map[string]bool, len(roles))
+	for _, role := range roles {
+		allowed[role] = true
+	}
+
+	return func(ctx *gin.Context) {
+		claims, ok := requireClaims(ctx)
+		if !ok {
+			return
+		}
+		if allowed[claims.Role] {
+			ctx.Next()
+			return
+		}
+
+		entry, err := lookupRole(claims.RoleID)
+		if err != nil {
+			log.Printf("Failed to load role %d: %v", claims.RoleID, err)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to check permissions", ""))
+			return
+		}
+		if !allowed[entry.name] {
+			deny(ctx, "role:"+strings.Join(roles, "|"))
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// RequirePermission lets the request through when the caller's role holds
+// every listed permission. Admin and system roles hold all permissions.
+// Requests made with an API key also need every permission among its scopes.
+// It must run after Guard or GuardAPI.
+func RequirePermission(permissions ...string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		claims, ok := requireClaims(ctx)
+		if !ok {
+			return
+		}
+		if claims.TokenType == utils.TokenTypeAPIKey {
+			for _, permission := range permissions {
+				if !slices.Contains(claims.Scopes, permission) {
+					deny(ctx, permission)
+					return
+				}
+			}
+		}
+		if isSuperuser(claims) {
+			ctx.Next()
+			return
+		}
+
+		entry, err := lookupRole(claims.RoleID)
+		if err != nil {
+			log.Printf("Failed to load role %d: %v", claims.RoleID, err)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to check permissions", ""))
+			return
+		}
+		for _, permission := range permissions {
+			if !entry.permissions[permission] {
+				deny(ctx, permission)
+				return
+			}
+		}
+		ctx.Next()
+	}
+}
+
+// HasPermission reports whether the caller holds a permission, for handlers
+// that only widen access with it. It follows the rules of RequirePermission.
+func HasPermission(claims *utils.Claims, permission string) (bool, error) {
+	if claims.TokenType == utils.TokenTypeAPIKey && !slices.Contains(claims.Scopes, permission) {
+		return false, nil
+	}
+	if isSuperuser(claims) {
+		return true, nil
+	}
+	return RoleHasPermission(claims.RoleID, permission)
+}
+
+// RequireOwner lets the request through when the resource belongs to the
+// caller's company. Admin and system roles may access any resource.
+// It must run after Guard.
+func RequireOwner(resolve OwnerResolver) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		claims, ok := requireClaims(ctx)
+		if !ok {
+			return
+		}
+		if isSuperuser(claims) {
+			ctx.Next()
+			return
+		}
+
+		ownerID, err := resolve(ctx)
+		if err != nil {
+			if errors.Is(err, ErrResourceNotFound) {
+				ctx.AbortWithStatusJSON(http.StatusNotFound, utils.FormatErrorResponse("Not found", err.Error()))
+				return
+			}
+			log.Printf("Failed to resolve resource owner: %v", err)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, utils.FormatErrorResponse("Failed to check permissions", ""))
+			return
+		}
+		if claims.CompanyID == 0 || ownerID != claims.CompanyID {
+			deny(ctx, "owner")
+			return
+		}
+		ctx.Next()
+	}
+}
@@ -0,0 +1,184 @@
+package middlewares
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/ratelimit"
+	"uneexpo/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// KeyFunc picks the bucket a request is counted against.
+type KeyFunc func(ctx *gin.Context) string
+
+func KeyByIP(ctx *gin.Context) string {
+	return "ip:" + ctx.ClientIP()
+}
+
+// KeyByUser counts authenticated requests per user and anonymous ones per IP.
+func KeyByUser(ctx *gin.Context) string {
+	if claims, ok := GetClaims(ctx); ok && claims.ID != 0 {
+		return "user:" + strconv.Itoa(claims.ID)
+	}
+	return KeyByIP(ctx)
+}
+
+// KeyByCompany counts requests of every user and API key of a company together.
+func KeyByCompany(ctx *gin.Context) string {
+	if claims, ok := GetClaims(ctx); ok && claims.CompanyID != 0 {
+		return "company:" + strconv.Itoa(claims.CompanyID)
+	}
+	return KeyByUser(ctx)
+}
+
+type RateLimitConfig struct {
+	// Name keeps the buckets of different route groups apart.
+	Name  string
+	Limit ratelimit.Limit
+	// Key defaults to KeyByIP.
+	Key KeyFunc
+	// Backend defaults to ratelimit.DefaultBackend.
+	Backend ratelimit.Backend
+	// PlanAware scales Limit by PlanMultipliers of the caller's company plan.
+	// It needs the claims, so the limiter has to run after Guard or GuardAPI.
+	PlanAware bool
+}
+
+// PlanMultipliers scales plan-aware limits by the plan_t of an active company plan.
+var PlanMultipliers = map[string]float64{
+	"start":    1,
+	"standard": 2,
+	"premium":  5,
+}
+
+const planCacheTTL = 5 * time.Minute
+
+// planCacheSize bounds the plans kept in memory. Past it, plans older than
+// planCacheTTL are dropped, and every plan if none is.
+const planCacheSize = 10000
+
+type cachedPlan struct {
+	plan     string
+	loadedAt time.Time
+}
+
+var planCache = struct {
+	sync.RWMutex
+	plans map[int]cachedPlan
+}{plans: map[int]cachedPlan{}}
+
+func companyPlan(companyID int) string {
+	planCache.RLock()
+	cached, ok := planCache.plans[companyID]
+	planCache.RUnlock()
+	if ok && time.Since(cached.loadedAt) < planCacheTTL {
+		return cached.plan
+	}
+
+	plan, err := repo.GetCompanyPlan(companyID)
+	if err != nil {
+		log.Printf("Failed to load plan of company %d: %v", companyID, err)
+		return cached.plan
+	}
+
+	cachePlan(companyID, plan)
+	return plan
+}
+
+func cachePlan(companyID int, plan string) {
+	planCache.Lock()
+	defer planCache.Unlock()
+
+	if len(planCache.plans) >= planCacheSize {
+		for id, cached := range planCache.plans {
+			if time.Since(cached.loadedAt) >= planCacheTTL {
+				delete(planCache.plans, id)
+			}
+		}
+		if len(planCache.plans) >= planCacheSize {
+			clear(planCache.plans)
+		}
+	}
+	planCache.plans[companyID] = cachedPlan{plan: plan, loadedAt: time.Now()}
+}
+
+// RateLimit throttles requests with a token bucket. Every response carries
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers, throttled
+// ones get 429 with Retry-After. When the backend fails requests are let through.
+func RateLimit(cfg RateLimitConfig) gin.HandlerFunc {
+	keyFunc := cfg.Key
+	if keyFunc == nil {
+		keyFunc = KeyByIP
+	}
+
+	return func(ctx *gin.Context) {
+		backend := cfg.Backend
+		if backend == nil {
+			backend = ratelimit.DefaultBackend
+		}
+
+		limit := cfg.Limit
+		if cfg.PlanAware {
+			if claims, ok := GetClaims(ctx); ok && claims.CompanyID != 0 {
+				if multiplier, ok := PlanMultipliers[companyPlan(claims.CompanyID)]; ok {
+					limit = limit.Scale(multiplier)
+				}
+			}
+		}
+
+		result, err := backend.Take(cfg.Name+":"+keyFunc(ctx), limit)
+		if err != nil {
+			log.Printf("Rate limiter %s failed: %v", cfg.Name, err)
+			ctx.Next()
+			return
+		}
+
+		ctx.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+		ctx.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		ctx.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+
+		if !result.Allowed {
+			retryAfter := ceilSeconds(result.RetryAfter)
+			ctx.Header("Retry-After", strconv.Itoa(retryAfter))
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, utils.FormatErrorResponse(
+				"Too many requests", fmt.Sprintf("Rate limit exceeded, retry in %d seconds", retryAfter),
+			))
+			return
+		}
+		ctx.Next()
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// OTPRateLimit guards endpoints that send an OTP, each of which costs an SMS.
+var OTPRateLimit = RateLimit(RateLimitConfig{
+	Name:  "otp",
+	Limit: ratelimit.Every(5, 15*time.Minute),
+	Key:   KeyByIP,
+})
+
+// OTPVerifyRateLimit guards endpoints that check an OTP, on top of the
+// attempts each code allows.
+var OTPVerifyRateLimit = RateLimit(RateLimitConfig{
+	Name:  "otp_verify",
+	Limit: ratelimit.PerMinute(10),
+	Key:   KeyByIP,
+})
+
+// APIRateLimit is the default limit of routes open to API keys.
+var APIRateLimit = RateLimit(RateLimitConfig{
+	Name:      "api",
+	Limit:     ratelimit.PerMinute(120),
+	Key:       KeyByCompany,
+	PlanAware: true,
+})
@@ -0,0 +1,249 @@
+package otp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/mailer"
+	"uneexpo/pkg/sms"
+)
+
+const (
+	ChannelSMS   = "sms"
+	ChannelEmail = "email"
+	ChannelPush  = "push"
+)
+
+var (
+	// ChannelOrder is the order channels are tried in after the preferred one.
+	ChannelOrder = []string{ChannelSMS, ChannelEmail, ChannelPush}
+	// ChannelTimeout is how long a channel may take before the next one is tried.
+	ChannelTimeout = 15 * time.Second
+
+	ErrNoChannel      = errors.New("the user has no verified contact to send a code to")
+	ErrUnknownChannel = errors.New("unknown channel")
+)
+
+// Channel delivers codes to one kind of contact of a user.
+type Channel interface {
+	Name() string
+	// Available reports whether the user has a verified contact on the channel.
+	Available(contact repo.UserContact) bool
+	// Destination is the contact shown to the user, masked.
+	Destination(contact repo.UserContact) string
+	Send(ctx context.Context, contact repo.UserContact, msg Message) error
+}
+
+// Message is an issued code on its way to a user.
+type Message struct {
+	Code    string
+	Purpose string
+	// Firmware of the requesting device, for the Android SMS Retriever hash.
+	Firmware string
+	// Locale of the user, for channels that send text of their own.
+	Locale    string
+	ExpiresAt time.Time
+}
+
+var channels = map[string]Channel{
+	ChannelSMS:   smsChannel{},
+	ChannelEmail: emailChannel{},
+}
+
+// RegisterChannel adds or replaces a channel, e.g. push once Firebase is set
+// up. It must be called during startup.
+func RegisterChannel(channel Channel) {
+	channels[channel.Name()] = channel
+}
+
+// IsChannel reports whether name is a registered channel.
+func IsChannel(name string) bool {
+	_, ok := channels[name]
+	return ok
+}
+
+// Delivery tells the app where to look for the code.
+type Delivery struct {
+	Channel     string    `json:"channel"`
+	Destination string    `json:"destination"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	// Failed lists the channels tried before Channel, which the code may still reach.
+	Failed []string `json:"failed,omitempty"`
+}
+
+// DeliverRequest asks for a code for Purpose to be sent to a user.
+type DeliverRequest struct {
+	UserID  int
+	Purpose string
+	// Channel, when set, is tried first, before the user's own preference.
+	Channel  string
+	Firmware string
+	// Locale is a locale or Accept-Language value for the message text.
+	Locale string
+}
+
+// UserDestination is what codes delivered to a user are issued for. A single
+// code is sent over every channel tried, so a late message from a channel
+// that timed out still carries a valid code.
+func UserDestination(userID int) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// DeliverToUser issues a code and sends it over the first channel that
+// works, trying the requested channel, then the user's preferred one, then
+// ChannelOrder. Codes it sends are checked with VerifyUser.
+func DeliverToUser(ctx context.Context, req DeliverRequest) (Delivery, error) {
+	if req.Channel != "" && !IsChannel(req.Channel) {
+		return Delivery{}, ErrUnknownChannel
+	}
+
+	contact, err := repo.GetUserContact(req.UserID)
+	if err != nil {
+		return Delivery{}, err
+	}
+
+	candidates := []Channel{}
+	for _, name := range channelOrder(req.Channel, contact.OTPChannel) {
+		if channel := channels[name]; channel.Available(contact) {
+			candidates = append(candidates, channel)
+		}
+	}
+	if len(candidates) == 0 {
+		return Delivery{}, ErrNoChannel
+	}
+
+	code, expiresAt, err := Issue(req.Purpose, UserDestination(req.UserID))
+	if err != nil {
+		return Delivery{}, err
+	}
+
+	msg := Message{Code: code, Purpose: req.Purpose, Firmware: req.Firmware, Locale: req.Locale, ExpiresAt: expiresAt}
+	delivery := Delivery{ExpiresAt: expiresAt}
+	var errs []error
+	for _, channel := range candidates {
+		if err := send(ctx, channel, contact, msg); err != nil {
+			log.Printf("Failed to deliver %s code to user %d by %s: %v", req.Purpose, req.UserID, channel.Name(), err)
+			delivery.Failed = append(delivery.Failed, channel.Name())
+			errs = append(errs, fmt.Errorf("%s: %w", channel.Name(), err))
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		delivery.Channel = channel.Name()
+		delivery.Destination = channel.Destination(contact)
+		return delivery, nil
+	}
+	return Delivery{}, fmt.Errorf("failed to deliver code: %w", errors.Join(errs...))
+}
+
+// VerifyUser checks a code sent by DeliverToUser.
+func VerifyUser(purpose string, userID int, code string) error {
+	return Verify(purpose, UserDestination(userID), code)
+}
+
+func channelOrder(preferred ...string) []string {
+	order := []string{}
+	seen := map[string]bool{}
+	for _, name := range append(preferred, ChannelOrder...) {
+		if name != "" && !seen[name] && IsChannel(name) {
+			seen[name] = true
+			order = append(order, name)
+		}
+	}
+	return order
+}
+
+// send gives up on a channel after ChannelTimeout even if it does not honour
+// the context, leaving it to finish in the background.
+func send(ctx context.Context, channel Channel, contact repo.UserContact, msg Message) error {
+	ctx, cancel := context.WithTimeout(ctx, ChannelTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- channel.Send(ctx, contact, msg) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type smsChannel struct{}
+
+func (smsChannel) Name() string { return ChannelSMS }
+
+func (smsChannel) Available(contact repo.UserContact) bool { return contact.PhoneVerified() }
+
+func (smsChannel) Destination(contact repo.UserContact) string { return MaskPhone(contact.Phone) }
+
+func (smsChannel) Send(ctx context.Context, contact repo.UserContact, msg Message) error {
+	return sms.Default.Send(ctx, sms.Message{Phone: contact.Phone, Code: msg.Code, Firmware: msg.Firmware})
+}
+
+type emailChannel struct{}
+
+func (emailChannel) Name() string { return ChannelEmail }
+
+func (emailChannel) Available(contact repo.UserContact) bool { return contact.EmailVerified() }
+
+func (emailChannel) Destination(contact repo.UserContact) string { return MaskEmail(contact.Email) }
+
+func (emailChannel) Send(ctx context.Context, contact repo.UserContact, msg Message) error {
+	// Sent at once rather than queued, so a failure falls back to the next channel
+	return mailer.Send(ctx, mailer.Email{
+		To:       contact.Email,
+		Template: mailer.TemplateOTP,
+		Locale:   msg.Locale,
+		Data: mailer.EmailData{
+			OTP:              msg.Code,
+			ExpiresInMinutes: int(math.Ceil(time.Until(msg.ExpiresAt).Minutes())),
+		},
+		Immediate: true,
+	})
+}
+
+// PushChannel sends codes as push notifications. The Firebase integration
+// registers it with its own functions once it is initialized.
+type PushChannel struct {
+	// HasDevice reports whether the user has a device to push to.
+	HasDevice func(userID int) bool
+	Push      func(ctx context.Context, userID int, title, body string) error
+}
+
+func (p PushChannel) Name() string { return ChannelPush }
+
+func (p PushChannel) Available(contact repo.UserContact) bool {
+	return p.HasDevice != nil && p.Push != nil && p.HasDevice(contact.UserID)
+}
+
+func (p PushChannel) Destination(contact repo.UserContact) string { return "app" }
+
+func (p PushChannel) Send(ctx context.Context, contact repo.UserContact, msg Message) error {
+	return p.Push(ctx, contact.UserID, "Your verification code", msg.Code)
+}
+
+// MaskPhone keeps the country code and the last two digits.
+func MaskPhone(phone string) string {
+	if len(phone) <= 6 {
+		return strings.Repeat("*", len(phone))
+	}
+	return phone[:4] + strings.Repeat("*", len(phone)-6) + phone[len(phone)-2:]
+}
+
+// MaskEmail keeps the first letter of the local part and the domain.
+func MaskEmail(email string) string {
+	local, domain, found := strings.Cut(email, "@")
+	if !found || local == "" {
+		return email
+	}
+	return local[:1] + strings.Repeat("*", max(len(local)-1, 3)) + "@" + domain
+}
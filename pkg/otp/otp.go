@@ -0,0 +1,226 @@
+package otp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"uneexpo/config"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/utils"
+)
+
+// Purposes of a code. A code issued for one purpose never verifies for another.
+const (
+	PurposeLogin         = "login"
+	PurposePhoneChange   = "phone_change"
+	PurposeEmailChange   = "email_change"
+	PurposePasswordReset = "password_reset"
+)
+
+// Policy controls how codes of a purpose are issued and verified.
+type Policy struct {
+	Length      int
+	TTL         time.Duration
+	MaxAttempts int
+	// Cooldown is the least time between two codes of the purpose to a destination.
+	Cooldown time.Duration
+	// DailyCap bounds the codes of every purpose a destination receives in 24 hours.
+	DailyCap int
+}
+
+var DefaultPolicy = Policy{
+	Length:      6,
+	TTL:         5 * time.Minute,
+	MaxAttempts: 5,
+	Cooldown:    time.Minute,
+	DailyCap:    10,
+}
+
+// Policies overrides DefaultPolicy per purpose.
+var Policies = map[string]Policy{
+	PurposePasswordReset: {Length: 6, TTL: 10 * time.Minute, MaxAttempts: 3, Cooldown: 2 * time.Minute, DailyCap: 5},
+}
+
+var (
+	ErrInvalidCode     = errors.New("invalid code")
+	ErrExpired         = errors.New("code has expired, please request a new one")
+	ErrTooManyAttempts = errors.New("too many attempts, please request a new code")
+	ErrNoCode          = errors.New("no code was requested")
+	ErrInvalidPurpose  = errors.New("unknown code purpose")
+)
+
+// LimitError is returned by Issue when the destination has to wait before
+// getting another code.
+type LimitError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%v, retry in %d seconds", e.Err, int(e.RetryAfter.Seconds())+1)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+var knownPurposes = map[string]bool{
+	PurposeLogin:         true,
+	PurposePhoneChange:   true,
+	PurposeEmailChange:   true,
+	PurposePasswordReset: true,
+}
+
+// RegisterPurpose allows a new purpose, with its own policy when policy is not
+// nil. It must be called during startup, before codes are issued.
+func RegisterPurpose(purpose string, policy *Policy) {
+	knownPurposes[purpose] = true
+	if policy != nil {
+		Policies[purpose] = *policy
+	}
+}
+
+func policyFor(purpose string) (Policy, error) {
+	if !knownPurposes[purpose] {
+		return Policy{}, ErrInvalidPurpose
+	}
+	if policy, ok := Policies[purpose]; ok {
+		return policy, nil
+	}
+	return DefaultPolicy, nil
+}
+
+// NormalizeDestination makes equal phone numbers and emails compare equal, so
+// limits can't be dodged by spelling a destination differently.
+func NormalizeDestination(destination string) string {
+	destination = strings.ToLower(strings.TrimSpace(destination))
+	if strings.Contains(destination, "@") {
+		return destination
+	}
+	return strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(destination)
+}
+
+// Codes are short, so a plain hash would be reversed by trying every code.
+// They are keyed with OTP_HASH_KEY.
+func codeHash(purpose, destination, code string) string {
+	mac := hmac.New(sha256.New, []byte(config.ENV.OTP_HASH_KEY))
+	mac.Write([]byte(purpose + "\n" + destination + "\n" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Issue creates a code for purpose sent to destination, replacing any earlier
+// code of that purpose. The caller delivers the code. Cooldown and daily cap
+// violations are returned as *LimitError.
+func Issue(purpose, destination string) (string, time.Time, error) {
+	policy, err := policyFor(purpose)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	destination = NormalizeDestination(destination)
+
+	code := utils.GenerateOTP(policy.Length)
+	if code == "" {
+		return "", time.Time{}, errors.New("failed to generate code")
+	}
+
+	expiresAt := time.Now().Add(policy.TTL)
+	retryAfter, err := repo.CreateOTPCode(repo.OTPCode{
+		Purpose:     purpose,
+		Destination: destination,
+		CodeHash:    codeHash(purpose, destination, code),
+		MaxAttempts: policy.MaxAttempts,
+	}, policy.TTL, policy.Cooldown, policy.DailyCap)
+	if errors.Is(err, repo.ErrOTPCooldown) || errors.Is(err, repo.ErrOTPDailyCap) {
+		return "", time.Time{}, &LimitError{Err: err, RetryAfter: retryAfter}
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return code, expiresAt, nil
+}
+
+// Verify checks a code and consumes it on success. Every call counts as an
+// attempt, and the code is dropped once its attempts are used up.
+func Verify(purpose, destination, code string) error {
+	if !knownPurposes[purpose] {
+		return ErrInvalidPurpose
+	}
+	destination = NormalizeDestination(destination)
+
+	active, err := repo.GetActiveOTPCode(purpose, destination)
+	if errors.Is(err, repo.ErrOTPNotFound) {
+		return ErrNoCode
+	}
+	if err != nil {
+		return err
+	}
+	if active.Expired {
+		return ErrExpired
+	}
+
+	counted, err := repo.RecordOTPAttempt(active.ID)
+	if err != nil {
+		return err
+	}
+	if !counted {
+		return ErrTooManyAttempts
+	}
+
+	given := codeHash(purpose, destination, strings.TrimSpace(code))
+	if !hmac.Equal([]byte(given), []byte(active.CodeHash)) {
+		return ErrInvalidCode
+	}
+
+	consumed, err := repo.ConsumeOTPCode(active.ID)
+	if err != nil {
+		return err
+	}
+	if !consumed {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// IsClientError separates wrong codes and exceeded limits from storage failures.
+func IsClientError(err error) bool {
+	var limitErr *LimitError
+	return errors.As(err, &limitErr) ||
+		errors.Is(err, ErrInvalidCode) ||
+		errors.Is(err, ErrExpired) ||
+		errors.Is(err, ErrTooManyAttempts) ||
+		errors.Is(err, ErrNoCode) ||
+		errors.Is(err, ErrInvalidPurpose)
+}
+
+var (
+	stopOnce sync.Once
+	stopCh   = make(chan struct{})
+)
+
+// Start deletes old codes every interval until Stop is called.
+func Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := repo.DeleteOldOTPCodes(); err != nil {
+					log.Printf("Failed to purge OTP codes: %v", err)
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func Stop() {
+	stopOnce.Do(func() { close(stopCh) })
+}
@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// MemoryBackend keeps buckets in process. Limits are per instance.
+type MemoryBackend struct {
+	mu          sync.Mutex
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{buckets: map[string]*bucket{}, lastCleanup: time.Now()}
+}
+
+func (m *MemoryBackend) Take(key string, limit Limit) (Result, error) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updatedAt: now}
+		m.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updatedAt).Seconds()*limit.Rate)
+	b.updatedAt = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+
+	if now.Sub(m.lastCleanup) > time.Minute {
+		m.cleanup(now)
+	}
+	return newResult(limit, b.tokens, allowed), nil
+}
+
+// cleanup drops buckets idle for long enough to have refilled completely.
+// Buckets are at most a few bytes each, so an hour of idleness is a safe bound.
+func (m *MemoryBackend) cleanup(now time.Time) {
+	for key, b := range m.buckets {
+		if now.Sub(b.updatedAt) > time.Hour {
+			delete(m.buckets, key)
+		}
+	}
+	m.lastCleanup = now
+}
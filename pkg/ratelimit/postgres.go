@@ -0,0 +1,39 @@
+package ratelimit
+
+import (
+	"log"
+	"sync"
+	"time"
+	"uneexpo/internal/repo"
+)
+
+// PostgresBackend keeps buckets in tbl_rate_limit so limits hold across every
+// API instance. Each Take is a single atomic upsert.
+type PostgresBackend struct {
+	mu          sync.Mutex
+	lastCleanup time.Time
+}
+
+func NewPostgresBackend() *PostgresBackend {
+	return &PostgresBackend{lastCleanup: time.Now()}
+}
+
+func (p *PostgresBackend) Take(key string, limit Limit) (Result, error) {
+	tokens, allowed, err := repo.TakeRateLimitToken(key, float64(limit.Burst), limit.Rate)
+	if err != nil {
+		return Result{}, err
+	}
+
+	p.mu.Lock()
+	if time.Since(p.lastCleanup) > time.Hour {
+		p.lastCleanup = time.Now()
+		go func() {
+			if err := repo.DeleteIdleRateLimits(time.Hour); err != nil {
+				log.Printf("Failed to clean up rate limit buckets: %v", err)
+			}
+		}()
+	}
+	p.mu.Unlock()
+
+	return newResult(limit, tokens, allowed), nil
+}
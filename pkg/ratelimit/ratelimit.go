@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Limit is a token bucket: Burst requests at once, refilled at Rate per second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// PerMinute allows n requests a minute with bursts of up to n.
+func PerMinute(n int) Limit {
+	return Limit{Rate: float64(n) / 60, Burst: n}
+}
+
+// Every allows n requests per period with bursts of up to n.
+func Every(n int, period time.Duration) Limit {
+	return Limit{Rate: float64(n) / period.Seconds(), Burst: n}
+}
+
+// Scale multiplies both the rate and the burst of a limit.
+func (l Limit) Scale(factor float64) Limit {
+	if factor <= 0 || factor == 1 {
+		return l
+	}
+	return Limit{Rate: l.Rate * factor, Burst: int(math.Ceil(float64(l.Burst) * factor))}
+}
+
+type Result struct {
+	Allowed bool
+	Limit   int
+	// Remaining is the number of whole tokens left in the bucket.
+	Remaining int
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is the time until the next request would be allowed, zero when allowed.
+	RetryAfter time.Duration
+}
+
+// Backend stores buckets. Take refills the bucket under key and consumes one token if there is one.
+type Backend interface {
+	Take(key string, limit Limit) (Result, error)
+}
+
+// DefaultBackend is used by limiters that do not set their own.
+var DefaultBackend Backend = NewMemoryBackend()
+
+func newResult(limit Limit, tokens float64, allowed bool) Result {
+	result := Result{
+		Allowed:   allowed,
+		Limit:     limit.Burst,
+		Remaining: int(math.Max(0, math.Floor(tokens))),
+	}
+	if limit.Rate > 0 {
+		result.Reset = secondsToDuration((float64(limit.Burst) - tokens) / limit.Rate)
+		if !allowed {
+			result.RetryAfter = secondsToDuration((1 - tokens) / limit.Rate)
+		}
+	}
+	return result
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
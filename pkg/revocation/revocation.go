@@ -0,0 +1,260 @@
+package revocation
+
+import (
+	"log"
+	"sync"
+	"time"
+	"uneexpo/config"
+	"uneexpo/internal/repo"
+	"uneexpo/pkg/utils"
+)
+
+var (
+	// SyncInterval is how often revocations made by other instances are picked up.
+	SyncInterval = 10 * time.Second
+	// PurgeInterval is how often expired revocations are deleted from the database.
+	PurgeInterval = time.Hour
+)
+
+// syncOverlap re-reads rows created shortly before the previous sync, so rows
+// committed out of order by concurrent transactions are not missed.
+const syncOverlap = 30 * time.Second
+
+type cutoff struct {
+	before    time.Time
+	expiresAt time.Time
+}
+
+// The list is kept in memory so Guard never waits on the database. Every
+// revocation is also written to tbl_token_revocation, which is how the other
+// API instances learn about it on their next sync.
+var list = struct {
+	sync.RWMutex
+	tokens    map[string]time.Time // jti -> token expiry
+	sessions  map[int]time.Time    // session id -> expiry of its last token
+	users     map[int]cutoff
+	companies map[int]cutoff
+	lastSync  time.Time
+}{
+	tokens:    map[string]time.Time{},
+	sessions:  map[int]time.Time{},
+	users:     map[int]cutoff{},
+	companies: map[int]cutoff{},
+}
+
+var (
+	stopOnce sync.Once
+	stopCh   = make(chan struct{})
+)
+
+// IsRevoked reports whether a verified access token has been revoked.
+func IsRevoked(claims *utils.Claims) bool {
+	list.RLock()
+	defer list.RUnlock()
+
+	if _, ok := list.tokens[claims.RegisteredClaims.ID]; ok {
+		return true
+	}
+	if _, ok := list.sessions[claims.SessionID]; ok && claims.SessionID != 0 {
+		return true
+	}
+
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+	if c, ok := list.users[claims.ID]; ok && issuedAt.Before(c.before) {
+		return true
+	}
+	if c, ok := list.companies[claims.CompanyID]; ok && claims.CompanyID != 0 && issuedAt.Before(c.before) {
+		return true
+	}
+	return false
+}
+
+// IsCompanyRevoked reports whether the access of a company has been revoked
+// recently. API keys, which have no issue time, are checked this way.
+func IsCompanyRevoked(companyID int) bool {
+	list.RLock()
+	defer list.RUnlock()
+
+	_, ok := list.companies[companyID]
+	return ok
+}
+
+// IsUserRevoked reports whether the access of a user has been revoked
+// recently, for API keys the user created.
+func IsUserRevoked(userID int) bool {
+	list.RLock()
+	defer list.RUnlock()
+
+	_, ok := list.users[userID]
+	return ok
+}
+
+// RevokeToken revokes a single access token until it expires, e.g. on logout.
+func RevokeToken(claims *utils.Claims, reason string) error {
+	if claims.RegisteredClaims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+	return revoke(repo.TokenRevocation{
+		Kind:      repo.RevocationKindToken,
+		Jti:       claims.RegisteredClaims.ID,
+		SubjectID: claims.ID,
+		Reason:    reason,
+		ExpiresAt: claims.ExpiresAt.Time,
+	})
+}
+
+// RevokeSession revokes every access token of a session revoked in
+// tbl_sessions. A revoked session issues no new tokens, so the revocation
+// only has to outlive the ones it issued already.
+func RevokeSession(sessionID int, reason string) error {
+	if sessionID == 0 {
+		return nil
+	}
+	return revoke(repo.TokenRevocation{
+		Kind:      repo.RevocationKindSession,
+		SubjectID: sessionID,
+		Reason:    reason,
+		ExpiresAt: time.Now().Add(config.ENV.ACCESS_TIME),
+	})
+}
+
+// RevokeUser revokes every access token issued to the user so far, e.g. after a password change.
+func RevokeUser(userID int, reason string) error {
+	return revokeSubject(repo.RevocationKindUser, userID, reason)
+}
+
+// RevokeCompany revokes every access token issued to users of the company so far, e.g. on a ban.
+func RevokeCompany(companyID int, reason string) error {
+	return revokeSubject(repo.RevocationKindCompany, companyID, reason)
+}
+
+// Tokens carry whole-second iat values, so the cutoff is rounded down: a
+// token issued in the same second as the revocation stays valid. This keeps
+// the token a client fetches right after changing its password usable.
+func revokeSubject(kind string, subjectID int, reason string) error {
+	before := time.Now().Truncate(time.Second)
+	return revoke(repo.TokenRevocation{
+		Kind:          kind,
+		SubjectID:     subjectID,
+		RevokedBefore: &before,
+		Reason:        reason,
+		ExpiresAt:     before.Add(config.ENV.ACCESS_TIME),
+	})
+}
+
+func revoke(r repo.TokenRevocation) error {
+	if _, err := repo.CreateTokenRevocation(r); err != nil {
+		return err
+	}
+
+	list.Lock()
+	apply(r)
+	list.Unlock()
+	return nil
+}
+
+// apply adds a revocation to the in-memory list. Callers hold the write lock.
+func apply(r repo.TokenRevocation) {
+	switch r.Kind {
+	case repo.RevocationKindToken:
+		list.tokens[r.Jti] = r.ExpiresAt
+	case repo.RevocationKindSession:
+		list.sessions[r.SubjectID] = r.ExpiresAt
+	case repo.RevocationKindUser:
+		applyCutoff(list.users, r)
+	case repo.RevocationKindCompany:
+		applyCutoff(list.companies, r)
+	}
+}
+
+func applyCutoff(cutoffs map[int]cutoff, r repo.TokenRevocation) {
+	if r.RevokedBefore == nil {
+		return
+	}
+	current, ok := cutoffs[r.SubjectID]
+	if ok && !r.RevokedBefore.After(current.before) {
+		return
+	}
+	cutoffs[r.SubjectID] = cutoff{before: *r.RevokedBefore, expiresAt: r.ExpiresAt}
+}
+
+func syncList() error {
+	list.RLock()
+	since := list.lastSync
+	list.RUnlock()
+	if !since.IsZero() {
+		since = since.Add(-syncOverlap)
+	}
+
+	startedAt := time.Now()
+	revocations, err := repo.GetTokenRevocationsSince(since)
+	if err != nil {
+		return err
+	}
+
+	list.Lock()
+	defer list.Unlock()
+
+	for _, r := range revocations {
+		apply(r)
+	}
+	list.lastSync = startedAt
+
+	now := time.Now()
+	for jti, expiresAt := range list.tokens {
+		if now.After(expiresAt) {
+			delete(list.tokens, jti)
+		}
+	}
+	for id, expiresAt := range list.sessions {
+		if now.After(expiresAt) {
+			delete(list.sessions, id)
+		}
+	}
+	for _, cutoffs := range []map[int]cutoff{list.users, list.companies} {
+		for id, c := range cutoffs {
+			if now.After(c.expiresAt) {
+				delete(cutoffs, id)
+			}
+		}
+	}
+	return nil
+}
+
+// Start loads the unexpired revocations and keeps the list in sync with the
+// database until Stop is called.
+func Start() error {
+	if err := syncList(); err != nil {
+		return err
+	}
+
+	go func() {
+		syncTicker := time.NewTicker(SyncInterval)
+		purgeTicker := time.NewTicker(PurgeInterval)
+		defer syncTicker.Stop()
+		defer purgeTicker.Stop()
+
+		for {
+			select {
+			case <-syncTicker.C:
+				if err := syncList(); err != nil {
+					log.Printf("Failed to sync token revocations: %v", err)
+				}
+			case <-purgeTicker.C:
+				if err := repo.DeleteExpiredTokenRevocations(); err != nil {
+					log.Printf("Failed to purge token revocations: %v", err)
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func Stop() {
+	stopOnce.Do(func() { close(stopCh) })
+}
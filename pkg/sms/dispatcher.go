@@ -0,0 +1,143 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"uneexpo/internal/repo"
+)
+
+var ErrAllProvidersFailed = errors.New("every SMS provider failed")
+
+type provider struct {
+	sender  SMSSender
+	breaker *Breaker
+}
+
+// Dispatcher sends through its providers in order: each one is retried with
+// exponential backoff, skipped while its circuit breaker is open, and the
+// next one takes over when it gives up. Every attempt is recorded in
+// tbl_sms_delivery.
+type Dispatcher struct {
+	providers []provider
+
+	Attempts int
+	Backoff  time.Duration
+	// ProviderTimeout caps the time spent on one provider, attempts and
+	// backoff included. With a deadline on the context, each provider also
+	// gets at most an even share of the time left, so the ones after it
+	// still get a turn.
+	ProviderTimeout time.Duration
+	// Record stores a delivery attempt, repo.CreateSMSDelivery by default.
+	Record func(repo.SMSDelivery) error
+}
+
+// NewDispatcher returns a dispatcher over senders, primary first.
+func NewDispatcher(senders ...SMSSender) *Dispatcher {
+	d := &Dispatcher{Attempts: 3, Backoff: 500 * time.Millisecond, ProviderTimeout: 10 * time.Second, Record: repo.CreateSMSDelivery}
+	for _, sender := range senders {
+		d.providers = append(d.providers, provider{sender: sender, breaker: NewBreaker(5, time.Minute)})
+	}
+	return d
+}
+
+func (d *Dispatcher) Name() string {
+	names := make([]string, 0, len(d.providers))
+	for _, p := range d.providers {
+		names = append(names, p.sender.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+func (d *Dispatcher) Send(ctx context.Context, msg Message) error {
+	var errs []error
+	for i, p := range d.providers {
+		providerCtx, cancel := d.providerContext(ctx, len(d.providers)-i)
+		err := d.sendWith(providerCtx, p, msg)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", p.sender.Name(), err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return fmt.Errorf("%w: %w", ErrAllProvidersFailed, errors.Join(errs...))
+}
+
+// providerContext bounds the time of the next of left providers.
+func (d *Dispatcher) providerContext(ctx context.Context, left int) (context.Context, context.CancelFunc) {
+	budget := d.ProviderTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if share := time.Until(deadline) / time.Duration(left); budget <= 0 || share < budget {
+			budget = share
+		}
+	}
+	if budget <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, budget)
+}
+
+func (d *Dispatcher) sendWith(ctx context.Context, p provider, msg Message) error {
+	backoff := d.Backoff
+	var err error
+	for attempt := 1; attempt <= d.Attempts; attempt++ {
+		if !p.breaker.Allow() {
+			d.record(p, msg, attempt, repo.SMSStatusSkipped, errors.New("circuit open"), 0)
+			return errors.New("circuit open")
+		}
+
+		startedAt := time.Now()
+		err = p.sender.Send(ctx, msg)
+		elapsed := time.Since(startedAt)
+		if err == nil {
+			p.breaker.Success()
+			d.record(p, msg, attempt, repo.SMSStatusSent, nil, elapsed)
+			return nil
+		}
+		d.record(p, msg, attempt, repo.SMSStatusFailed, err, elapsed)
+
+		// A rejected message says nothing about the health of the provider
+		var permanent *PermanentError
+		if errors.As(err, &permanent) {
+			p.breaker.Success()
+			return err
+		}
+		p.breaker.Failure()
+
+		if attempt == d.Attempts {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+func (d *Dispatcher) record(p provider, msg Message, attempt int, status string, err error, elapsed time.Duration) {
+	if d.Record == nil {
+		return
+	}
+	delivery := repo.SMSDelivery{
+		Provider:   p.sender.Name(),
+		Phone:      msg.Phone,
+		Attempt:    attempt,
+		Status:     status,
+		DurationMs: int(elapsed.Milliseconds()),
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	if err := d.Record(delivery); err != nil {
+		log.Printf("Failed to record SMS delivery: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubSender fails every message with err, or blocks until the context is
+// done when err is nil.
+type stubSender struct {
+	err   error
+	calls atomic.Int32
+}
+
+func (s *stubSender) Name() string { return "stub" }
+
+func (s *stubSender) Send(ctx context.Context, msg Message) error {
+	s.calls.Add(1)
+	if s.err != nil {
+		return s.err
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func newTestDispatcher(t *testing.T, primary SMSSender) (*Dispatcher, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sms.log")
+	d := NewDispatcher(primary, NewFakeSender(path))
+	d.Backoff = time.Millisecond
+	d.Record = nil
+	return d, path
+}
+
+func delivered(t *testing.T, path, code string) bool {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Contains(string(data), "code="+code)
+}
+
+func TestDispatcherFailsOver(t *testing.T) {
+	primary := &stubSender{err: errors.New("gateway down")}
+	d, path := newTestDispatcher(t, primary)
+
+	if err := d.Send(context.Background(), Message{Phone: "+99361000000", Code: "123456"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := primary.calls.Load(); got != int32(d.Attempts) {
+		t.Errorf("primary tried %d times, want %d", got, d.Attempts)
+	}
+	if !delivered(t, path, "123456") {
+		t.Error("fallback did not send the code")
+	}
+}
+
+func TestDispatcherDoesNotRetryPermanentErrors(t *testing.T) {
+	primary := &stubSender{err: &PermanentError{Err: errors.New("invalid number")}}
+	d, path := newTestDispatcher(t, primary)
+
+	if err := d.Send(context.Background(), Message{Phone: "+99361000000", Code: "654321"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := primary.calls.Load(); got != 1 {
+		t.Errorf("primary tried %d times, want 1", got)
+	}
+	if !delivered(t, path, "654321") {
+		t.Error("fallback did not send the code")
+	}
+}
+
+func TestDispatcherLeavesTimeForFallback(t *testing.T) {
+	primary := &stubSender{}
+	d, path := newTestDispatcher(t, primary)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+
+	if err := d.Send(ctx, Message{Phone: "+99361000000", Code: "111222"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if !delivered(t, path, "111222") {
+		t.Error("fallback did not send the code")
+	}
+}
+
+func TestDispatcherCapsTimePerProvider(t *testing.T) {
+	primary := &stubSender{}
+	d, path := newTestDispatcher(t, primary)
+	d.ProviderTimeout = 50 * time.Millisecond
+
+	startedAt := time.Now()
+	if err := d.Send(context.Background(), Message{Phone: "+99361000000", Code: "333444"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if elapsed := time.Since(startedAt); elapsed > time.Second {
+		t.Errorf("Send took %v, want the primary cut off after %v", elapsed, d.ProviderTimeout)
+	}
+	if !delivered(t, path, "333444") {
+		t.Error("fallback did not send the code")
+	}
+}
+
+func TestDispatcherReportsEveryProvider(t *testing.T) {
+	d := NewDispatcher(&stubSender{err: errors.New("gateway down")}, &stubSender{err: errors.New("fallback down")})
+	d.Backoff = time.Millisecond
+	d.Record = nil
+
+	err := d.Send(context.Background(), Message{Phone: "+99361000000", Code: "000000"})
+	if !errors.Is(err, ErrAllProvidersFailed) {
+		t.Fatalf("Send error = %v, want ErrAllProvidersFailed", err)
+	}
+	for _, want := range []string{"gateway down", "fallback down"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
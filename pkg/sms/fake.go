@@ -0,0 +1,48 @@
+package sms
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// FakeSender sends nothing: messages are appended to a file, or logged when
+// no path is set, so codes can be read without a gateway.
+type FakeSender struct {
+	Path   string
+	Format OTPFormat
+
+	mu sync.Mutex
+}
+
+func NewFakeSender(path string) *FakeSender {
+	return &FakeSender{Path: path, Format: OTPFormat{AppName: "uneexpo"}}
+}
+
+func (f *FakeSender) Name() string {
+	return "fake"
+}
+
+func (f *FakeSender) Send(ctx context.Context, msg Message) error {
+	line := fmt.Sprintf("%s to=%s code=%s text=%q",
+		time.Now().Format(time.RFC3339), msg.Phone, msg.Code, f.Format.Render(msg))
+
+	if f.Path == "" {
+		log.Printf("[sms] %s", line)
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(line + "\n")
+	return err
+}
@@ -0,0 +1,67 @@
+package sms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// GatewaySender posts {"code", "phoneNumber"} JSON to an HTTP SMS gateway,
+// the protocol of the in-house gateway at OTP_SERVICE_ROUTE.
+type GatewaySender struct {
+	ProviderName string
+	URL          string
+	Format       OTPFormat
+	Client       *http.Client
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+func NewGatewaySender(name, url string, format OTPFormat) *GatewaySender {
+	return &GatewaySender{ProviderName: name, URL: url, Format: format, Client: defaultClient}
+}
+
+func (g *GatewaySender) Name() string {
+	return g.ProviderName
+}
+
+func (g *GatewaySender) Send(ctx context.Context, msg Message) error {
+	jsonBody, err := json.Marshal(map[string]string{
+		"code":        g.Format.Render(msg),
+		"phoneNumber": msg.Phone,
+	})
+	if err != nil {
+		return &PermanentError{Err: fmt.Errorf("failed to marshal JSON: %w", err)}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.URL, bytes.NewReader(jsonBody))
+	if err != nil {
+		return &PermanentError{Err: fmt.Errorf("failed to create request: %w", err)}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send SMS request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	err = fmt.Errorf("SMS service responded with status: %d", resp.StatusCode)
+	if body, _ := io.ReadAll(io.LimitReader(resp.Body, 512)); len(bytes.TrimSpace(body)) > 0 {
+		err = fmt.Errorf("%w: %s", err, bytes.TrimSpace(body))
+	}
+	// Other 4xx mean the request itself is wrong and would fail again
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusRequestTimeout {
+		return &PermanentError{Err: err}
+	}
+	return err
+}
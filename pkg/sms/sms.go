@@ -0,0 +1,78 @@
+package sms
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Message is one SMS. OTP messages set Code and are formatted by each
+// provider, since the text and the Android hash differ between providers.
+type Message struct {
+	Phone string
+	// Text is sent as is when Code is empty.
+	Text string
+	Code string
+	// Firmware is the device platform; "android" appends the SMS Retriever hash.
+	Firmware string
+}
+
+// SMSSender delivers messages through one provider.
+type SMSSender interface {
+	Name() string
+	Send(ctx context.Context, msg Message) error
+}
+
+// OTPFormat is how a provider words OTP messages.
+type OTPFormat struct {
+	// Prefix is prepended to every message, e.g. a sender tag the gateway requires.
+	Prefix  string
+	AppName string
+	// AndroidHash is the 11-character app hash the SMS Retriever API matches on.
+	AndroidHash string
+}
+
+// Render returns the text to send for msg.
+func (f OTPFormat) Render(msg Message) string {
+	if msg.Code == "" {
+		return f.Prefix + msg.Text
+	}
+
+	text := fmt.Sprintf("%s\n%s", msg.Code, f.AppName)
+	if strings.EqualFold(msg.Firmware, "android") && f.AndroidHash != "" {
+		text = fmt.Sprintf("%s\n%s: %s", msg.Code, f.AppName, f.AndroidHash)
+	}
+	return f.Prefix + text
+}
+
+// PermanentError marks a failure retrying can't fix, such as an invalid
+// number, so the dispatcher moves on without retrying.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Default is the sender used by SendOTP, set up in main.
+var Default SMSSender = NewFakeSender("")
+
+// SendOTP sends an OTP through Default, which handles retries, failover and
+// the Android SMS Retriever hash of each provider. It replaces
+// utils.SendOTPSMS.
+func SendOTP(phoneNumber, code, firmware string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return Default.Send(ctx, Message{
+		Phone:    phoneNumber,
+		Code:     code,
+		Firmware: firmware,
+	})
+}
@@ -0,0 +1,249 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// conn is an authenticated connection to the SMTP server.
+type conn struct {
+	client   *smtp.Client
+	netConn  net.Conn
+	lastUsed time.Time
+}
+
+// getConn takes a kept connection that is still alive, or dials a new one.
+func (c *SMTPConfig) getConn(ctx context.Context) (*conn, bool, error) {
+	for {
+		c.mu.Lock()
+		if len(c.idle) == 0 {
+			c.mu.Unlock()
+			break
+		}
+		cn := c.idle[len(c.idle)-1]
+		c.idle = c.idle[:len(c.idle)-1]
+		c.mu.Unlock()
+
+		if c.IdleTimeout > 0 && time.Since(cn.lastUsed) > c.IdleTimeout {
+			cn.quit()
+			continue
+		}
+		return cn, true, nil
+	}
+
+	cn, err := c.dial(ctx)
+	return cn, false, err
+}
+
+// putConn keeps the connection for the next message unless it broke or the
+// pool is full. A rejection by the server leaves the connection usable.
+func (c *SMTPConfig) putConn(cn *conn, err error) {
+	if err != nil && !isReply(err) {
+		cn.close()
+		return
+	}
+
+	cn.lastUsed = time.Now()
+	c.mu.Lock()
+	if len(c.idle) < c.MaxIdleConns {
+		c.idle = append(c.idle, cn)
+		cn = nil
+	}
+	c.mu.Unlock()
+
+	if cn != nil {
+		cn.quit()
+	}
+}
+
+func (c *SMTPConfig) dial(ctx context.Context) (*conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+
+	addr := net.JoinHostPort(c.SMTPHost, c.SMTPPort)
+	dialer := &net.Dialer{}
+	var netConn net.Conn
+	var err error
+	if c.Security == SecurityTLS {
+		netConn, err = (&tls.Dialer{NetDialer: dialer, Config: c.tlsConfig()}).DialContext(ctx, "tcp", addr)
+	} else {
+		netConn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	netConn.SetDeadline(deadline)
+
+	cn := &conn{netConn: netConn}
+	if err := c.handshake(cn); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	netConn.SetDeadline(time.Time{})
+	return cn, nil
+}
+
+// handshake greets the server, upgrades to TLS as Security says and logs in.
+func (c *SMTPConfig) handshake(cn *conn) error {
+	client, err := smtp.NewClient(cn.netConn, c.SMTPHost)
+	if err != nil {
+		return err
+	}
+	cn.client = client
+
+	if c.HeloName != "" {
+		if err := client.Hello(c.HeloName); err != nil {
+			return err
+		}
+	}
+
+	if c.Security == SecurityStartTLS || c.Security == SecurityStartTLSOptional {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(c.tlsConfig()); err != nil {
+				return err
+			}
+		} else if c.Security == SecurityStartTLS {
+			return errors.New("server does not support STARTTLS")
+		}
+	}
+
+	if c.Password == "" {
+		return nil
+	}
+	if ok, _ := client.Extension("AUTH"); !ok {
+		return errors.New("server does not support authentication")
+	}
+	auth, err := c.auth()
+	if err != nil {
+		return err
+	}
+	return client.Auth(auth)
+}
+
+func (c *SMTPConfig) auth() (smtp.Auth, error) {
+	username := c.Username
+	if username == "" {
+		username = c.SenderEmail
+	}
+
+	switch strings.ToLower(c.AuthMechanism) {
+	case "", "plain":
+		return smtp.PlainAuth("", username, c.Password, c.SMTPHost), nil
+	case "login":
+		return &loginAuth{username: username, password: c.Password, host: c.SMTPHost}, nil
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(username, c.Password), nil
+	}
+	return nil, fmt.Errorf("unknown SMTP auth mechanism %q", c.AuthMechanism)
+}
+
+func (c *SMTPConfig) tlsConfig() *tls.Config {
+	if c.TLSConfig != nil {
+		return c.TLSConfig
+	}
+	return &tls.Config{ServerName: c.SMTPHost, MinVersion: tls.VersionTLS12}
+}
+
+// send delivers one message. Unlike smtp.Client.Data, it returns the reply
+// of the server to the message.
+func (cn *conn) send(ctx context.Context, timeout time.Duration, from string, to []string, data []byte) (string, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(timeout)
+	}
+	cn.netConn.SetDeadline(deadline)
+	defer cn.netConn.SetDeadline(time.Time{})
+
+	if err := cn.client.Mail(from); err != nil {
+		cn.client.Reset()
+		return "", err
+	}
+	for _, recipient := range to {
+		if err := cn.client.Rcpt(recipient); err != nil {
+			cn.client.Reset()
+			return "", err
+		}
+	}
+
+	text := cn.client.Text
+	id, err := text.Cmd("DATA")
+	if err != nil {
+		return "", err
+	}
+	text.StartResponse(id)
+	_, _, err = text.ReadResponse(354)
+	text.EndResponse(id)
+	if err != nil {
+		cn.client.Reset()
+		return "", err
+	}
+
+	w := text.DotWriter()
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	code, message, err := text.ReadResponse(250)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d %s", code, message), nil
+}
+
+func (cn *conn) quit() {
+	cn.netConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := cn.client.Quit(); err != nil {
+		cn.close()
+	}
+}
+
+func (cn *conn) close() {
+	cn.client.Close()
+}
+
+// isReply reports whether err is an SMTP reply rather than a broken connection.
+func isReply(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr)
+}
+
+// loginAuth implements the LOGIN mechanism that some servers, e.g. Office 365,
+// offer instead of PLAIN.
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Like smtp.PlainAuth, never send the password in the clear to a remote host
+	if !server.TLS && a.host != "localhost" && a.host != "127.0.0.1" && a.host != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch prompt := strings.ToLower(strings.TrimSpace(string(fromServer))); {
+	case strings.HasPrefix(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "password"):
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN prompt %q", fromServer)
+}
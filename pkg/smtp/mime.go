@@ -0,0 +1,222 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+	"uneexpo/pkg/mailer"
+	"unicode/utf8"
+)
+
+// BuildMessage formats msg as an RFC 5322 message: a multipart/alternative
+// of the text and HTML bodies, wrapped in multipart/mixed with the
+// attachments if there are any. BCC recipients are left out of the headers.
+func BuildMessage(from mail.Address, msg mailer.Message) ([]byte, error) {
+	to, err := formatAddressList(msg.To)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := formatAddressList(msg.CC)
+	if err != nil {
+		return nil, err
+	}
+	messageID, err := newMessageID(from.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	writeHeader(&buf, "From", from.String())
+	writeHeader(&buf, "To", to)
+	if cc != "" {
+		writeHeader(&buf, "Cc", cc)
+	}
+	if msg.ReplyTo != "" {
+		replyTo, err := formatAddressList([]string{msg.ReplyTo})
+		if err != nil {
+			return nil, err
+		}
+		writeHeader(&buf, "Reply-To", replyTo)
+	}
+	writeHeader(&buf, "Subject", encodeHeader(msg.Subject))
+	writeHeader(&buf, "Date", time.Now().Format(time.RFC1123Z))
+	writeHeader(&buf, "Message-ID", messageID)
+	writeHeader(&buf, "MIME-Version", "1.0")
+
+	w := multipart.NewWriter(&buf)
+	if len(msg.Attachments) == 0 {
+		writeHeader(&buf, "Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": w.Boundary()}))
+		buf.WriteString("\r\n")
+		if err := writeBodies(w, msg); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	writeHeader(&buf, "Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": w.Boundary()}))
+	buf.WriteString("\r\n")
+
+	boundary, err := newBoundary()
+	if err != nil {
+		return nil, err
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": boundary}))
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	alternative := multipart.NewWriter(part)
+	if err := alternative.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+	if err := writeBodies(alternative, msg); err != nil {
+		return nil, err
+	}
+	if err := alternative.Close(); err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range msg.Attachments {
+		if err := writeAttachment(w, attachment); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeBodies writes the plain-text body first so clients prefer the HTML one.
+func writeBodies(w *multipart.Writer, msg mailer.Message) error {
+	bodies := []struct{ contentType, body string }{
+		{"text/plain", msg.Text},
+		{"text/html", msg.HTML},
+	}
+	for _, b := range bodies {
+		if b.body == "" {
+			continue
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", b.contentType+"; charset=UTF-8")
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		part, err := w.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		qp := quotedprintable.NewWriter(part)
+		if _, err := qp.Write([]byte(b.body)); err != nil {
+			return err
+		}
+		if err := qp.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeAttachment(w *multipart.Writer, attachment mailer.Attachment) error {
+	filename := filepath.Base(attachment.Filename)
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(filename))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// FormatMediaType encodes non-ASCII file names as RFC 2231 parameters
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"name": filename}))
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	header.Set("Content-Transfer-Encoding", "base64")
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	// Base64 lines may not be longer than 76 characters
+	encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+	for len(encoded) > 76 {
+		if _, err := fmt.Fprintf(part, "%s\r\n", encoded[:76]); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = fmt.Fprintf(part, "%s\r\n", encoded)
+	return err
+}
+
+func writeHeader(buf *bytes.Buffer, name, value string) {
+	fmt.Fprintf(buf, "%s: %s\r\n", name, value)
+}
+
+func formatAddressList(addresses []string) (string, error) {
+	formatted := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		parsed, err := mail.ParseAddress(address)
+		if err != nil {
+			return "", fmt.Errorf("invalid email address %q: %w", address, err)
+		}
+		formatted = append(formatted, parsed.String())
+	}
+	return strings.Join(formatted, ",\r\n "), nil
+}
+
+// encodeHeader encodes non-ASCII text as RFC 2047 encoded words, folded onto
+// separate lines so none exceeds the line length limit. Base64 is shorter
+// than quoted-printable for mostly non-Latin text such as Russian.
+func encodeHeader(value string) string {
+	// Line breaks would let the value inject headers
+	value = strings.NewReplacer("\r", "", "\n", " ").Replace(value)
+
+	nonASCII := 0
+	for _, r := range value {
+		if r >= utf8.RuneSelf {
+			nonASCII++
+		}
+	}
+	if nonASCII == 0 {
+		return value
+	}
+
+	encoder := mime.QEncoding
+	if nonASCII*3 > utf8.RuneCountInString(value) {
+		encoder = mime.BEncoding
+	}
+	return strings.ReplaceAll(encoder.Encode("UTF-8", value), "?= =?", "?=\r\n =?")
+}
+
+func newMessageID(sender string) (string, error) {
+	random, err := newBoundary()
+	if err != nil {
+		return "", err
+	}
+	domain := "localhost"
+	if at := strings.LastIndexByte(sender, '@'); at >= 0 {
+		domain = sender[at+1:]
+	}
+	return fmt.Sprintf("<%s@%s>", random, domain), nil
+}
+
+func newBoundary() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
@@ -0,0 +1,149 @@
+package smtp
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"uneexpo/pkg/mailer"
+)
+
+var testSender = mail.Address{Name: "Uneexpo", Address: "noreply@example.com"}
+
+func parseMessage(t *testing.T, data []byte) *mail.Message {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("message does not parse: %v\n%s", err, data)
+	}
+	return msg
+}
+
+func TestBuildMessageLeavesOutBCC(t *testing.T) {
+	data, err := BuildMessage(testSender, mailer.Message{
+		To:      []string{"to@example.com"},
+		CC:      []string{"cc@example.com"},
+		BCC:     []string{"hidden@example.com"},
+		Subject: "Hello",
+		Text:    "Hi",
+		HTML:    "<p>Hi</p>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := parseMessage(t, data)
+	if got := msg.Header.Get("To"); got != "<to@example.com>" {
+		t.Errorf("To = %q", got)
+	}
+	if got := msg.Header.Get("Cc"); got != "<cc@example.com>" {
+		t.Errorf("Cc = %q", got)
+	}
+	if _, ok := msg.Header["Bcc"]; ok {
+		t.Error("Bcc header is sent")
+	}
+	if bytes.Contains(data, []byte("hidden@example.com")) {
+		t.Error("BCC recipient appears in the message")
+	}
+}
+
+func TestBuildMessageEncodesSubject(t *testing.T) {
+	subject := "Код подтверждения для входа в приложение Uneexpo, действует пять минут"
+	data, err := BuildMessage(testSender, mailer.Message{
+		To:      []string{"to@example.com"},
+		Subject: subject,
+		Text:    "Код: 123456",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, _, _ := bytes.Cut(data, []byte("\r\n\r\n"))
+	for _, r := range string(header) {
+		if r > 127 {
+			t.Fatalf("header is not ASCII:\n%s", header)
+		}
+	}
+	// RFC 2047 limits an encoded word to 75 characters, one per folded line
+	words := 0
+	for _, word := range strings.Fields(string(header)) {
+		if strings.HasPrefix(word, "=?") {
+			words++
+			if len(word) > 75 {
+				t.Errorf("encoded word longer than 75 characters: %q", word)
+			}
+		}
+	}
+	if words < 2 {
+		t.Errorf("long subject is not split into encoded words:\n%s", header)
+	}
+
+	decoded, err := new(mime.WordDecoder).DecodeHeader(parseMessage(t, data).Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != subject {
+		t.Errorf("Subject decodes to %q, want %q", decoded, subject)
+	}
+}
+
+func TestEncodeHeader(t *testing.T) {
+	tests := []struct {
+		name, value, want string
+	}{
+		{"ascii is kept", "Your code", "Your code"},
+		{"line breaks are removed", "Hi\r\nBcc: evil@example.com", "Hi Bcc: evil@example.com"},
+		{"latin uses Q", "Café", "=?UTF-8?q?Caf=C3=A9?="},
+		{"cyrillic uses B", "Код", "=?UTF-8?b?0JrQvtC0?="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encodeHeader(tt.value); got != tt.want {
+				t.Errorf("encodeHeader(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildMessageAttachments(t *testing.T) {
+	data, err := BuildMessage(testSender, mailer.Message{
+		To:      []string{"to@example.com"},
+		Subject: "Invoice",
+		Text:    "Attached",
+		Attachments: []mailer.Attachment{
+			{Filename: "счёт.pdf", Data: []byte("%PDF-1.4")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := parseMessage(t, data)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type = %q, %v", msg.Header.Get("Content-Type"), err)
+	}
+
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	if _, err := reader.NextPart(); err != nil {
+		t.Fatalf("missing body part: %v", err)
+	}
+	part, err := reader.NextPart()
+	if err != nil {
+		t.Fatalf("missing attachment: %v", err)
+	}
+	if got := part.FileName(); got != "счёт.pdf" {
+		t.Errorf("attachment name = %q", got)
+	}
+	if got := part.Header.Get("Content-Type"); !strings.HasPrefix(got, "application/pdf") {
+		t.Errorf("attachment Content-Type = %q", got)
+	}
+	// multipart.Part does not decode base64 itself
+	body, _ := io.ReadAll(part)
+	if got := strings.TrimSpace(string(body)); got != "JVBERi0xLjQ=" {
+		t.Errorf("attachment body = %q", got)
+	}
+}
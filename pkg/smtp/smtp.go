@@ -1,78 +1,167 @@
 package smtp
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
-	"net/smtp"
-	"text/template"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+	"uneexpo/pkg/mailer"
 )
 
+// Security is how the connection to the SMTP server is encrypted.
+type Security string
+
+const (
+	// SecurityStartTLS upgrades a plain connection and fails if the server can't.
+	SecurityStartTLS Security = "starttls"
+	// SecurityStartTLSOptional upgrades a plain connection when the server offers it.
+	SecurityStartTLSOptional Security = "starttls_optional"
+	// SecurityTLS connects over TLS from the start, usually on port 465.
+	SecurityTLS Security = "tls"
+	// SecurityNone never encrypts, e.g. for a local SMTP sink in development.
+	SecurityNone Security = "none"
+)
+
+// ParseSecurity reads an SMTP_SECURITY value. Empty picks implicit TLS on
+// port 465 and mandatory STARTTLS on any other port.
+func ParseSecurity(value, port string) (Security, error) {
+	switch security := Security(strings.ToLower(strings.TrimSpace(value))); security {
+	case "":
+		if port == "465" {
+			return SecurityTLS, nil
+		}
+		return SecurityStartTLS, nil
+	case SecurityStartTLS, SecurityStartTLSOptional, SecurityTLS, SecurityNone:
+		return security, nil
+	}
+	return "", fmt.Errorf("unknown SMTP security %q", value)
+}
+
 type SMTPConfig struct {
 	SMTPHost    string
 	SMTPPort    string
 	SenderEmail string
 	Password    string
 	LogoURL     string
+
+	// Username defaults to SenderEmail. No Password skips authentication.
+	Username string
+	// AuthMechanism is "plain" (default), "login" or "cram-md5".
+	AuthMechanism string
+	Security      Security
+	// TLSConfig overrides the defaults used for TLS and STARTTLS.
+	TLSConfig *tls.Config
+	// HeloName is the name sent in EHLO, "localhost" when empty.
+	HeloName string
+
+	// SenderName is shown next to SenderEmail in the From header.
+	SenderName string
+	// ReplyTo applies to messages that don't set their own.
+	ReplyTo string
+
+	// MaxIdleConns is how many connections are kept open between messages.
+	MaxIdleConns int
+	// IdleTimeout closes kept connections before the server drops them.
+	IdleTimeout time.Duration
+	// Timeout limits sending one message when the context has no deadline.
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	idle []*conn
 }
 
 var DefaultConfig = &SMTPConfig{
-	SMTPHost:    "smtp.gmail.com",
-	SMTPPort:    "587",
-	SenderEmail: "your-email@gmail.com",
-	Password:    "your-app-password",
-	LogoURL:     "https://app-logo-url",
+	SMTPHost:     "smtp.gmail.com",
+	SMTPPort:     "587",
+	SenderEmail:  "your-email@gmail.com",
+	Password:     "your-app-password",
+	LogoURL:      "https://app-logo-url",
+	Security:     SecurityStartTLS,
+	MaxIdleConns: 2,
+	IdleTimeout:  30 * time.Second,
+	Timeout:      time.Minute,
 }
 
-type EmailData struct {
-	Title       string
-	Description string
-	OTP         string
-	Link        string
-	LogoURL     string
-}
+// OTPExpiryMinutes is the validity shown in emails sent by SendOTPEmail.
+var OTPExpiryMinutes = 5
 
 func SendOTPEmail(recipient, otp string) error {
+	return mailer.Send(context.Background(), mailer.Email{
+		To:       recipient,
+		Template: mailer.TemplateOTP,
+		Data:     mailer.EmailData{OTP: otp, ExpiresInMinutes: OTPExpiryMinutes},
+	})
+}
 
-	Title := "Your OTP Code"
-	Description := "Please use the following code to complete your login."
+// SendNewLoginEmail warns the account owner about a login from an unknown device.
+func SendNewLoginEmail(recipient, deviceDescription string) error {
+	return mailer.Send(context.Background(), mailer.Email{
+		To:       recipient,
+		Template: mailer.TemplateNewLogin,
+		Data:     mailer.EmailData{Device: deviceDescription},
+	})
+}
 
-	emailData := EmailData{
-		Title:       Title,
-		Description: Description,
-		OTP:         otp,
-		LogoURL:     DefaultConfig.LogoURL,
-	}
+// Send implements mailer.Transport.
+func (c *SMTPConfig) Send(ctx context.Context, msg mailer.Message) error {
+	_, err := c.SendWithResponse(ctx, msg)
+	return err
+}
 
-	emailBody, err := parseTemplate("assets/email_template.html", emailData)
+// SendWithResponse implements mailer.ResponseTransport, returning the reply
+// of the server to the message, which usually holds its queue id.
+func (c *SMTPConfig) SendWithResponse(ctx context.Context, msg mailer.Message) (string, error) {
+	if msg.ReplyTo == "" {
+		msg.ReplyTo = c.ReplyTo
+	}
+	from := mail.Address{Name: c.SenderName, Address: c.SenderEmail}
+	data, err := BuildMessage(from, msg)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	from := DefaultConfig.SenderEmail
-	to := []string{recipient}
-	subject := "Your OTP Code"
-	msg := []byte(fmt.Sprintf("To: %s\r\nSubject: %s\r\nMIME-version: 1.0;\r\nContent-Type: text/html; charset=\"UTF-8\";\r\n\r\n%s", recipient, subject, emailBody))
+	recipients := msg.Recipients()
+	for attempt := 0; ; attempt++ {
+		cn, reused, err := c.getConn(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to connect to SMTP server: %w", err)
+		}
 
-	auth := smtp.PlainAuth("", DefaultConfig.SenderEmail, DefaultConfig.Password, DefaultConfig.SMTPHost)
+		response, err := cn.send(ctx, c.timeout(), c.SenderEmail, recipients, data)
+		if err != nil && reused && attempt == 0 && !isReply(err) {
+			// The server may have dropped the kept connection without us noticing
+			cn.close()
+			continue
+		}
+		c.putConn(cn, err)
+		if err != nil {
+			return "", fmt.Errorf("failed to send email: %w", err)
+		}
 
-	err = smtp.SendMail(DefaultConfig.SMTPHost+":"+DefaultConfig.SMTPPort, auth, from, to, msg)
-	if err != nil {
-		return fmt.Errorf("failed to send email: %w", err)
+		log.Printf("Email sent successfully to %s", strings.Join(recipients, ", "))
+		return response, nil
 	}
-
-	log.Printf("Email sent successfully to %s", recipient)
-	return nil
 }
 
-func parseTemplate(templateFileName string, data EmailData) (string, error) {
-	tmpl, err := template.ParseFiles(templateFileName)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse template: %w", err)
+// Close closes the connections kept for reuse.
+func (c *SMTPConfig) Close() {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle = nil
+	c.mu.Unlock()
+
+	for _, cn := range idle {
+		cn.quit()
 	}
-	var tpl bytes.Buffer
-	if err := tmpl.Execute(&tpl, data); err != nil {
-		return "", fmt.Errorf("failed to execute template: %w", err)
+}
+
+func (c *SMTPConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
 	}
-	return tpl.String(), nil
+	return time.Minute
 }
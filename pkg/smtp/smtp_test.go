@@ -0,0 +1,227 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"uneexpo/pkg/mailer"
+)
+
+// sink is an SMTP server that accepts every message, except for recipients
+// at reject.example.com, and can hang up after each one.
+type sink struct {
+	listener net.Listener
+	// hangUp closes the connection after a message, as servers dropping
+	// idle connections do.
+	hangUp bool
+
+	mu       sync.Mutex
+	conns    int
+	messages []string
+	quits    int
+}
+
+func newSink(t *testing.T) *sink {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sink{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *sink) config() *SMTPConfig {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return &SMTPConfig{
+		SMTPHost:     host,
+		SMTPPort:     port,
+		SenderEmail:  "noreply@example.com",
+		Security:     SecurityNone,
+		MaxIdleConns: 2,
+		IdleTimeout:  time.Minute,
+		Timeout:      5 * time.Second,
+	}
+}
+
+func (s *sink) serve() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+func (s *sink) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	reply := func(line string) { fmt.Fprintf(c, "%s\r\n", line) }
+
+	reply("220 sink ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 sink")
+		case strings.HasPrefix(command, "RCPT") && strings.Contains(command, "@REJECT.EXAMPLE.COM"):
+			reply("550 no such user")
+		case strings.HasPrefix(command, "MAIL"), strings.HasPrefix(command, "RCPT"),
+			strings.HasPrefix(command, "RSET"), strings.HasPrefix(command, "NOOP"):
+			reply("250 ok")
+		case command == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, data.String())
+			id := len(s.messages)
+			s.mu.Unlock()
+			reply(fmt.Sprintf("250 queued as %d", id))
+			if s.hangUp {
+				return
+			}
+		case command == "QUIT":
+			s.mu.Lock()
+			s.quits++
+			s.mu.Unlock()
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (s *sink) counts() (conns, messages, quits int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns, len(s.messages), s.quits
+}
+
+func testMessage(to string) mailer.Message {
+	return mailer.Message{To: []string{to}, Subject: "Test", Text: "Hello"}
+}
+
+func TestSendReusesConnection(t *testing.T) {
+	s := newSink(t)
+	c := s.config()
+
+	for i := 1; i <= 3; i++ {
+		response, err := c.SendWithResponse(context.Background(), testMessage("to@example.com"))
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("250 queued as %d", i); response != want {
+			t.Errorf("response = %q, want %q", response, want)
+		}
+	}
+	if conns, messages, _ := s.counts(); conns != 1 || messages != 3 {
+		t.Errorf("%d connections for %d messages, want 1 for 3", conns, messages)
+	}
+}
+
+func TestSendKeepsConnectionAfterRejection(t *testing.T) {
+	s := newSink(t)
+	c := s.config()
+
+	err := c.Send(context.Background(), testMessage("nobody@reject.example.com"))
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Fatalf("err = %v, want the 550 rejection", err)
+	}
+	if err := c.Send(context.Background(), testMessage("to@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if conns, messages, _ := s.counts(); conns != 1 || messages != 1 {
+		t.Errorf("%d connections for %d messages, want 1 for 1", conns, messages)
+	}
+}
+
+func TestSendRedialsDroppedConnection(t *testing.T) {
+	s := newSink(t)
+	s.hangUp = true
+	c := s.config()
+
+	for i := 1; i <= 2; i++ {
+		if err := c.Send(context.Background(), testMessage("to@example.com")); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	if conns, messages, _ := s.counts(); conns != 2 || messages != 2 {
+		t.Errorf("%d connections for %d messages, want 2 for 2", conns, messages)
+	}
+}
+
+func TestSendDropsExpiredIdleConnection(t *testing.T) {
+	s := newSink(t)
+	c := s.config()
+	c.IdleTimeout = time.Millisecond
+
+	for i := 1; i <= 2; i++ {
+		if err := c.Send(context.Background(), testMessage("to@example.com")); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if conns, _, _ := s.counts(); conns != 2 {
+		t.Errorf("%d connections, want a new one after the idle timeout", conns)
+	}
+}
+
+func TestCloseQuitsIdleConnections(t *testing.T) {
+	s := newSink(t)
+	c := s.config()
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Send(context.Background(), testMessage("to@example.com")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		conns, _, quits := s.counts()
+		// Connections beyond MaxIdleConns quit as soon as they are returned
+		if quits == conns {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d connections quit", quits, conns)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(c.idle) != 0 {
+		t.Errorf("%d connections still kept", len(c.idle))
+	}
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"uneexpo/pkg/mediaurl"
+)
+
+// tempPrefix marks files being written by Put, which List skips.
+const tempPrefix = ".upload-"
+
+// Local stores objects as files under Root, the layout UPLOAD_PATH always had.
+type Local struct {
+	Root string
+	// BaseURL serves Root over HTTP, e.g. STATIC_URL.
+	BaseURL string
+}
+
+func NewLocal(root, baseURL string) *Local {
+	return &Local{Root: root, BaseURL: baseURL}
+}
+
+func (l *Local) path(key string) (string, string, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	return key, filepath.Join(l.Root, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file renamed into place, so readers never see
+// half-written files.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64, opts PutOptions) error {
+	_, name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("wrote %d of %d bytes of %s", written, size, key)
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	key, name, err := l.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	file, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, ObjectInfo{}, err
+	}
+	if stat.IsDir() {
+		file.Close()
+		return nil, ObjectInfo{}, ErrNotFound
+	}
+	return file, fileInfo(key, stat), nil
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	key, name, err := l.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	stat, err := os.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && stat.IsDir()) {
+		return ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return fileInfo(key, stat), nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	_, name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List walks the directory holding prefix, which may end in part of a name.
+func (l *Local) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	start := l.Root
+	if dir := prefixDir(prefix); dir != "" {
+		dir, err := CleanKey(dir)
+		if err != nil {
+			return err
+		}
+		start = filepath.Join(l.Root, filepath.FromSlash(dir))
+	}
+
+	err := filepath.WalkDir(start, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), tempPrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.Root, name)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(fileInfo(key, stat))
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// SignedURL signs the URL under BaseURL with mediaurl, for the user set on
+// ctx with mediaurl.WithUser, so that it is served by GuardSignedURL.
+func (l *Local) SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	userID, ok := mediaurl.UserFrom(ctx)
+	if !ok {
+		return "", mediaurl.ErrNoUser
+	}
+	key, _, err := l.path(key)
+	if err != nil {
+		return "", err
+	}
+	link, err := url.Parse(strings.TrimSuffix(l.BaseURL, "/") + "/" + key)
+	if err != nil {
+		return "", err
+	}
+	link.RawQuery = mediaurl.Sign(link.EscapedPath(), userID, ttl).Encode()
+	return link.String(), nil
+}
+
+func fileInfo(key string, stat fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:         key,
+		Size:        stat.Size(),
+		ContentType: contentTypeOf(key, ""),
+		ModTime:     stat.ModTime(),
+	}
+}
+
+// prefixDir is the directory part of a key prefix, "" for the root.
+func prefixDir(prefix string) string {
+	if i := strings.LastIndexByte(prefix, '/'); i >= 0 {
+		return prefix[:i]
+	}
+	return ""
+}
@@ -0,0 +1,408 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unsignedPayload skips hashing bodies; the connection protects them.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+type S3Options struct {
+	// Endpoint is the URL of the service, e.g. https://s3.eu-central-1.amazonaws.com
+	// or http://localhost:9000 for MinIO.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses the bucket as endpoint/bucket instead of
+	// bucket.endpoint, which MinIO and most self-hosted services need.
+	PathStyle bool
+	// HTTPClient defaults to a client with a generous timeout for large files.
+	HTTPClient *http.Client
+}
+
+// S3 stores objects in a bucket of an S3-compatible service, signing
+// requests with AWS Signature Version 4.
+type S3 struct {
+	options  S3Options
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewS3(options S3Options) (*S3, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(options.Endpoint, "/"))
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", options.Endpoint)
+	}
+	if options.Bucket == "" {
+		return nil, errors.New("S3 bucket is not set")
+	}
+	if options.Region == "" {
+		options.Region = "us-east-1"
+	}
+
+	client := options.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Minute}
+	}
+	return &S3{options: options, endpoint: endpoint, client: client}, nil
+}
+
+// objectURL addresses key in the bucket, or the bucket itself for "".
+func (s *S3) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	objectPath := "/" + key
+	if s.options.PathStyle {
+		objectPath = "/" + s.options.Bucket
+		if key != "" {
+			objectPath += "/" + key
+		}
+	} else {
+		u.Host = s.options.Bucket + "." + u.Host
+	}
+	u.Path = u.Path + objectPath
+	u.RawPath = escapePath(u.Path)
+	return &u
+}
+
+func (s *S3) newRequest(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := s.objectURL(key)
+	u.RawQuery = canonicalQuery(query)
+	return http.NewRequestWithContext(ctx, method, u.String(), body)
+}
+
+// do signs and sends req, turning error responses into errors.
+func (s *S3) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, opts PutOptions) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	// S3 needs the length up front
+	if size < 0 {
+		spooled, err := os.CreateTemp("", "uneexpo-s3-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(spooled.Name())
+		defer spooled.Close()
+
+		if size, err = io.Copy(spooled, r); err != nil {
+			return err
+		}
+		if _, err := spooled.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r = spooled
+	}
+
+	req, err := s.newRequest(ctx, http.MethodPut, key, nil, io.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("Content-Type", contentTypeOf(key, opts.ContentType))
+
+	resp, err := s.do(req)
+	if err != nil {
+		return fmt.Errorf("failed to put %s: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return resp.Body, headerInfo(key, resp), nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	req, err := s.newRequest(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	return headerInfo(key, resp), nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List pages through ListObjectsV2.
+func (s *S3) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		req, err := s.newRequest(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return fmt.Errorf("failed to list %q: %w", prefix, err)
+		}
+
+		var page listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to parse listing: %w", err)
+		}
+
+		for _, object := range page.Contents {
+			err := fn(ObjectInfo{
+				Key:         object.Key,
+				Size:        object.Size,
+				ContentType: contentTypeOf(object.Key, ""),
+				ModTime:     object.LastModified,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// SignedURL presigns a GET of key. S3 caps the validity at 7 days.
+func (s *S3) SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	if ttl > 7*24*time.Hour {
+		ttl = 7 * 24 * time.Hour
+	}
+	return s.presign(key, ttl, time.Now().UTC()), nil
+}
+
+// presign signs a GET of key made at now as query parameters.
+func (s *S3) presign(key string, ttl time.Duration, now time.Time) string {
+	u := s.objectURL(key)
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.options.AccessKey + "/" + s.scope(now)},
+		"X-Amz-Date":          {now.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {strconv.Itoa(int(ttl.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	headers := http.Header{}
+	request := canonicalRequest(http.MethodGet, u.EscapedPath(), canonicalQuery(query), u.Host, headers, unsignedPayload)
+	query.Set("X-Amz-Signature", s.signature(now, request))
+	u.RawQuery = canonicalQuery(query)
+	return u.String()
+}
+
+// sign adds the Authorization header of Signature Version 4.
+func (s *S3) sign(req *http.Request, now time.Time) {
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	headers := http.Header{}
+	for _, name := range []string{"Content-Type", "X-Amz-Content-Sha256", "X-Amz-Date"} {
+		if value := req.Header.Get(name); value != "" {
+			headers.Set(name, value)
+		}
+	}
+	request := canonicalRequest(req.Method, req.URL.EscapedPath(), req.URL.RawQuery, req.URL.Host, headers, unsignedPayload)
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.options.AccessKey, s.scope(now), signedHeaders(headers), s.signature(now, request),
+	))
+}
+
+func (s *S3) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.options.Region + "/s3/aws4_request"
+}
+
+func (s *S3) signature(now time.Time, canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + s.scope(now) + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.options.SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.options.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalRequest signs host plus the given headers.
+func canonicalRequest(method, path, query, host string, headers http.Header, payloadHash string) string {
+	lines := []string{"host:" + host}
+	for name := range headers {
+		lines = append(lines, strings.ToLower(name)+":"+strings.TrimSpace(headers.Get(name)))
+	}
+	sort.Strings(lines)
+
+	return strings.Join([]string{
+		method, path, query,
+		strings.Join(lines, "\n") + "\n",
+		signedHeaders(headers),
+		payloadHash,
+	}, "\n")
+}
+
+func signedHeaders(headers http.Header) string {
+	names := []string{"host"}
+	for name := range headers {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ";")
+}
+
+// canonicalQuery encodes a query the way Signature Version 4 expects: sorted,
+// with every character but the unreserved ones escaped.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, escape(key, false)+"="+escape(value, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func escapePath(path string) string {
+	return escape(path, true)
+}
+
+func escape(value string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', keepSlash && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func headerInfo(key string, resp *http.Response) ObjectInfo {
+	info := ObjectInfo{
+		Key:         key,
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	if info.ContentType == "" {
+		info.ContentType = contentTypeOf(key, "")
+	}
+	return info
+}
+
+// responseError reads the XML error document S3 answers failures with.
+func responseError(resp *http.Response) error {
+	var body struct {
+		Code    string
+		Message string
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body); err != nil || body.Code == "" {
+		return fmt.Errorf("S3 answered %s", resp.Status)
+	}
+	return fmt.Errorf("S3 answered %s: %s: %s", resp.Status, body.Code, body.Message)
+}
@@ -0,0 +1,108 @@
+// Package storage keeps uploaded files behind one interface, so the API can
+// store them on its own disk or in an S3-compatible bucket shared by several
+// instances.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+	"time"
+	"uneexpo/config"
+)
+
+var (
+	ErrNotFound   = errors.New("object not found")
+	ErrInvalidKey = errors.New("invalid object key")
+)
+
+// ObjectInfo describes a stored object. Keys are slash-separated paths
+// relative to the root of the storage, e.g. "vehicles/image/2025-01-31/a.jpg".
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+type PutOptions struct {
+	// ContentType defaults to one guessed from the extension of the key.
+	ContentType string
+}
+
+type Storage interface {
+	// Put stores size bytes read from r under key, replacing any object there.
+	// A negative size means unknown.
+	Put(ctx context.Context, key string, r io.Reader, size int64, opts PutOptions) error
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// Delete removes key. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+	// List calls fn for every object under prefix until fn returns an error.
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+	// SignedURL returns a URL that serves key without other credentials until ttl passes.
+	// Backends served by the API sign it for the user set with mediaurl.WithUser.
+	SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+// Default is the storage of uploaded files, set up in main.
+var Default Storage
+
+// Drivers accepted by Open.
+const (
+	DriverLocal = "local"
+	DriverS3    = "s3"
+)
+
+// Open creates the storage of a driver configured in config.ENV.
+func Open(driver string) (Storage, error) {
+	switch driver {
+	case "", DriverLocal:
+		return NewLocal(config.ENV.UPLOAD_PATH, config.ENV.STATIC_URL), nil
+	case DriverS3:
+		return NewS3(S3Options{
+			Endpoint:  config.ENV.S3_ENDPOINT,
+			Region:    config.ENV.S3_REGION,
+			Bucket:    config.ENV.S3_BUCKET,
+			AccessKey: config.ENV.S3_ACCESS_KEY,
+			SecretKey: config.ENV.S3_SECRET_KEY,
+			PathStyle: config.ENV.S3_PATH_STYLE == 1,
+		})
+	}
+	return nil, fmt.Errorf("unknown storage driver %q", driver)
+}
+
+// CleanKey validates key and returns it in canonical form. Keys may not
+// escape the root of the storage.
+func CleanKey(key string) (string, error) {
+	key = strings.ReplaceAll(key, "\\", "/")
+	cleaned := path.Clean("/" + key)[1:]
+	if cleaned == "" || cleaned != strings.TrimPrefix(key, "/") {
+		return "", fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	return cleaned, nil
+}
+
+func contentTypeOf(key, contentType string) string {
+	if contentType != "" {
+		return contentType
+	}
+	if byExt := mime.TypeByExtension(path.Ext(key)); byExt != "" {
+		return byExt
+	}
+	return "application/octet-stream"
+}
+
+// Copy copies one object between storages.
+func Copy(ctx context.Context, dst, src Storage, key string) error {
+	r, info, err := src.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return dst.Put(ctx, key, r, info.Size, PutOptions{ContentType: info.ContentType})
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCleanKey(t *testing.T) {
+	tests := []struct {
+		key, want string
+	}{
+		{"chat/image/2025-01-31/a.jpg", "chat/image/2025-01-31/a.jpg"},
+		{"/chat/a.jpg", "chat/a.jpg"},
+		{"chat\\image\\a.jpg", "chat/image/a.jpg"},
+		{"", ""},
+		{"/", ""},
+		{".", ""},
+		{"..", ""},
+		{"../etc/passwd", ""},
+		{"/../etc/passwd", ""},
+		{"chat/../../etc/passwd", ""},
+		{"chat/../avatar/a.jpg", ""},
+		{"chat\\..\\..\\etc\\passwd", ""},
+		{"chat//a.jpg", ""},
+		{"chat/./a.jpg", ""},
+		{"chat/", ""},
+	}
+	for _, tt := range tests {
+		got, err := CleanKey(tt.key)
+		if tt.want == "" {
+			if !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("CleanKey(%q) = %q, %v, want ErrInvalidKey", tt.key, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("CleanKey(%q) = %q, %v, want %q", tt.key, got, err, tt.want)
+		}
+	}
+}
+
+func TestLocalStaysInRoot(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "uploads")
+	l := NewLocal(root, "https://example.com/uploads")
+	ctx := context.Background()
+
+	for _, key := range []string{"../escaped.txt", "chat/../../escaped.txt", "..\\escaped.txt"} {
+		if err := l.Put(ctx, key, strings.NewReader("x"), 1, PutOptions{}); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Put(%q) = %v, want ErrInvalidKey", key, err)
+		}
+		if _, _, err := l.Get(ctx, key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Get(%q) = %v, want ErrInvalidKey", key, err)
+		}
+		if err := l.Delete(ctx, key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Delete(%q) = %v, want ErrInvalidKey", key, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.txt")); !os.IsNotExist(err) {
+		t.Errorf("a file was written outside the root: %v", err)
+	}
+}
+
+func TestLocalRoundTrip(t *testing.T) {
+	l := NewLocal(t.TempDir(), "")
+	ctx := context.Background()
+
+	if err := l.Put(ctx, "chat/a.txt", strings.NewReader("hello"), -1, PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	if err := l.List(ctx, "chat/", func(info ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "chat/a.txt" {
+		t.Errorf("listed %v, temporary files included or the file missing", keys)
+	}
+
+	if err := l.Delete(ctx, "chat/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Stat(ctx, "chat/a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat after Delete = %v, want ErrNotFound", err)
+	}
+	if err := l.Delete(ctx, "chat/a.txt"); err != nil {
+		t.Errorf("deleting a missing file = %v", err)
+	}
+}
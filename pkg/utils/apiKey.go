@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+const APIKeyPrefix = "uxk_"
+
+// GenerateAPIKey returns a new key in the form uxk_<prefix>_<secret> and its
+// prefix. Only the prefix and HashToken(key) are stored.
+func GenerateAPIKey() (key string, prefix string, err error) {
+	prefixBytes := make([]byte, 6)
+	if _, err := rand.Read(prefixBytes); err != nil {
+		return "", "", err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+
+	prefix = hex.EncodeToString(prefixBytes)
+	key = APIKeyPrefix + prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	return key, prefix, nil
+}
+
+// ParseAPIKey extracts the lookup prefix of a key created by GenerateAPIKey.
+func ParseAPIKey(key string) (string, bool) {
+	rest, found := strings.CutPrefix(key, APIKeyPrefix)
+	if !found {
+		return "", false
+	}
+	prefix, secret, found := strings.Cut(rest, "_")
+	if !found || len(prefix) != 12 || secret == "" {
+		return "", false
+	}
+	return prefix, true
+}
@@ -1,34 +1,265 @@
 package utils
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"uneexpo/config"
+	"uneexpo/pkg/keyring"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+	// TokenTypeAPIKey marks claims built from a company API key rather than a JWT.
+	TokenTypeAPIKey = "api_key"
+	// TokenTypeChallenge is returned by the first step of a two-factor login.
+	TokenTypeChallenge = "2fa_challenge"
+)
+
+var (
+	TokenIssuer   = "uneexpo"
+	TokenAudience = "uneexpo-api"
+
+	// SigningKeys signs new tokens with EdDSA when set. Without it tokens are
+	// HS256 signed with ACCESS_KEY and REFRESH_KEY.
+	SigningKeys *keyring.KeyRing
+	// AcceptLegacyTokens keeps HS256 tokens of CreateSessionToken valid after
+	// SigningKeys is set, so sessions started before the switch survive until
+	// they expire.
+	AcceptLegacyTokens = true
+	// AcceptPreSessionTokens keeps the tokens of the original CreateToken
+	// valid: HS256, without issuer, audience, type, ID or session. Nothing
+	// issues them any more, so the last one expires REFRESH_TIME after the
+	// upgrade, and this can be turned off then.
+	AcceptPreSessionTokens = true
+	// ChallengeTTL is how long the second step of a two-factor login may take.
+	ChallengeTTL = 5 * time.Minute
+	// LegacyLogin completes the logins of CreateToken. main sets it to
+	// auth.LegacyLogin, so those logins get a session and a second factor.
+	LegacyLogin func(subject TokenSubject) (accessToken, refreshToken string, exp int64, err error)
+
+	ErrInvalidTokenType = errors.New("invalid token type")
+	ErrInvalidSubject   = errors.New("token has no subject")
+)
+
+// Claims is the payload of every access and refresh token issued by CreateSessionToken.
+type Claims struct {
+	ID        int    `json:"id"`
+	RoleID    int    `json:"roleID"`
+	CompanyID int    `json:"companyID"`
+	DriverID  int    `json:"driverID"`
+	Role      string `json:"role"`
+	SessionID int    `json:"sid,omitempty"`
+	TokenType string `json:"typ"`
+	// LoginMethod carries the first login step to the session a challenge completes.
+	LoginMethod string `json:"lm,omitempty"`
+	// Scopes limits API key requests to these permissions, unused for JWTs.
+	Scopes []string `json:"-"`
+	jwt.RegisteredClaims
+}
+
+// TokenSubject identifies the account a token pair is issued for.
+type TokenSubject struct {
+	ID        int
+	RoleID    int
+	CompanyID int
+	DriverID  int
+	Role      string
+}
+
+// IsDriver reports whether the token belongs to a driver account of a company.
+func (c *Claims) IsDriver() bool {
+	return c.DriverID != 0
+}
+
+// Subject returns the account the claims were issued for.
+func (c *Claims) Subject() TokenSubject {
+	return TokenSubject{
+		ID:        c.ID,
+		RoleID:    c.RoleID,
+		CompanyID: c.CompanyID,
+		DriverID:  c.DriverID,
+		Role:      c.Role,
+	}
+}
+
+func newClaims(subject TokenSubject, sessionID int, tokenType string, exp time.Time) *Claims {
+	return &Claims{
+		ID:        subject.ID,
+		RoleID:    subject.RoleID,
+		CompanyID: subject.CompanyID,
+		DriverID:  subject.DriverID,
+		Role:      subject.Role,
+		SessionID: sessionID,
+		TokenType: tokenType,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    TokenIssuer,
+			Audience:  jwt.ClaimStrings{TokenAudience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(exp),
+		},
+	}
+}
+
+// CreateToken issues the token pair of a login whose first factor the caller
+// has checked, through LegacyLogin. Users who have to pass a second factor,
+// and failures, get empty tokens.
+//
+// Deprecated: login handlers call auth.CompleteLogin, which returns the
+// challenge of a two-factor login.
 func CreateToken(id, roleID, companyID, driverID int, role string) (string, string, int64) {
-	accessExp := time.Now().Add(config.ENV.ACCESS_TIME).Unix()
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":        id,
-		"companyID": companyID,
-		"driverID":  driverID,
-		"role":      role,
-		"roleID":    roleID,
-		"exp":       accessExp,
-	})
-	tokenString, _ := accessToken.SignedString([]byte(config.ENV.ACCESS_KEY))
-
-	refreshExp := time.Now().Add(config.ENV.REFRESH_TIME).Unix()
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":        id,
-		"companyID": companyID,
-		"driverID":  driverID,
-		"role":      role,
-		"roleID":    roleID,
-		"exp":       refreshExp,
+	if LegacyLogin == nil {
+		log.Printf("No tokens issued to user %d: LegacyLogin is not set", id)
+		return "", "", 0
+	}
+
+	accessToken, refreshToken, exp, err := LegacyLogin(TokenSubject{
+		ID:        id,
+		RoleID:    roleID,
+		CompanyID: companyID,
+		DriverID:  driverID,
+		Role:      role,
 	})
-	refreshString, _ := refreshToken.SignedString([]byte(config.ENV.REFRESH_KEY))
+	if err != nil {
+		log.Printf("No tokens issued to user %d: %v", id, err)
+		return "", "", 0
+	}
+	return accessToken, refreshToken, exp
+}
+
+// CreateSessionToken issues an access and refresh token pair bound to a row of tbl_sessions.
+func CreateSessionToken(subject TokenSubject, sessionID int) (string, string, int64) {
+	accessExp := time.Now().Add(config.ENV.ACCESS_TIME)
+	tokenString, _ := signToken(newClaims(subject, sessionID, TokenTypeAccess, accessExp), config.ENV.ACCESS_KEY)
+
+	refreshExp := time.Now().Add(config.ENV.REFRESH_TIME)
+	refreshString, _ := signToken(newClaims(subject, sessionID, TokenTypeRefresh, refreshExp), config.ENV.REFRESH_KEY)
+
+	return tokenString, refreshString, accessExp.Unix()
+}
+
+// CreateChallengeToken issues the short-lived token a client trades, together
+// with a second factor, for the token pair of a new session.
+func CreateChallengeToken(subject TokenSubject, loginMethod string) (string, int64, error) {
+	exp := time.Now().Add(ChallengeTTL)
+	claims := newClaims(subject, 0, TokenTypeChallenge, exp)
+	claims.LoginMethod = loginMethod
+
+	token, err := signToken(claims, config.ENV.ACCESS_KEY)
+	return token, exp.Unix(), err
+}
+
+func signToken(claims jwt.Claims, hmacKey string) (string, error) {
+	if SigningKeys != nil && SigningKeys.CanSign() {
+		return SigningKeys.Sign(claims)
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(hmacKey))
+}
+
+// tokenKeyfunc picks the verification key by algorithm: EdDSA tokens are
+// checked against SigningKeys by kid, HS256 tokens against hmacKey.
+func tokenKeyfunc(hmacKey string) (jwt.Keyfunc, []string) {
+	if SigningKeys == nil {
+		return func(t *jwt.Token) (interface{}, error) {
+			return []byte(hmacKey), nil
+		}, []string{jwt.SigningMethodHS256.Alg()}
+	}
+
+	methods := []string{jwt.SigningMethodEdDSA.Alg()}
+	if AcceptLegacyTokens {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	return func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodEd25519:
+			return SigningKeys.Keyfunc(t)
+		case *jwt.SigningMethodHMAC:
+			return []byte(hmacKey), nil
+		}
+		return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+	}, methods
+}
+
+// ParseAccessToken verifies signature, algorithm, key id, expiry, issuer and audience
+// of an access token and returns its claims.
+func ParseAccessToken(tokenString string) (*Claims, error) {
+	return parseToken(tokenString, config.ENV.ACCESS_KEY, TokenTypeAccess)
+}
+
+// ParseRefreshToken is the refresh-token counterpart of ParseAccessToken.
+func ParseRefreshToken(tokenString string) (*Claims, error) {
+	return parseToken(tokenString, config.ENV.REFRESH_KEY, TokenTypeRefresh)
+}
+
+// ParseChallengeToken is the challenge-token counterpart of ParseAccessToken.
+func ParseChallengeToken(tokenString string) (*Claims, error) {
+	return parseToken(tokenString, config.ENV.ACCESS_KEY, TokenTypeChallenge)
+}
+
+func parseToken(tokenString, key, tokenType string) (*Claims, error) {
+	claims := &Claims{}
+	keyfunc, methods := tokenKeyfunc(key)
+	_, err := jwt.ParseWithClaims(
+		tokenString, claims, keyfunc,
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuer(TokenIssuer),
+		jwt.WithAudience(TokenAudience),
+	)
+	if err != nil {
+		if AcceptPreSessionTokens && tokenType != TokenTypeChallenge {
+			if legacy, legacyErr := parsePreSessionToken(tokenString, key, tokenType); legacyErr == nil {
+				return legacy, nil
+			}
+		}
+		return nil, err
+	}
+
+	if claims.TokenType != tokenType {
+		return nil, ErrInvalidTokenType
+	}
+	if claims.ID == 0 {
+		return nil, ErrInvalidSubject
+	}
+	return claims, nil
+}
+
+// parsePreSessionToken accepts a token of the original CreateToken. Access
+// and refresh tokens were only told apart by their key. The hash of the
+// token stands in for its ID, so it can be revoked like any other.
+func parsePreSessionToken(tokenString, key, tokenType string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(
+		tokenString, claims,
+		func(t *jwt.Token) (interface{}, error) {
+			return []byte(key), nil
+		},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.TokenType != "" || claims.SessionID != 0 || claims.Issuer != "" || len(claims.Audience) > 0 ||
+		claims.RegisteredClaims.ID != "" || claims.IssuedAt != nil {
+		return nil, ErrInvalidTokenType
+	}
+	// Issued before the upgrade, so it can't outlive the longest token issued then
+	if claims.ExpiresAt.After(time.Now().Add(config.ENV.REFRESH_TIME)) {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	if claims.ID == 0 {
+		return nil, ErrInvalidSubject
+	}
 
-	return tokenString, refreshString, accessExp
+	claims.TokenType = tokenType
+	claims.RegisteredClaims.ID = HashToken(tokenString)
+	return claims, nil
 }
@@ -0,0 +1,120 @@
+// Package worker runs the background workers of queues kept in the
+// database, such as the email outbox and media jobs.
+package worker
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Pool is a fixed number of workers that take work while there is some,
+// then wait for the next poll or a Wake.
+type Pool struct {
+	// Workers is how many jobs are worked on at once.
+	Workers      int
+	PollInterval time.Duration
+	// Backoff is the wait after the first failure, doubled after each next one up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	initOnce sync.Once
+	wake     chan struct{}
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+func (p *Pool) init() {
+	p.initOnce.Do(func() {
+		p.wake = make(chan struct{}, 1)
+		p.stop = make(chan struct{})
+	})
+}
+
+// Wake makes an idle worker look for work now rather than at its next poll.
+func (p *Pool) Wake() {
+	p.init()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start runs the workers until Stop is called. Each calls next, which takes
+// some work and reports whether there may be more, back to back until it
+// reports false.
+func (p *Pool) Start(next func() bool) {
+	p.init()
+	for range p.Workers {
+		p.wg.Add(1)
+		go p.work(next)
+	}
+}
+
+// Every calls fn every interval until Stop is called, e.g. to purge
+// finished jobs.
+func (p *Pool) Every(interval time.Duration, fn func()) {
+	p.init()
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop tells the workers to stop and waits for the work in progress.
+// interrupt, when not nil, is called once they were told, to cut that work
+// short.
+func (p *Pool) Stop(interrupt func()) {
+	p.init()
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		if interrupt != nil {
+			interrupt()
+		}
+		p.wg.Wait()
+	})
+}
+
+// RetryIn is the wait after the attempt-th failure of a job.
+func (p *Pool) RetryIn(attempt int) time.Duration {
+	wait := time.Duration(float64(p.Backoff) * math.Pow(2, float64(attempt-1)))
+	if wait > p.MaxBackoff || wait <= 0 {
+		return p.MaxBackoff
+	}
+	return wait
+}
+
+func (p *Pool) work(next func() bool) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.PollInterval)
+	defer ticker.Stop()
+	for {
+		// Take work back to back while there is some
+		for next() {
+			select {
+			case <-p.stop:
+				return
+			default:
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-p.wake:
+		case <-p.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package worker
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryInDoublesUpToMaxBackoff(t *testing.T) {
+	p := &Pool{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+
+	for attempt, want := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		4:  5 * time.Second,
+		80: 5 * time.Second,
+	} {
+		if got := p.RetryIn(attempt); got != want {
+			t.Errorf("RetryIn(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestWorkersDrainBackToBackAndWakeUp(t *testing.T) {
+	p := &Pool{Workers: 1, PollInterval: time.Hour}
+
+	var queued, taken atomic.Int32
+	queued.Store(3)
+	done := make(chan struct{}, 10)
+	p.Start(func() bool {
+		if queued.Load() == 0 {
+			return false
+		}
+		queued.Add(-1)
+		taken.Add(1)
+		done <- struct{}{}
+		return true
+	})
+	defer p.Stop(nil)
+
+	for range 3 {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("took %d jobs before the poll, want 3", taken.Load())
+		}
+	}
+
+	// Only a Wake picks up new work before the next poll, an hour away
+	queued.Store(1)
+	p.Wake()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Wake did not make the worker look for work")
+	}
+}
+
+func TestStopInterruptsAndWaits(t *testing.T) {
+	p := &Pool{Workers: 2, PollInterval: time.Hour}
+
+	interrupt := make(chan struct{})
+	var running, finished atomic.Int32
+	p.Start(func() bool {
+		running.Add(1)
+		<-interrupt
+		finished.Add(1)
+		return false
+	})
+	for running.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	p.Stop(func() { close(interrupt) })
+	if finished.Load() != 2 {
+		t.Fatalf("Stop returned with %d of 2 workers finished", finished.Load())
+	}
+	// Stopping again does nothing
+	p.Stop(func() { t.Fatal("interrupted twice") })
+}
@@ -0,0 +1,8 @@
+-- Session refresh token rotation.
+-- refresh_token now stores the SHA-256 of the only refresh token of the session
+-- that may still be exchanged; presenting an older one revokes the session.
+ALTER TABLE tbl_sessions
+    ADD COLUMN revoked_at    TIMESTAMP,
+    ADD COLUMN revoke_reason VARCHAR(50) NOT NULL DEFAULT '';
+
+CREATE INDEX idx_sessions_user_active ON tbl_sessions(user_id, is_active);
@@ -0,0 +1,46 @@
+INSERT INTO tbl_role (role, name, description, title, subtitle, title_ru, subtitle_ru) VALUES
+   ('driver', 'driver', 'Drives the vehicles of a carrier and handles assigned deliveries', 'Driver', 'I drive for a carrier', 'Водитель', 'Я вожу для перевозчика');
+
+CREATE TABLE tbl_permission
+(
+    id          SERIAL PRIMARY KEY,
+    name        VARCHAR(100) UNIQUE NOT NULL, -- resource.action, e.g. "cargo.create"
+    description TEXT         NOT NULL DEFAULT '',
+    created_at  TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at  TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE tbl_role_permission
+(
+    role_id       INT       NOT NULL REFERENCES tbl_role (id) ON DELETE CASCADE,
+    permission_id INT       NOT NULL REFERENCES tbl_permission (id) ON DELETE CASCADE,
+    created_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+-- admin and system roles are allowed everything and need no rows here.
+INSERT INTO tbl_permission (name, description) VALUES
+   ('cargo.create', 'Publish cargo looking for transport'),
+   ('cargo.manage', 'Edit and archive own cargo'),
+   ('offer.create', 'Publish transport offers'),
+   ('offer.manage', 'Edit and archive own offers'),
+   ('offer.respond', 'Respond to cargo and offers of other companies'),
+   ('vehicle.manage', 'Add and edit company vehicles'),
+   ('driver.manage', 'Add and edit company drivers'),
+   ('delivery.update', 'Update status and location of assigned deliveries'),
+   ('chat.use', 'Send chat messages'),
+   ('analytics.view', 'View company analytics'),
+   ('role.manage', 'Edit role permissions'),
+   ('content.manage', 'Edit site content');
+
+INSERT INTO tbl_role_permission (role_id, permission_id)
+SELECT r.id, p.id
+FROM tbl_role r
+         JOIN tbl_permission p ON p.name = ANY (CASE r.name
+    WHEN 'sender' THEN ARRAY ['cargo.create', 'cargo.manage', 'offer.respond', 'chat.use', 'analytics.view']
+    WHEN 'carrier_personal' THEN ARRAY ['offer.create', 'offer.manage', 'offer.respond', 'vehicle.manage', 'delivery.update', 'chat.use']
+    WHEN 'carrier_owner' THEN ARRAY ['offer.create', 'offer.manage', 'offer.respond', 'vehicle.manage', 'driver.manage', 'delivery.update', 'chat.use', 'analytics.view']
+    WHEN 'carrier_company' THEN ARRAY ['cargo.create', 'cargo.manage', 'offer.create', 'offer.manage', 'offer.respond', 'vehicle.manage', 'driver.manage', 'delivery.update', 'chat.use', 'analytics.view']
+    WHEN 'driver' THEN ARRAY ['delivery.update', 'chat.use']
+    ELSE ARRAY []::TEXT[]
+    END);
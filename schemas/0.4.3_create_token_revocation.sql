@@ -0,0 +1,66 @@
+-- Access tokens revoked before their exp. Rows are only needed until every
+-- token they match has expired, which is what expires_at records.
+CREATE TABLE tbl_token_revocation
+(
+    id             SERIAL PRIMARY KEY,
+    kind           VARCHAR(20) NOT NULL,            -- token, session, user, company
+    jti            VARCHAR(64) NOT NULL DEFAULT '', -- set for kind = token
+    subject_id     INT         NOT NULL DEFAULT 0,  -- session, user or company id
+    revoked_before TIMESTAMP,                       -- tokens of the subject issued before are revoked
+    reason         VARCHAR(50) NOT NULL DEFAULT '',
+    expires_at     TIMESTAMP   NOT NULL,
+    created_at     TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_token_revocation_expires_at ON tbl_token_revocation(expires_at);
+
+-- Password changes and bans revoke the tokens and sessions of the account
+-- however they are written, also by handlers that never call the revocation
+-- code. The cutoff is kept for a day, longer than any access token lives.
+CREATE OR REPLACE FUNCTION revoke_user_access()
+    RETURNS TRIGGER AS $$
+DECLARE
+    reason VARCHAR(50);
+BEGIN
+    IF NEW.password <> OLD.password THEN
+        reason := 'password_change';
+    ELSIF (NEW.active <> 1 OR NEW.deleted <> 0) AND OLD.active = 1 AND OLD.deleted = 0 THEN
+        reason := 'banned';
+    ELSE
+        RETURN NEW;
+    END IF;
+
+    INSERT INTO tbl_token_revocation (kind, subject_id, revoked_before, reason, expires_at)
+    VALUES ('user', NEW.id, date_trunc('second', CURRENT_TIMESTAMP), reason, CURRENT_TIMESTAMP + INTERVAL '1 day');
+
+    UPDATE tbl_sessions
+    SET is_active = FALSE, revoked_at = CURRENT_TIMESTAMP, revoke_reason = reason, updated_at = CURRENT_TIMESTAMP
+    WHERE user_id = NEW.id AND is_active = TRUE;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER revoke_user_access
+    AFTER UPDATE OF password, active, deleted ON tbl_user
+    FOR EACH ROW
+EXECUTE FUNCTION revoke_user_access();
+
+CREATE OR REPLACE FUNCTION revoke_company_access()
+    RETURNS TRIGGER AS $$
+BEGIN
+    IF (NEW.active <> 1 OR NEW.deleted <> 0) AND OLD.active = 1 AND OLD.deleted = 0 THEN
+        INSERT INTO tbl_token_revocation (kind, subject_id, revoked_before, reason, expires_at)
+        VALUES ('company', NEW.id, date_trunc('second', CURRENT_TIMESTAMP), 'banned', CURRENT_TIMESTAMP + INTERVAL '1 day');
+
+        UPDATE tbl_sessions
+        SET is_active = FALSE, revoked_at = CURRENT_TIMESTAMP, revoke_reason = 'banned', updated_at = CURRENT_TIMESTAMP
+        WHERE company_id = NEW.id AND is_active = TRUE;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER revoke_company_access
+    AFTER UPDATE OF active, deleted ON tbl_company
+    FOR EACH ROW
+EXECUTE FUNCTION revoke_company_access();
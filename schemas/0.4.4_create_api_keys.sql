@@ -0,0 +1,67 @@
+-- Links a company to the tbl_plan row it subscribed to, plan_t stays the tier.
+ALTER TABLE tbl_company
+    ADD COLUMN plan_id INT REFERENCES tbl_plan (id) ON DELETE SET NULL;
+
+-- The UNEEXPO plan sold as each tier, for companies that only have a tier.
+CREATE OR REPLACE FUNCTION tier_plan_id(tier plan_t)
+    RETURNS INT AS $$
+SELECT id FROM tbl_plan
+WHERE deleted = 0 AND code = CASE tier
+    WHEN 'start' THEN 'TEX_START'
+    WHEN 'standard' THEN 'TEX_PRO'
+    WHEN 'premium' THEN 'TEX_ENTERPRISE'
+    END;
+$$ LANGUAGE sql STABLE;
+
+UPDATE tbl_company SET plan_id = tier_plan_id(plan) WHERE plan_id IS NULL;
+
+-- Writes that change the tier without naming a plan keep plan_id in step.
+CREATE OR REPLACE FUNCTION sync_company_plan_id()
+    RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        IF NEW.plan_id IS NULL THEN
+            NEW.plan_id = tier_plan_id(NEW.plan);
+        END IF;
+    ELSIF NEW.plan <> OLD.plan AND NEW.plan_id IS NOT DISTINCT FROM OLD.plan_id THEN
+        NEW.plan_id = tier_plan_id(NEW.plan);
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER sync_company_plan_id
+    BEFORE INSERT OR UPDATE OF plan, plan_id ON tbl_company
+    FOR EACH ROW
+EXECUTE FUNCTION sync_company_plan_id();
+
+CREATE TABLE tbl_api_key
+(
+    id           SERIAL PRIMARY KEY,
+    uuid         UUID                  DEFAULT gen_random_uuid(),
+    company_id   INT          NOT NULL REFERENCES tbl_company (id) ON DELETE CASCADE,
+    user_id      INT          NOT NULL REFERENCES tbl_user (id) ON DELETE CASCADE, -- creator, requests act on their behalf
+    name         VARCHAR(100) NOT NULL DEFAULT '',
+    prefix       VARCHAR(20)  NOT NULL UNIQUE,                                     -- public part of the key, used for lookup
+    key_hash     VARCHAR(64)  NOT NULL,                                            -- SHA-256 of the full key
+    scopes       TEXT[]       NOT NULL DEFAULT '{}',                               -- tbl_permission names
+    last_used_at TIMESTAMP,
+    last_used_ip VARCHAR(50)  NOT NULL DEFAULT '',
+    expires_at   TIMESTAMP,
+    revoked_at   TIMESTAMP,
+    created_at   TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at   TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    active       INT          NOT NULL DEFAULT 1,
+    deleted      INT          NOT NULL DEFAULT 0
+);
+
+CREATE INDEX idx_api_key_company_id ON tbl_api_key(company_id);
+
+INSERT INTO tbl_permission (name, description) VALUES
+   ('api_key.manage', 'Create, rotate and revoke company API keys');
+
+INSERT INTO tbl_role_permission (role_id, permission_id)
+SELECT r.id, p.id
+FROM tbl_role r
+         JOIN tbl_permission p ON p.name = 'api_key.manage'
+WHERE r.name IN ('sender', 'carrier_personal', 'carrier_owner', 'carrier_company');
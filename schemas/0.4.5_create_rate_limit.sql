@@ -0,0 +1,10 @@
+-- Token buckets of the PostgreSQL rate limit backend.
+CREATE UNLOGGED TABLE tbl_rate_limit
+(
+    key        VARCHAR(200)     PRIMARY KEY,
+    tokens     DOUBLE PRECISION NOT NULL,
+    allowed    BOOLEAN          NOT NULL DEFAULT TRUE, -- outcome of the last take
+    updated_at TIMESTAMP        NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_rate_limit_updated_at ON tbl_rate_limit(updated_at);
@@ -0,0 +1,26 @@
+-- TOTP (RFC 6238) second factor of a user. The row exists from the start of
+-- enrollment, 2FA is on once enabled_at is set.
+CREATE TABLE tbl_user_totp
+(
+    user_id        INT          PRIMARY KEY REFERENCES tbl_user (id) ON DELETE CASCADE,
+    secret         VARCHAR(200) NOT NULL, -- AES-GCM sealed base32 secret
+    last_used_step BIGINT       NOT NULL DEFAULT 0, -- codes of this step or older are refused
+    enabled_at     TIMESTAMP,
+    created_at     TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at     TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE tbl_user_recovery_code
+(
+    id         SERIAL PRIMARY KEY,
+    user_id    INT         NOT NULL REFERENCES tbl_user (id) ON DELETE CASCADE,
+    code_hash  VARCHAR(64) NOT NULL, -- SHA-256 of the code
+    used_at    TIMESTAMP,
+    created_at TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_user_recovery_code_user_id ON tbl_user_recovery_code(user_id);
+
+-- Users of a role with require_2fa must enroll before they can log in.
+ALTER TABLE tbl_role
+    ADD COLUMN require_2fa BOOLEAN NOT NULL DEFAULT FALSE;
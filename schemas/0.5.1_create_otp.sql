@@ -0,0 +1,36 @@
+-- One-time codes sent by SMS or email. Only an HMAC of the code is stored, keyed
+-- by purpose and destination, so a code can't be used for another purpose.
+CREATE TABLE tbl_otp_code
+(
+    id           SERIAL PRIMARY KEY,
+    purpose      VARCHAR(30)  NOT NULL, -- login, phone_change, password_reset, ...
+    destination  VARCHAR(200) NOT NULL, -- normalized phone number or email
+    code_hash    VARCHAR(64)  NOT NULL,
+    attempts     INT          NOT NULL DEFAULT 0,
+    max_attempts INT          NOT NULL,
+    expires_at   TIMESTAMP    NOT NULL,
+    consumed_at  TIMESTAMP,             -- set when verified or superseded by a newer code
+    created_at   TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_otp_code_destination ON tbl_otp_code(destination, created_at);
+
+-- tbl_user.otp_key held the last code in clear. Codes live in tbl_otp_code
+-- now: the column is emptied, and kept empty against handlers still writing
+-- it, until it is dropped.
+UPDATE tbl_user SET otp_key = '' WHERE otp_key <> '';
+
+COMMENT ON COLUMN tbl_user.otp_key IS 'Deprecated: always empty, codes are in tbl_otp_code';
+
+CREATE OR REPLACE FUNCTION clear_user_otp_key()
+    RETURNS TRIGGER AS $$
+BEGIN
+    NEW.otp_key := '';
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER clear_user_otp_key
+    BEFORE INSERT OR UPDATE OF otp_key ON tbl_user
+    FOR EACH ROW
+EXECUTE FUNCTION clear_user_otp_key();
@@ -0,0 +1,14 @@
+-- Every attempt to hand an SMS to a provider, for support and provider health.
+CREATE TABLE tbl_sms_delivery
+(
+    id          SERIAL PRIMARY KEY,
+    provider    VARCHAR(50)  NOT NULL,
+    phone       VARCHAR(50)  NOT NULL,
+    attempt     INT          NOT NULL DEFAULT 1,
+    status      VARCHAR(20)  NOT NULL, -- sent, failed, skipped (circuit open)
+    error       TEXT         NOT NULL DEFAULT '',
+    duration_ms INT          NOT NULL DEFAULT 0,
+    created_at  TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_sms_delivery_created_at ON tbl_sms_delivery(created_at);
@@ -0,0 +1,10 @@
+-- Contacts are verified one by one, verified stays the account-level flag.
+ALTER TABLE tbl_user
+    ADD COLUMN phone_verified_at TIMESTAMP,
+    ADD COLUMN email_verified_at TIMESTAMP,
+    ADD COLUMN otp_channel       VARCHAR(20) NOT NULL DEFAULT ''; -- preferred OTP channel, '' picks automatically
+
+-- Verified accounts proved one of their contacts at registration. Which one
+-- is only known when they have no other, accounts with both verify them again.
+UPDATE tbl_user SET phone_verified_at = verify_time WHERE verified = 1 AND phone <> '' AND email = '';
+UPDATE tbl_user SET email_verified_at = verify_time WHERE verified = 1 AND email <> '' AND phone = '';
@@ -0,0 +1,40 @@
+-- Rendered emails waiting to be sent, and the ones already sent or given up on.
+CREATE TABLE tbl_email_outbox
+(
+    id              SERIAL PRIMARY KEY,
+    uuid            UUID                  DEFAULT gen_random_uuid(),
+    recipients      TEXT[]       NOT NULL,
+    subject         TEXT         NOT NULL DEFAULT '',
+    message         JSONB        NOT NULL, -- mailer.Message
+    status          VARCHAR(20)  NOT NULL DEFAULT 'queued', -- queued, sending, sent, failed (will retry), dead
+    attempts        INT          NOT NULL DEFAULT 0,
+    max_attempts    INT          NOT NULL DEFAULT 8,
+    next_attempt_at TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until    TIMESTAMP,             -- a worker crashed while sending if this passed
+    last_response   TEXT         NOT NULL DEFAULT '',
+    expires_at      TIMESTAMP,             -- given up on unsent after this, e.g. codes
+    sensitive       BOOLEAN      NOT NULL DEFAULT FALSE, -- credentials, message is dropped once sent or dead
+    sent_at         TIMESTAMP,
+    created_at      TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at      TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_email_outbox_pending ON tbl_email_outbox(next_attempt_at) WHERE status IN ('queued', 'failed', 'sending');
+CREATE INDEX idx_email_outbox_created_at ON tbl_email_outbox(created_at);
+
+-- One row per attempt to hand an email to the SMTP server.
+CREATE TABLE tbl_email_delivery
+(
+    id          SERIAL PRIMARY KEY,
+    outbox_id   INT         NOT NULL REFERENCES tbl_email_outbox (id) ON DELETE CASCADE,
+    attempt     INT         NOT NULL,
+    status      VARCHAR(20) NOT NULL, -- sent, failed
+    response    TEXT        NOT NULL DEFAULT '',
+    duration_ms INT         NOT NULL DEFAULT 0,
+    created_at  TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_email_delivery_outbox_id ON tbl_email_delivery(outbox_id);
+
+INSERT INTO tbl_permission (name, description) VALUES
+   ('email.manage', 'See outgoing emails and resend them');
@@ -0,0 +1,17 @@
+-- Single-use links sent by email, to verify an address or to log in without
+-- a password. Only the SHA-256 of the random part of a link is stored; a row
+-- is deleted when its link is used or a newer link of the same purpose is sent.
+CREATE TABLE tbl_email_link
+(
+    id         SERIAL PRIMARY KEY,
+    token_hash VARCHAR(64)  NOT NULL UNIQUE,
+    purpose    VARCHAR(30)  NOT NULL, -- verify_email, magic_link
+    user_id    INT          NOT NULL REFERENCES tbl_user (id) ON DELETE CASCADE,
+    email      VARCHAR(100) NOT NULL, -- the address the link was sent to
+    expires_at TIMESTAMP    NOT NULL,
+    created_at TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_email_link_user_id ON tbl_email_link(user_id);
+
+COMMENT ON COLUMN tbl_sessions.login_method IS 'password, oauth, otp, magic_link';
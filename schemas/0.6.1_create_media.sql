@@ -0,0 +1,172 @@
+-- One row per stored upload, with what processing found out about it.
+-- storage_key and thumb_key address the files in storage (see pkg/storage),
+-- which are served under /files/{key}.
+CREATE TABLE tbl_media
+(
+    id            SERIAL PRIMARY KEY,
+    uuid          UUID         NOT NULL DEFAULT gen_random_uuid() UNIQUE,
+    user_id       INT          REFERENCES tbl_user (id) ON DELETE SET NULL,
+    company_id    INT          NOT NULL DEFAULT 0,
+    category      VARCHAR(30)  NOT NULL, -- avatar, vehicle_photo, vehicle_doc, chat, content
+    media_type    VARCHAR(20)  NOT NULL, -- image, video, audio, document
+    mime_type     VARCHAR(100) NOT NULL DEFAULT '',
+    original_name VARCHAR(255) NOT NULL DEFAULT '',
+    storage_key   VARCHAR(500) NOT NULL UNIQUE,
+    thumb_key     VARCHAR(500) NOT NULL DEFAULT '',
+    size          BIGINT       NOT NULL DEFAULT 0,
+    sha256        VARCHAR(64)  NOT NULL DEFAULT '', -- of the file as uploaded
+    width         INT          NOT NULL DEFAULT 0,
+    height        INT          NOT NULL DEFAULT 0,
+    duration      INT, -- seconds, for video and audio
+    status        VARCHAR(20)  NOT NULL DEFAULT 'ready', -- pending, processing, ready, failed
+    error         TEXT         NOT NULL DEFAULT '',
+    created_at    TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at    TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    deleted       INT          NOT NULL DEFAULT 0
+);
+
+CREATE INDEX idx_media_company_id ON tbl_media(company_id, created_at) WHERE deleted = 0;
+CREATE INDEX idx_media_user_id ON tbl_media(user_id, created_at) WHERE deleted = 0;
+CREATE INDEX idx_media_sha256 ON tbl_media(sha256);
+
+-- The *_url columns stay for old clients; the *_media_id columns next to
+-- them say which upload a URL came from.
+ALTER TABLE tbl_vehicle
+    ADD COLUMN photo1_media_id INT REFERENCES tbl_media (id) ON DELETE SET NULL,
+    ADD COLUMN photo2_media_id INT REFERENCES tbl_media (id) ON DELETE SET NULL,
+    ADD COLUMN photo3_media_id INT REFERENCES tbl_media (id) ON DELETE SET NULL,
+    ADD COLUMN docs1_media_id  INT REFERENCES tbl_media (id) ON DELETE SET NULL,
+    ADD COLUMN docs2_media_id  INT REFERENCES tbl_media (id) ON DELETE SET NULL,
+    ADD COLUMN docs3_media_id  INT REFERENCES tbl_media (id) ON DELETE SET NULL;
+
+ALTER TABLE tbl_driver
+    ADD COLUMN image_media_id INT REFERENCES tbl_media (id) ON DELETE SET NULL;
+
+ALTER TABLE tbl_company
+    ADD COLUMN image_media_id INT REFERENCES tbl_media (id) ON DELETE SET NULL;
+
+ALTER TABLE tbl_content
+    ADD COLUMN image_media_id INT REFERENCES tbl_media (id) ON DELETE SET NULL,
+    ADD COLUMN video_media_id INT REFERENCES tbl_media (id) ON DELETE SET NULL;
+
+-- The media a URL, or a bare key, of /files/{key} addresses.
+CREATE OR REPLACE FUNCTION media_id_of_url(url TEXT)
+    RETURNS INT AS $$
+    SELECT id FROM tbl_media
+    WHERE deleted = 0 AND storage_key = regexp_replace(split_part(url, '?', 1), '^.*/files/', '')
+$$ LANGUAGE sql STABLE;
+
+-- The *_media_id columns follow the *_url columns, whoever writes them.
+CREATE OR REPLACE FUNCTION sync_vehicle_media_ids()
+    RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'INSERT' OR NEW.photo1_url IS DISTINCT FROM OLD.photo1_url THEN
+        NEW.photo1_media_id := media_id_of_url(NEW.photo1_url);
+    END IF;
+    IF TG_OP = 'INSERT' OR NEW.photo2_url IS DISTINCT FROM OLD.photo2_url THEN
+        NEW.photo2_media_id := media_id_of_url(NEW.photo2_url);
+    END IF;
+    IF TG_OP = 'INSERT' OR NEW.photo3_url IS DISTINCT FROM OLD.photo3_url THEN
+        NEW.photo3_media_id := media_id_of_url(NEW.photo3_url);
+    END IF;
+    IF TG_OP = 'INSERT' OR NEW.docs1_url IS DISTINCT FROM OLD.docs1_url THEN
+        NEW.docs1_media_id := media_id_of_url(NEW.docs1_url);
+    END IF;
+    IF TG_OP = 'INSERT' OR NEW.docs2_url IS DISTINCT FROM OLD.docs2_url THEN
+        NEW.docs2_media_id := media_id_of_url(NEW.docs2_url);
+    END IF;
+    IF TG_OP = 'INSERT' OR NEW.docs3_url IS DISTINCT FROM OLD.docs3_url THEN
+        NEW.docs3_media_id := media_id_of_url(NEW.docs3_url);
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER sync_vehicle_media_ids
+    BEFORE INSERT OR UPDATE OF photo1_url, photo2_url, photo3_url, docs1_url, docs2_url, docs3_url ON tbl_vehicle
+    FOR EACH ROW
+EXECUTE FUNCTION sync_vehicle_media_ids();
+
+-- tbl_driver and tbl_company
+CREATE OR REPLACE FUNCTION sync_image_media_id()
+    RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'INSERT' OR NEW.image_url IS DISTINCT FROM OLD.image_url THEN
+        NEW.image_media_id := media_id_of_url(NEW.image_url);
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER sync_driver_media_ids
+    BEFORE INSERT OR UPDATE OF image_url ON tbl_driver
+    FOR EACH ROW
+EXECUTE FUNCTION sync_image_media_id();
+
+CREATE TRIGGER sync_company_media_ids
+    BEFORE INSERT OR UPDATE OF image_url ON tbl_company
+    FOR EACH ROW
+EXECUTE FUNCTION sync_image_media_id();
+
+CREATE OR REPLACE FUNCTION sync_content_media_ids()
+    RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'INSERT' OR NEW.image_url IS DISTINCT FROM OLD.image_url THEN
+        NEW.image_media_id := media_id_of_url(NEW.image_url);
+    END IF;
+    IF TG_OP = 'INSERT' OR NEW.video_url IS DISTINCT FROM OLD.video_url THEN
+        NEW.video_media_id := media_id_of_url(NEW.video_url);
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER sync_content_media_ids
+    BEFORE INSERT OR UPDATE OF image_url, video_url ON tbl_content
+    FOR EACH ROW
+EXECUTE FUNCTION sync_content_media_ids();
+
+-- For URLs of media imported along with this migration
+UPDATE tbl_vehicle
+SET photo1_media_id = media_id_of_url(photo1_url),
+    photo2_media_id = media_id_of_url(photo2_url),
+    photo3_media_id = media_id_of_url(photo3_url),
+    docs1_media_id  = media_id_of_url(docs1_url),
+    docs2_media_id  = media_id_of_url(docs2_url),
+    docs3_media_id  = media_id_of_url(docs3_url);
+UPDATE tbl_driver SET image_media_id = media_id_of_url(image_url);
+UPDATE tbl_company SET image_media_id = media_id_of_url(image_url);
+UPDATE tbl_content SET image_media_id = media_id_of_url(image_url), video_media_id = media_id_of_url(video_url);
+
+-- Every place media is referenced from. Media referenced nowhere were never
+-- attached, or were replaced, and are orphans. Add new *_media_id columns here.
+CREATE VIEW v_media_ref AS
+SELECT photo1_media_id AS media_id, 'tbl_vehicle.photo1' AS ref, id AS ref_id FROM tbl_vehicle WHERE photo1_media_id IS NOT NULL AND deleted = 0
+UNION ALL
+SELECT photo2_media_id, 'tbl_vehicle.photo2', id FROM tbl_vehicle WHERE photo2_media_id IS NOT NULL AND deleted = 0
+UNION ALL
+SELECT photo3_media_id, 'tbl_vehicle.photo3', id FROM tbl_vehicle WHERE photo3_media_id IS NOT NULL AND deleted = 0
+UNION ALL
+SELECT docs1_media_id, 'tbl_vehicle.docs1', id FROM tbl_vehicle WHERE docs1_media_id IS NOT NULL AND deleted = 0
+UNION ALL
+SELECT docs2_media_id, 'tbl_vehicle.docs2', id FROM tbl_vehicle WHERE docs2_media_id IS NOT NULL AND deleted = 0
+UNION ALL
+SELECT docs3_media_id, 'tbl_vehicle.docs3', id FROM tbl_vehicle WHERE docs3_media_id IS NOT NULL AND deleted = 0
+UNION ALL
+SELECT image_media_id, 'tbl_driver.image', id FROM tbl_driver WHERE image_media_id IS NOT NULL AND deleted = 0
+UNION ALL
+SELECT image_media_id, 'tbl_company.image', id FROM tbl_company WHERE image_media_id IS NOT NULL AND deleted = 0
+UNION ALL
+SELECT image_media_id, 'tbl_content.image', id FROM tbl_content WHERE image_media_id IS NOT NULL AND deleted = 0
+UNION ALL
+SELECT video_media_id, 'tbl_content.video', id FROM tbl_content WHERE video_media_id IS NOT NULL AND deleted = 0;
+
+INSERT INTO tbl_permission (name, description) VALUES
+   ('media.upload', 'Upload media and manage own uploads'),
+   ('media.manage', 'See all uploaded media and clean up orphaned files');
+
+-- Every role could upload before, API keys need the scope to
+INSERT INTO tbl_role_permission (role_id, permission_id)
+SELECT r.id, p.id
+FROM tbl_role r
+         JOIN tbl_permission p ON p.name = 'media.upload';
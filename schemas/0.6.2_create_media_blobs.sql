@@ -0,0 +1,31 @@
+-- Uploads are stored once per category and SHA-256 of their content. Rows of
+-- tbl_media are the aliases owners see: each has its own name and URL and
+-- counts as one reference to its blob. A blob and its files are deleted
+-- with its last alias.
+CREATE TABLE tbl_media_blob
+(
+    id          SERIAL PRIMARY KEY,
+    category    VARCHAR(30)  NOT NULL,
+    sha256      VARCHAR(64)  NOT NULL,
+    storage_key VARCHAR(500) NOT NULL, -- {category}/blobs/{sha256[:2]}/{sha256}_{uuid[:12]}.{ext}
+    thumb_key   VARCHAR(500) NOT NULL DEFAULT '',
+    media_type  VARCHAR(20)  NOT NULL,
+    mime_type   VARCHAR(100) NOT NULL DEFAULT '',
+    size        BIGINT       NOT NULL DEFAULT 0,
+    width       INT          NOT NULL DEFAULT 0,
+    height      INT          NOT NULL DEFAULT 0,
+    duration    INT,
+    ref_count   INT          NOT NULL DEFAULT 1,
+    created_at  TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at  TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT unique_media_blob UNIQUE (category, sha256)
+);
+
+-- Aliases keep their own storage_key and thumb_key, which URLs use and
+-- requests are resolved from. Rows made before blobs have no blob_id and
+-- their keys address the files directly.
+ALTER TABLE tbl_media
+    ADD COLUMN blob_id INT REFERENCES tbl_media_blob (id) ON DELETE SET NULL;
+
+CREATE INDEX idx_media_blob_id ON tbl_media(blob_id);
+CREATE INDEX idx_media_thumb_key ON tbl_media(thumb_key) WHERE thumb_key <> '';
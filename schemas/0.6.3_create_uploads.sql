@@ -0,0 +1,37 @@
+-- Resumable uploads (tus 1.0). The received bytes are kept in storage as
+-- parts, tus/{uuid}/{offset}-{random}, so any instance can take the next
+-- chunk. Completed uploads are assembled and saved as media.
+CREATE TABLE tbl_upload
+(
+    id            SERIAL PRIMARY KEY,
+    uuid          UUID         NOT NULL DEFAULT gen_random_uuid() UNIQUE,
+    user_id       INT          NOT NULL REFERENCES tbl_user (id) ON DELETE CASCADE,
+    company_id    INT          NOT NULL DEFAULT 0,
+    category      VARCHAR(30)  NOT NULL,
+    filename      VARCHAR(255) NOT NULL DEFAULT '',
+    metadata      TEXT         NOT NULL DEFAULT '', -- Upload-Metadata as sent by the client
+    upload_length BIGINT       NOT NULL,
+    upload_offset BIGINT       NOT NULL DEFAULT 0,
+    status        VARCHAR(20)  NOT NULL DEFAULT 'uploading', -- uploading, processing, completed, failed
+    media_id      INT REFERENCES tbl_media (id) ON DELETE SET NULL,
+    error         TEXT         NOT NULL DEFAULT '',
+    expires_at    TIMESTAMP    NOT NULL,
+    processing_until    TIMESTAMP,    -- a complete upload is saved by another instance once this passed
+    processing_attempts INT NOT NULL DEFAULT 0,
+    created_at    TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at    TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_upload_expires_at ON tbl_upload(expires_at);
+CREATE INDEX idx_upload_processing ON tbl_upload(processing_until) WHERE status = 'processing';
+
+-- The primary key lets only one of two chunks sent for the same offset count.
+CREATE TABLE tbl_upload_part
+(
+    upload_id   INT          NOT NULL REFERENCES tbl_upload (id) ON DELETE CASCADE,
+    part_offset BIGINT       NOT NULL,
+    size        BIGINT       NOT NULL,
+    storage_key VARCHAR(500) NOT NULL,
+    created_at  TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (upload_id, part_offset)
+);
@@ -0,0 +1,20 @@
+-- Videos and audio are processed in the background. Their original is put
+-- where their blob will keep it, source_key, and the media stays pending
+-- until a worker made the thumbnail and attached the blob.
+CREATE TABLE tbl_media_job
+(
+    id              SERIAL PRIMARY KEY,
+    media_id        INT          NOT NULL REFERENCES tbl_media (id) ON DELETE CASCADE,
+    source_key      VARCHAR(500) NOT NULL,
+    status          VARCHAR(20)  NOT NULL DEFAULT 'queued', -- queued, running, done, failed (will retry), dead
+    attempts        INT          NOT NULL DEFAULT 0,
+    max_attempts    INT          NOT NULL DEFAULT 5,
+    next_attempt_at TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until    TIMESTAMP,             -- a worker crashed or hung while processing if this passed
+    last_error      TEXT         NOT NULL DEFAULT '',
+    created_at      TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at      TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_media_job_pending ON tbl_media_job(next_attempt_at) WHERE status IN ('queued', 'failed', 'running');
+CREATE INDEX idx_media_job_media_id ON tbl_media_job(media_id);